@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package capture defines the bundles recording an authorization request along with the responses of the docker
+// daemon, the registry, the notary server and the workload agent the decision was taken with, so the decision
+// can be replayed away from the node it was taken on.
+package capture
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"secure-docker-plugin/v3/integrity"
+	"secure-docker-plugin/v3/wla"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+const (
+	// BundleVersion is the version of the bundle format written by this plugin
+	BundleVersion = 2
+
+	bundlePrefix  = "bundle-"
+	bundleFileExt = ".json"
+	// bundleTimeFormat names the bundles so they sort in capture order
+	bundleTimeFormat = "20060102T150405.000000000Z"
+)
+
+// Failure is a recorded error
+type Failure struct {
+	Message string `json:"message"`
+	// Kind classifies the error: a workload agent error kind, or NotFound for the docker objects
+	Kind   string `json:"kind,omitempty"`
+	Method string `json:"method,omitempty"`
+}
+
+// NotFound is the kind of the docker errors reporting a missing image or container
+const NotFound = "not-found"
+
+// Image is a recorded image inspection
+type Image struct {
+	Inspect *types.ImageInspect `json:"inspect,omitempty"`
+	Error   *Failure            `json:"error,omitempty"`
+}
+
+// Container is a recorded container inspection
+type Container struct {
+	Inspect *types.ContainerJSON `json:"inspect,omitempty"`
+	Error   *Failure             `json:"error,omitempty"`
+}
+
+// Digest is a recorded registry lookup
+type Digest struct {
+	Digest string   `json:"digest,omitempty"`
+	Error  *Failure `json:"error,omitempty"`
+}
+
+// Flavor is a recorded flavor fetched from the workload agent or the flavor cache
+type Flavor struct {
+	Flavor *wla.Flavor `json:"flavor,omitempty"`
+	Error  *Failure    `json:"error,omitempty"`
+}
+
+// Key is a recorded key request, only the key size is kept
+type Key struct {
+	Size  int      `json:"size"`
+	Error *Failure `json:"error,omitempty"`
+}
+
+// Integrity is a recorded signature verification
+type Integrity struct {
+	Digest string `json:"digest,omitempty"`
+	Signer string `json:"signer,omitempty"`
+	// IntegrityError is set when the verification failed with a classified error, Error otherwise
+	IntegrityError *integrity.Error `json:"integrity_error,omitempty"`
+	Error          *Failure         `json:"error,omitempty"`
+}
+
+// Wla is the recorded state of the workload agent connection
+type Wla struct {
+	Installed bool     `json:"installed"`
+	Error     *Failure `json:"error,omitempty"`
+}
+
+// Bundle is a captured authorization request with everything its decision depended on
+type Bundle struct {
+	Version    int       `json:"version"`
+	CapturedAt time.Time `json:"captured_at"`
+	// Config is the configuration in use, in YAML with the secrets redacted
+	Config  string                `json:"config"`
+	Request authorization.Request `json:"request"`
+
+	// Responses keyed by image reference, container reference, image UUID, key URL and IntegrityKey
+	Images     map[string]Image     `json:"images,omitempty"`
+	Containers map[string]Container `json:"containers,omitempty"`
+	Digests    map[string]Digest    `json:"digests,omitempty"`
+	Flavors    map[string]Flavor    `json:"flavors,omitempty"`
+	Keys       map[string]Key       `json:"keys,omitempty"`
+	Integrity  map[string]Integrity `json:"integrity,omitempty"`
+	// FlavorSignatures holds the flavor signature verifications by flavor ID, nil for a verified signature
+	FlavorSignatures map[string]*Failure `json:"flavor_signatures,omitempty"`
+	// Wla is set once the workload agent connection was looked up
+	Wla *Wla `json:"wla,omitempty"`
+	// Revocations holds the revocation reason of the revoked images looked up, by image ID
+	Revocations map[string]string `json:"revocations,omitempty"`
+
+	// Decision is the decision taken, Response the response returned to the docker daemon
+	Decision json.RawMessage        `json:"decision"`
+	Response authorization.Response `json:"response"`
+}
+
+// NewBundle starts a bundle for a request, the request is sanitized
+func NewBundle(req authorization.Request, config string) *Bundle {
+	return &Bundle{
+		Version:     BundleVersion,
+		CapturedAt:  time.Now().UTC(),
+		Config:      config,
+		Request:     SanitizeRequest(req),
+		Images:      make(map[string]Image),
+		Containers:  make(map[string]Container),
+		Digests:     make(map[string]Digest),
+		Flavors:     make(map[string]Flavor),
+		Keys:        make(map[string]Key),
+		Integrity:   make(map[string]Integrity),
+		Revocations: make(map[string]string),
+
+		FlavorSignatures: make(map[string]*Failure),
+	}
+}
+
+// IntegrityKey is the key of the signature verification of an image with a notary server
+func IntegrityKey(notaryURL, imageRef string) string {
+	return notaryURL + " " + imageRef
+}
+
+// Save writes a bundle to dir and removes the oldest bundles beyond maxBundles, it returns the bundle path
+func Save(dir string, bundle *Bundle, maxBundles int) (string, error) {
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "Error marshalling capture bundle")
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrapf(err, "Unable to create capture directory %s", dir)
+	}
+	name := bundlePrefix + bundle.CapturedAt.UTC().Format(bundleTimeFormat) + bundleFileExt
+	tmp, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to create capture bundle")
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	path := filepath.Join(dir, name)
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", errors.Wrap(err, "Unable to write capture bundle")
+	}
+
+	return path, prune(dir, maxBundles)
+}
+
+// prune removes the oldest bundles of dir beyond maxBundles
+func prune(dir string, maxBundles int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read capture directory %s", dir)
+	}
+	var bundles []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), bundlePrefix) && strings.HasSuffix(entry.Name(), bundleFileExt) {
+			bundles = append(bundles, entry.Name())
+		}
+	}
+	sort.Strings(bundles)
+	for len(bundles) > maxBundles {
+		if err = os.Remove(filepath.Join(dir, bundles[0])); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Unable to remove capture bundle")
+		}
+		bundles = bundles[1:]
+	}
+	return nil
+}
+
+// Load reads a bundle
+func Load(path string) (*Bundle, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read capture bundle %s", path)
+	}
+	var bundle Bundle
+	if err = json.Unmarshal(data, &bundle); err != nil {
+		return nil, errors.Wrapf(err, "Invalid capture bundle %s", path)
+	}
+	if bundle.Version < 1 || bundle.Version > BundleVersion {
+		return nil, errors.Errorf("Capture bundle %s has version %d, version %d is supported", path, bundle.Version,
+			BundleVersion)
+	}
+	return &bundle, nil
+}
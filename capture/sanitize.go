@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package capture
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+const redactedValue = "********"
+
+// sensitiveHeaders carry credentials and are redacted from the captured requests
+var sensitiveHeaders = []string{"Authorization", "Cookie", "X-Registry-Auth", "X-Registry-Config"}
+
+// SanitizeRequest returns a copy of a request without the credentials and environment variable values it may
+// carry. The parts of the request the plugin decides on are kept.
+func SanitizeRequest(req authorization.Request) authorization.Request {
+	sanitized := req
+	sanitized.ResponseBody = nil
+
+	sanitized.RequestHeaders = sanitizeHeaders(req.RequestHeaders)
+	sanitized.ResponseHeaders = sanitizeHeaders(req.ResponseHeaders)
+	sanitized.RequestBody = sanitizeBody(req.RequestBody)
+	return sanitized
+}
+
+func sanitizeHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	sanitized := make(map[string]string, len(headers))
+	for name, value := range headers {
+		sanitized[name] = value
+		for _, sensitive := range sensitiveHeaders {
+			if http.CanonicalHeaderKey(name) == sensitive {
+				sanitized[name] = redactedValue
+			}
+		}
+	}
+	return sanitized
+}
+
+// sanitizeBody redacts the values of the environment variables of a container create request,
+// bodies which are not a JSON object are dropped
+func sanitizeBody(body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
+
+	var env []string
+	if err := json.Unmarshal(fields["Env"], &env); err == nil && env != nil {
+		for i, variable := range env {
+			env[i] = strings.SplitN(variable, "=", 2)[0] + "=" + redactedValue
+		}
+		fields["Env"], _ = json.Marshal(env)
+	}
+
+	sanitized, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return sanitized
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// fake-wlagent serves a workload agent simulator on a unix socket, for development and integration tests
+// of the secure docker plugin without an ISecL workload agent.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/wla/fake"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	socket := flag.String("socket", config.Get().Wla.Socket, "Specifies the unix socket to listen on")
+	flavorDir := flag.String("flavors", ".", "Specifies the directory holding the flavors, named <image UUID>.json")
+	manifestDir := flag.String("manifests", "", "Specifies the directory receiving the manifests")
+	keyFile := flag.String("key", "", "Specifies the file holding the key returned for every key URL")
+	latency := flag.Duration("latency", 0, "Specifies the delay of every call")
+	failureRate := flag.Float64("failure-rate", 0, "Specifies the probability that a call fails, between 0 and 1")
+	failMethods := flag.String("fail-methods", "", "Specifies the comma separated methods that can fail, such as VirtualMachine.FetchFlavor, all when empty")
+	flag.Parse()
+
+	opts := fake.Options{
+		FlavorDir:   *flavorDir,
+		ManifestDir: *manifestDir,
+		Latency:     *latency,
+		FailureRate: *failureRate,
+	}
+	if *failMethods != "" {
+		opts.FailMethods = strings.Split(*failMethods, ",")
+	}
+	if *keyFile != "" {
+		key, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			log.Fatalf("Unable to read the key: %v", err)
+		}
+		opts.Key = key
+	}
+
+	server, err := fake.Listen(*socket, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Fake workload agent listening on %s", *socket)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+	server.Close()
+	os.Remove(*socket)
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"secure-docker-plugin/v3/capture"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/nri"
+	"secure-docker-plugin/v3/ocihook"
+	"secure-docker-plugin/v3/plugin"
+	"secure-docker-plugin/v3/webhook"
+)
+
+// configCommand handles the config subcommands and returns the process exit code
+func configCommand(args []string, configFile, dockerHost string) int {
+	if len(args) != 1 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "Usage: secure-docker-plugin [options] config validate")
+		return 2
+	}
+
+	cfg, err := loadConfiguration(configFile, dockerHost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("Configuration %s is valid, effective settings:\n\n%s", configFile, cfg)
+	return 0
+}
+
+// versionCommand prints the build information
+func versionCommand() int {
+	fmt.Printf("Secure Docker Plugin %s\nBuild date: %s\nGit hash: %s\n", Version, BuildDate, GitHash)
+	if Branch != "" {
+		fmt.Printf("Branch: %s\n", Branch)
+	}
+	return 0
+}
+
+// newPlugin creates a plugin instance for the offline commands
+func newPlugin(configFile, dockerHost string) (*plugin.SecureDockerPlugin, error) {
+	cfg, err := loadConfiguration(configFile, dockerHost)
+	if err != nil {
+		return nil, err
+	}
+	config.Set(cfg)
+	return plugin.NewPlugin(cfg.Docker.Host, cfg.Wla.Socket)
+}
+
+// printDecision writes the decision to stdout and returns 0 when allowed, 1 when denied
+func printDecision(decision plugin.Decision) int {
+	out, err := json.MarshalIndent(decision, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(out))
+	if !decision.Allow {
+		return 1
+	}
+	return 0
+}
+
+// verifyCommand runs the image policy and integrity checks for an image
+func verifyCommand(args []string, configFile, dockerHost string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: secure-docker-plugin [options] verify <image>")
+		return 2
+	}
+
+	sdp, err := newPlugin(configFile, dockerHost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return printDecision(sdp.VerifyImage(args[0]))
+}
+
+// simulateCommand runs a captured authorization request through the plugin
+func simulateCommand(args []string, configFile, dockerHost string) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	requestFile := flags.String("request", "", "Specifies the JSON file holding the authorization request")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *requestFile == "" || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: secure-docker-plugin [options] simulate --request <request.json>")
+		return 2
+	}
+
+	data, err := ioutil.ReadFile(*requestFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var req authorization.Request
+	if err = json.Unmarshal(data, &req); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid authorization request in %s: %v\n", *requestFile, err)
+		return 1
+	}
+
+	sdp, err := newPlugin(configFile, dockerHost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return printDecision(sdp.Authorize(req))
+}
+
+// statusCommand prints the recorded decision and trust report status of a container
+func statusCommand(args []string, configFile, dockerHost string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: secure-docker-plugin [options] status <container>")
+		return 2
+	}
+
+	sdp, err := newPlugin(configFile, dockerHost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	status, err := sdp.ContainerStatus(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	out, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
+
+// replayCommand takes again the decision of a capture bundle, it returns 0 when the replayed decision matches the
+// captured one and 1 otherwise
+func replayCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: secure-docker-plugin replay <bundle>")
+		return 2
+	}
+
+	bundle, err := capture.Load(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var captured plugin.Decision
+	if err = json.Unmarshal(bundle.Decision, &captured); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid decision in %s: %v\n", args[0], err)
+		return 1
+	}
+	replayed, resp, err := plugin.Replay(bundle)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	out, err := json.MarshalIndent(struct {
+		Captured         plugin.Decision        `json:"captured"`
+		Replayed         plugin.Decision        `json:"replayed"`
+		CapturedResponse authorization.Response `json:"captured_response"`
+		ReplayedResponse authorization.Response `json:"replayed_response"`
+	}{captured, replayed, bundle.Response, resp}, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(out))
+	if replayed.Allow != captured.Allow || replayed.Code != captured.Code || replayed.Audited != captured.Audited {
+		fmt.Fprintln(os.Stderr, "The replayed decision differs from the captured one")
+		return 1
+	}
+	return 0
+}
+
+// ociHookCommand runs the OCI runtime hook on the container state read from stdin, it returns 1 for a container
+// denied by the createRuntime or prestart hooks so the container runtime does not start it
+func ociHookCommand(args []string, configFile string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: secure-docker-plugin [options] oci-hook < state.json")
+		return 2
+	}
+
+	cfg, err := loadConfiguration(configFile, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	config.Set(cfg)
+	if err = applyLogging(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	state, err := ocihook.ReadState(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err = newOCIHook(cfg).Run(state); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// newOCIHook creates the OCI runtime hook of the runtimes other than docker
+func newOCIHook(cfg *config.Configuration) *ocihook.Hook {
+	return ocihook.New(plugin.NewEngine(cfg.Wla.Socket), ocihook.CommandInspector{Command: cfg.OCIHook.InspectCommand},
+		cfg.OCIHook.SpoolDir)
+}
+
+// nriCommand runs the containerd NRI v0.1 plugin on the request read from stdin and prints its result, it returns 1
+// for a container denied on its creation so containerd does not start it
+func nriCommand(args []string, configFile string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: secure-docker-plugin [options] invoke < request.json")
+		return 2
+	}
+
+	cfg, err := loadConfiguration(configFile, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	config.Set(cfg)
+	if err = applyLogging(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	request, err := nri.ReadRequest(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	result, err := nri.New(newOCIHook(cfg)).Invoke(request)
+	if err == nil {
+		err = json.NewEncoder(os.Stdout).Encode(result)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// webhookCommand serves the Kubernetes validating admission webhook until the listener fails
+func webhookCommand(args []string, configFile string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: secure-docker-plugin [options] webhook")
+		return 2
+	}
+
+	cfg, err := loadConfiguration(configFile, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if cfg.Webhook.TLSCert == "" {
+		fmt.Fprintln(os.Stderr, "webhook.tls-cert and webhook.tls-key are required, the API server only calls webhooks over HTTPS")
+		return 1
+	}
+	config.Set(cfg)
+	if err = applyLogging(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(webhook.ValidateURI, webhook.New(plugin.NewEngine(cfg.Wla.Socket)))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	log.Printf("Serving the admission webhook on %s%s", cfg.Webhook.Listen, webhook.ValidateURI)
+	err = http.ListenAndServeTLS(cfg.Webhook.Listen, cfg.Webhook.TLSCert, cfg.Webhook.TLSKey, mux)
+	log.Println(err)
+	return 1
+}
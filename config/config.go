@@ -6,34 +6,790 @@ package config
  */
 
 import (
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"secure-docker-plugin/v3/flavorsig"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-// EnvVariables is a struct containing data required for contacting docker registry server
-type EnvVariables struct {
-	Username   string
-	Password   string
-	SchemeType string
-	SkipVerify bool
+const (
+	// DefaultConfigFile is the location of the plugin configuration file
+	DefaultConfigFile = "/etc/secure-docker-plugin/config.yml"
+
+	// ActionAllow and ActionDeny are the decisions a policy setting can take
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+
+	// RemediationNone only reports the non compliant running containers, RemediationStop stops them
+	RemediationNone = "none"
+	RemediationStop = "stop"
+
+	// EnforcementEnforce denies the requests failing the policy,
+	// EnforcementAudit only reports them and lets them through
+	EnforcementEnforce = "enforce"
+	EnforcementAudit   = "audit"
+
+	// FlavorKeyImageID, FlavorKeyDigest, FlavorKeyTag, FlavorKeyRepository and FlavorKeyRepositoryPattern are the
+	// keys an image flavor can be looked up with: the local image ID, the manifest digest, the repository and tag,
+	// the repository, and the first flavor-lookup.repository-patterns pattern matching the repository
+	FlavorKeyImageID           = "image-id"
+	FlavorKeyDigest            = "digest"
+	FlavorKeyTag               = "tag"
+	FlavorKeyRepository        = "repository"
+	FlavorKeyRepositoryPattern = "repository-pattern"
+
+	redactedValue = "********"
+)
+
+// Configuration holds the settings of the secure docker plugin. The secret settings are tagged secret:"value" when
+// their whole value is secret and secret:"userinfo" for the URLs which can carry a password, see Redacted.
+type Configuration struct {
+	Docker          DockerConfig          `yaml:"docker"`
+	Plugin          PluginConfig          `yaml:"plugin"`
+	Wla             WlaConfig             `yaml:"wla"`
+	Registry        RegistryConfig        `yaml:"registry"`
+	Notary          NotaryConfig          `yaml:"notary"`
+	Policy          PolicyConfig          `yaml:"policy"`
+	FlavorSignature FlavorSignatureConfig `yaml:"flavor-signature"`
+	FlavorLookup    FlavorLookupConfig    `yaml:"flavor-lookup"`
+	TrustReport     TrustReportConfig     `yaml:"trust-report"`
+	Reconcile       ReconcileConfig       `yaml:"reconcile"`
+	Reverify        ReverifyConfig        `yaml:"reverify"`
+	State           StateConfig           `yaml:"state"`
+	Cache           CacheConfig           `yaml:"cache"`
+	Logging         LoggingConfig         `yaml:"logging"`
+	Capture         CaptureConfig         `yaml:"capture"`
+	OCIHook         OCIHookConfig         `yaml:"oci-hook"`
+	Webhook         WebhookConfig         `yaml:"webhook"`
+}
+
+// DockerConfig holds the settings used to connect to the docker daemon
+type DockerConfig struct {
+	Host           string   `yaml:"host" secret:"userinfo"`
+	ConnectTimeout Duration `yaml:"connect-timeout"`
+}
+
+// PluginConfig holds the settings of the authorization plugin listener
+type PluginConfig struct {
+	Socket string `yaml:"socket"`
+}
+
+// WlaConfig holds the settings used to connect to the workload agent
+type WlaConfig struct {
+	Socket      string   `yaml:"socket"`
+	DialTimeout Duration `yaml:"dial-timeout"`
+	// ConnectTimeout is how long the plugin waits for the workload agent on startup
+	ConnectTimeout Duration `yaml:"connect-timeout"`
+	// CallTimeout bounds every call to the workload agent
+	CallTimeout Duration `yaml:"call-timeout"`
+	// ReconnectMin and ReconnectMax bound the delay between the reconnection attempts, changes require a restart
+	ReconnectMin Duration `yaml:"reconnect-min"`
+	ReconnectMax Duration `yaml:"reconnect-max"`
+}
+
+// RegistryConfig is a struct containing data required for contacting docker registry server
+type RegistryConfig struct {
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password" secret:"value"`
+	SchemeType string `yaml:"scheme"`
+	SkipVerify bool   `yaml:"insecure-skip-verify"`
+	// TokenURL is the token endpoint, %s is replaced by the image repository
+	TokenURL string `yaml:"token-url" secret:"userinfo"`
+}
+
+// NotaryConfig holds the settings of the notary clients verifying the image signatures
+type NotaryConfig struct {
+	// TrustDir caches the trust data of every repository per notary server, its root of trust pinned the first time
+	// it is fetched
+	TrustDir string `yaml:"trust-dir"`
+	// Timeout bounds every request to a notary server
+	Timeout Duration `yaml:"timeout"`
+}
+
+// PolicyConfig holds the decisions taken when no flavor based decision can be made
+type PolicyConfig struct {
+	// WlaUnavailable applies when the workload agent socket does not exist
+	WlaUnavailable string `yaml:"wla-unavailable"`
+	// FlavorNotFound applies when the workload agent has no flavor for the image
+	FlavorNotFound string `yaml:"flavor-not-found"`
+	// UnsignedFlavor applies to the flavors without signature, or which cannot be verified for lack of certificate.
+	// When empty, unsigned flavors are denied once flavor-signature.certificate is set, see UnsignedFlavorAction.
+	UnsignedFlavor string `yaml:"unsigned-flavor"`
+	// Enforcement is the default enforcement mode, either enforce or audit
+	Enforcement string `yaml:"enforcement"`
+	// Rules apply to the images they match, the first matching rule applies
+	Rules []PolicyRule `yaml:"rules"`
+	// RedactDenialDetails replaces the denial details returned to the docker client by a generic message
+	RedactDenialDetails bool `yaml:"redact-denial-details"`
+	// AllowedCiphers are the ciphers accepted for the images requiring confidentiality, any cipher when empty
+	AllowedCiphers []string `yaml:"allowed-ciphers"`
+}
+
+// FlavorSignatureConfig holds the certificates the flavor signatures are verified with, the signatures are not
+// verified when Certificate is empty
+type FlavorSignatureConfig struct {
+	// Certificate is the PEM file with the flavor signing certificate followed by its intermediate CA certificates
+	Certificate string `yaml:"certificate"`
+	// TrustedCA is the PEM file with the root CA certificates the flavor signing certificate must chain to
+	TrustedCA string `yaml:"trusted-ca"`
+}
+
+// FlavorLookupConfig holds the keys the image flavors are looked up with
+type FlavorLookupConfig struct {
+	// Keys are the kinds of keys tried in turn, the flavor found with the first one applies
+	Keys []string `yaml:"keys"`
+	// RepositoryPatterns are path.Match patterns matched against the image repository, an image flavor can be
+	// associated with the first matching pattern
+	RepositoryPatterns []string `yaml:"repository-patterns"`
+}
+
+// PolicyRule sets the decision or the enforcement mode of the images matching a pattern
+type PolicyRule struct {
+	Name string `yaml:"name"`
+	// Image is a path.Match pattern matched against the normalized image reference, see MatchRule
+	Image string `yaml:"image"`
+	// Action denies the images without checking their flavor, the flavor decides when empty. Allowing the images
+	// without checking their flavor and integrity takes SkipVerification as well.
+	Action           string `yaml:"action"`
+	SkipVerification bool   `yaml:"skip-verification"`
+	Enforcement      string `yaml:"enforcement"`
+}
+
+// TrustReportConfig holds the settings of the trust report delivery
+type TrustReportConfig struct {
+	// SpoolDir keeps the reports until the workload agent accepted them, changes require a restart
+	SpoolDir string `yaml:"spool-dir"`
+	// RetryMin and RetryMax bound the delay between delivery attempts while the workload agent is unavailable
+	RetryMin Duration `yaml:"retry-min"`
+	RetryMax Duration `yaml:"retry-max"`
+	// Workers create the reports from a queue of QueueSize containers, changes require a restart
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queue-size"`
+	// EnqueueTimeout is how long to wait for room in a full queue before queuing beyond QueueSize
+	EnqueueTimeout Duration `yaml:"enqueue-timeout"`
+	// WatchEvents reports the containers started without going through the plugin, changes require a restart
+	WatchEvents bool `yaml:"watch-events"`
+}
+
+// ReconcileConfig holds the settings of the reconciliation of the running containers against the policy
+type ReconcileConfig struct {
+	// Enabled runs the reconciliation on startup and on configuration reload, off by default as it verifies the
+	// image of every running container
+	Enabled bool `yaml:"enabled"`
+	// Remediation applied to the non compliant containers, either none or stop
+	Remediation string `yaml:"remediation"`
+	// StopTimeout is the grace period given to a container stopped by the remediation
+	StopTimeout Duration `yaml:"stop-timeout"`
+}
+
+// ReverifyConfig holds the settings of the periodic verification of the running images signatures
+type ReverifyConfig struct {
+	// Interval between two verifications, 0 disables them
+	Interval Duration `yaml:"interval"`
+	// BlockRevoked denies the creation of containers from an image whose signature was revoked
+	BlockRevoked bool `yaml:"block-revoked"`
+	// Remediation applied to the containers of a revoked image, either none or stop
+	Remediation string `yaml:"remediation"`
+	// StopTimeout is the grace period given to a container stopped by the remediation
+	StopTimeout Duration `yaml:"stop-timeout"`
+	// RevocationFile keeps the revoked images across restarts, changes require a restart
+	RevocationFile string `yaml:"revocation-file"`
+}
+
+// StateConfig holds the settings of the container state store
+type StateConfig struct {
+	// Dir keeps the decision and trust report status of every container, changes require a restart
+	Dir string `yaml:"dir"`
+}
+
+// CacheConfig holds the settings of the flavor cache
+type CacheConfig struct {
+	// FlavorTTL is how long a fetched flavor is reused, 0 disables the cache
+	FlavorTTL Duration `yaml:"flavor-ttl"`
+}
+
+// LoggingConfig holds the logging settings
+type LoggingConfig struct {
+	// File is the log file, logs are written to stderr when empty
+	File string `yaml:"file"`
+	// AuditFile receives a JSON record for every request denied in audit mode
+	AuditFile string `yaml:"audit-file"`
+}
+
+// CaptureConfig holds the settings of the capture of the authorization requests
+type CaptureConfig struct {
+	// Enabled records the create and start requests with the responses their decision depended on
+	Enabled bool `yaml:"enabled"`
+	// Dir receives a bundle per captured request
+	Dir string `yaml:"dir"`
+	// DeniedOnly captures only the requests denied, or which would be denied in audit mode
+	DeniedOnly bool `yaml:"denied-only"`
+	// MaxBundles is the number of bundles kept in Dir, the oldest are removed
+	MaxBundles int `yaml:"max-bundles"`
+}
+
+// OCIHookConfig holds the settings of the OCI runtime hook run by the container runtimes other than docker
+type OCIHookConfig struct {
+	// ImageAnnotations are the container annotations holding the image reference, the first one set applies
+	ImageAnnotations []string `yaml:"image-annotations"`
+	// InspectCommand is the docker compatible CLI the images are inspected with, run as <command> image inspect <image>
+	InspectCommand []string `yaml:"inspect-command"`
+	// Unannotated applies to the containers without image annotation
+	Unannotated string `yaml:"unannotated"`
+	// SpoolDir keeps the reports of the hooks until the workload agent accepted them, every poststart and poststop
+	// hook retries the pending ones
+	SpoolDir string `yaml:"spool-dir"`
+}
+
+// WebhookConfig holds the settings of the Kubernetes validating admission webhook
+type WebhookConfig struct {
+	// Listen is the address the webhook is served on with HTTPS
+	Listen string `yaml:"listen"`
+	// TLSCert and TLSKey are the PEM certificate and key files the webhook is served with
+	TLSCert string `yaml:"tls-cert"`
+	TLSKey  string `yaml:"tls-key"`
+}
+
+// Duration is a time.Duration read from strings like "5s" in the configuration file
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// MarshalYAML writes the duration as a string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+var current atomic.Value
+
+// Get returns the configuration currently in use. The returned value must not be modified,
+// a new configuration is swapped in as a whole with Set.
+func Get() *Configuration {
+	if cfg, ok := current.Load().(*Configuration); ok {
+		return cfg
+	}
+	cfg := defaultConfiguration()
+	cfg.applyEnv()
+	return cfg
+}
+
+// Set atomically replaces the configuration in use
+func Set(cfg *Configuration) {
+	current.Store(cfg)
+}
+
+func defaultConfiguration() *Configuration {
+	return &Configuration{
+		Docker: DockerConfig{
+			Host:           "unix:///var/run/docker.sock",
+			ConnectTimeout: Duration{30 * time.Second},
+		},
+		Plugin: PluginConfig{
+			Socket: "/run/docker/plugins/secure-docker-plugin.sock",
+		},
+		Wla: WlaConfig{
+			Socket:         "/var/run/workload-agent/wlagent.sock",
+			DialTimeout:    Duration{5 * time.Second},
+			ConnectTimeout: Duration{30 * time.Second},
+			CallTimeout:    Duration{30 * time.Second},
+			ReconnectMin:   Duration{500 * time.Millisecond},
+			ReconnectMax:   Duration{30 * time.Second},
+		},
+		Registry: RegistryConfig{
+			SchemeType: "https",
+			TokenURL:   "https://auth.docker.io/token?scope=repository:%s:pull&service=registry.docker.io",
+		},
+		Notary: NotaryConfig{
+			TrustDir: "/var/lib/secure-docker-plugin/trust",
+			Timeout:  Duration{10 * time.Second},
+		},
+		Policy: PolicyConfig{
+			WlaUnavailable: ActionAllow,
+			FlavorNotFound: ActionAllow,
+			Enforcement:    EnforcementEnforce,
+			AllowedCiphers: []string{"aes-xts-plain", "aes-xts-plain64"},
+		},
+		FlavorLookup: FlavorLookupConfig{
+			Keys: []string{FlavorKeyImageID, FlavorKeyDigest, FlavorKeyTag, FlavorKeyRepository,
+				FlavorKeyRepositoryPattern},
+		},
+		TrustReport: TrustReportConfig{
+			SpoolDir:       "/var/lib/secure-docker-plugin/spool",
+			RetryMin:       Duration{time.Second},
+			RetryMax:       Duration{5 * time.Minute},
+			Workers:        2,
+			QueueSize:      100,
+			EnqueueTimeout: Duration{time.Second},
+			WatchEvents:    true,
+		},
+		Reconcile: ReconcileConfig{
+			Enabled:     false,
+			Remediation: RemediationNone,
+			StopTimeout: Duration{10 * time.Second},
+		},
+		Reverify: ReverifyConfig{
+			Interval:       Duration{time.Hour},
+			BlockRevoked:   true,
+			Remediation:    RemediationNone,
+			StopTimeout:    Duration{10 * time.Second},
+			RevocationFile: "/var/lib/secure-docker-plugin/revoked.json",
+		},
+		State: StateConfig{
+			Dir: "/var/lib/secure-docker-plugin/state",
+		},
+		Capture: CaptureConfig{
+			Dir:        "/var/lib/secure-docker-plugin/capture",
+			DeniedOnly: true,
+			MaxBundles: 100,
+		},
+		OCIHook: OCIHookConfig{
+			ImageAnnotations: []string{"io.kubernetes.cri.image-name", "io.kubernetes.cri-o.ImageName"},
+			InspectCommand:   []string{"podman"},
+			Unannotated:      ActionAllow,
+			SpoolDir:         "/var/lib/secure-docker-plugin/oci-hook-spool",
+		},
+		Webhook: WebhookConfig{
+			Listen: ":8443",
+		},
+	}
+}
+
+// LoadConfiguration reads the configuration file, applies the environment overrides and validates the result.
+// Defaults are used for the settings missing from the file, or for all of them when the file does not exist.
+func LoadConfiguration(path string) (*Configuration, error) {
+	cfg := defaultConfiguration()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "Failed to read configuration file %s", path)
+		}
+		log.Printf("Configuration file %s does not exist, using defaults", path)
+	} else if err = yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse configuration file %s", path)
+	}
+
+	cfg.applyEnv()
+
+	if err = cfg.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid configuration in %s", path)
+	}
+	return cfg, nil
+}
+
+// UnsignedFlavorAction returns the action applied to the unsigned flavors: policy.unsigned-flavor when set, otherwise
+// deny once a flavor signing certificate is configured, so that configuring it is enough to require the signatures,
+// and allow without certificate
+func (cfg *Configuration) UnsignedFlavorAction() string {
+	if cfg.Policy.UnsignedFlavor != "" {
+		return cfg.Policy.UnsignedFlavor
+	}
+	if cfg.FlavorSignature.Certificate != "" {
+		return ActionDeny
+	}
+	return ActionAllow
+}
+
+// ParseConfiguration reads a configuration from YAML and validates it, without the environment overrides.
+// Defaults are used for the settings missing from data.
+func ParseConfiguration(data []byte) (*Configuration, error) {
+	cfg := defaultConfiguration()
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse configuration")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid configuration")
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides the configuration with the environment variables that are set.
+// The registry variables are the ones historically read from securedockerplugin.conf.
+func (cfg *Configuration) applyEnv() {
+	overrides := map[string]*string{
+		"SDP_DOCKER_HOST":      &cfg.Docker.Host,
+		"SDP_PLUGIN_SOCKET":    &cfg.Plugin.Socket,
+		"SDP_WLA_SOCKET":       &cfg.Wla.Socket,
+		"SDP_LOG_FILE":         &cfg.Logging.File,
+		"REGISTRY_USERNAME":    &cfg.Registry.Username,
+		"REGISTRY_PASSWORD":    &cfg.Registry.Password,
+		"REGISTRY_SCHEME_TYPE": &cfg.Registry.SchemeType,
+	}
+	for name, setting := range overrides {
+		if value := os.Getenv(name); value != "" {
+			*setting = value
+		}
+	}
+
+	if insecureSkipVerify := os.Getenv("INSECURE_SKIP_VERIFY"); insecureSkipVerify != "" {
+		cfg.Registry.SkipVerify, _ = strconv.ParseBool(insecureSkipVerify)
+	}
+}
+
+// Validate checks that the configuration can be used by the plugin
+func (cfg *Configuration) Validate() error {
+	hostURL, err := url.Parse(cfg.Docker.Host)
+	if err != nil || hostURL.Scheme == "" {
+		return errors.Errorf("docker.host %q is not a valid docker host address", cfg.Docker.Host)
+	}
+
+	if !filepath.IsAbs(cfg.Plugin.Socket) {
+		return errors.Errorf("plugin.socket %q must be an absolute path", cfg.Plugin.Socket)
+	}
+	if !filepath.IsAbs(cfg.Wla.Socket) {
+		return errors.Errorf("wla.socket %q must be an absolute path", cfg.Wla.Socket)
+	}
+	if !filepath.IsAbs(cfg.TrustReport.SpoolDir) {
+		return errors.Errorf("trust-report.spool-dir %q must be an absolute path", cfg.TrustReport.SpoolDir)
+	}
+	if !filepath.IsAbs(cfg.Notary.TrustDir) {
+		return errors.Errorf("notary.trust-dir %q must be an absolute path", cfg.Notary.TrustDir)
+	}
+	if !filepath.IsAbs(cfg.State.Dir) {
+		return errors.Errorf("state.dir %q must be an absolute path", cfg.State.Dir)
+	}
+	if cfg.Logging.File != "" && !filepath.IsAbs(cfg.Logging.File) {
+		return errors.Errorf("logging.file %q must be an absolute path", cfg.Logging.File)
+	}
+	if cfg.Logging.AuditFile != "" && !filepath.IsAbs(cfg.Logging.AuditFile) {
+		return errors.Errorf("logging.audit-file %q must be an absolute path", cfg.Logging.AuditFile)
+	}
+
+	durations := map[string]Duration{
+		"docker.connect-timeout":       cfg.Docker.ConnectTimeout,
+		"wla.dial-timeout":             cfg.Wla.DialTimeout,
+		"wla.connect-timeout":          cfg.Wla.ConnectTimeout,
+		"wla.call-timeout":             cfg.Wla.CallTimeout,
+		"wla.reconnect-min":            cfg.Wla.ReconnectMin,
+		"wla.reconnect-max":            cfg.Wla.ReconnectMax,
+		"notary.timeout":               cfg.Notary.Timeout,
+		"trust-report.retry-min":       cfg.TrustReport.RetryMin,
+		"trust-report.retry-max":       cfg.TrustReport.RetryMax,
+		"trust-report.enqueue-timeout": cfg.TrustReport.EnqueueTimeout,
+	}
+	for name, duration := range durations {
+		if duration.Duration <= 0 {
+			return errors.Errorf("%s must be a positive duration", name)
+		}
+	}
+	if cfg.Wla.ReconnectMax.Duration < cfg.Wla.ReconnectMin.Duration {
+		return errors.New("wla.reconnect-max must not be lower than wla.reconnect-min")
+	}
+	if cfg.TrustReport.Workers < 1 {
+		return errors.New("trust-report.workers must be at least 1")
+	}
+	if cfg.TrustReport.QueueSize < 1 {
+		return errors.New("trust-report.queue-size must be at least 1")
+	}
+	if cfg.TrustReport.RetryMax.Duration < cfg.TrustReport.RetryMin.Duration {
+		return errors.New("trust-report.retry-max must not be lower than trust-report.retry-min")
+	}
+	if cfg.Reconcile.Remediation != RemediationNone && cfg.Reconcile.Remediation != RemediationStop {
+		return errors.Errorf("reconcile.remediation %q must be either %s or %s", cfg.Reconcile.Remediation, RemediationNone, RemediationStop)
+	}
+	if cfg.Reconcile.StopTimeout.Duration < 0 {
+		return errors.New("reconcile.stop-timeout must not be negative")
+	}
+	if cfg.Reverify.Remediation != RemediationNone && cfg.Reverify.Remediation != RemediationStop {
+		return errors.Errorf("reverify.remediation %q must be either %s or %s", cfg.Reverify.Remediation, RemediationNone, RemediationStop)
+	}
+	if !filepath.IsAbs(cfg.Reverify.RevocationFile) {
+		return errors.Errorf("reverify.revocation-file %q must be an absolute path", cfg.Reverify.RevocationFile)
+	}
+	if cfg.Reverify.Interval.Duration < 0 {
+		return errors.New("reverify.interval must not be negative")
+	}
+	if cfg.Reverify.StopTimeout.Duration < 0 {
+		return errors.New("reverify.stop-timeout must not be negative")
+	}
+	if cfg.Cache.FlavorTTL.Duration < 0 {
+		return errors.New("cache.flavor-ttl must not be negative")
+	}
+	if cfg.Capture.Enabled && cfg.Capture.Dir == "" {
+		return errors.New("capture.dir must be set when capture is enabled")
+	}
+	if cfg.Capture.MaxBundles < 1 {
+		return errors.New("capture.max-bundles must be at least 1")
+	}
+	if len(cfg.OCIHook.InspectCommand) == 0 || cfg.OCIHook.InspectCommand[0] == "" {
+		return errors.New("oci-hook.inspect-command must name the CLI the images are inspected with")
+	}
+	if !filepath.IsAbs(cfg.OCIHook.SpoolDir) {
+		return errors.Errorf("oci-hook.spool-dir %q must be an absolute path", cfg.OCIHook.SpoolDir)
+	}
+	if cfg.Webhook.Listen == "" {
+		return errors.New("webhook.listen must not be empty")
+	}
+	if (cfg.Webhook.TLSCert == "") != (cfg.Webhook.TLSKey == "") {
+		return errors.New("webhook.tls-cert and webhook.tls-key must be set together")
+	}
+
+	if cfg.Registry.SchemeType != "http" && cfg.Registry.SchemeType != "https" {
+		return errors.Errorf("registry.scheme %q must be either http or https", cfg.Registry.SchemeType)
+	}
+	if strings.Count(cfg.Registry.TokenURL, "%s") != 1 {
+		return errors.Errorf("registry.token-url %q must contain a single %%s for the image repository", cfg.Registry.TokenURL)
+	}
+	if _, err = url.Parse(cfg.Registry.TokenURL); err != nil {
+		return errors.Wrap(err, "registry.token-url is not a valid URL")
+	}
+
+	actions := map[string]string{
+		"policy.wla-unavailable":  cfg.Policy.WlaUnavailable,
+		"policy.flavor-not-found": cfg.Policy.FlavorNotFound,
+		"policy.unsigned-flavor":  cfg.UnsignedFlavorAction(),
+		"oci-hook.unannotated":    cfg.OCIHook.Unannotated,
+	}
+	for name, action := range actions {
+		if action != ActionAllow && action != ActionDeny {
+			return errors.Errorf("%s %q must be either %s or %s", name, action, ActionAllow, ActionDeny)
+		}
+	}
+
+	if (cfg.FlavorSignature.Certificate == "") != (cfg.FlavorSignature.TrustedCA == "") {
+		return errors.New("flavor-signature.certificate and flavor-signature.trusted-ca must be set together")
+	}
+	if cfg.FlavorSignature.Certificate != "" {
+		if _, err = flavorsig.NewVerifier(cfg.FlavorSignature.Certificate, cfg.FlavorSignature.TrustedCA); err != nil {
+			return errors.Wrap(err, "flavor-signature")
+		}
+	}
+	if cfg.UnsignedFlavorAction() == ActionDeny && cfg.FlavorSignature.Certificate == "" {
+		return errors.New("policy.unsigned-flavor deny requires flavor-signature.certificate to verify the signed flavors")
+	}
+
+	if len(cfg.FlavorLookup.Keys) == 0 {
+		return errors.New("flavor-lookup.keys must have at least one key")
+	}
+	flavorKeys := make(map[string]bool)
+	for _, key := range cfg.FlavorLookup.Keys {
+		switch key {
+		case FlavorKeyImageID, FlavorKeyDigest, FlavorKeyTag, FlavorKeyRepository, FlavorKeyRepositoryPattern:
+		default:
+			return errors.Errorf("flavor-lookup.keys: unknown key %q", key)
+		}
+		if flavorKeys[key] {
+			return errors.Errorf("flavor-lookup.keys: key %q is listed twice", key)
+		}
+		flavorKeys[key] = true
+	}
+	for i, pattern := range cfg.FlavorLookup.RepositoryPatterns {
+		if _, err = path.Match(pattern, ""); err != nil || pattern == "" {
+			return errors.Errorf("flavor-lookup.repository-patterns[%d] %q is not a valid pattern", i, pattern)
+		}
+	}
+
+	if !isEnforcementMode(cfg.Policy.Enforcement) {
+		return errors.Errorf("policy.enforcement %q must be either %s or %s", cfg.Policy.Enforcement, EnforcementEnforce, EnforcementAudit)
+	}
+	for i, cipher := range cfg.Policy.AllowedCiphers {
+		if cipher == "" {
+			return errors.Errorf("policy.allowed-ciphers[%d] is empty", i)
+		}
+	}
+	for i, rule := range cfg.Policy.Rules {
+		if rule.Name == "" {
+			return errors.Errorf("policy.rules[%d] has no name", i)
+		}
+		if _, err = imagePattern(rule.Image); err != nil || rule.Image == "" {
+			return errors.Errorf("policy rule %s: image %q is not a valid pattern", rule.Name, rule.Image)
+		}
+		if rule.Action != "" && rule.Action != ActionAllow && rule.Action != ActionDeny {
+			return errors.Errorf("policy rule %s: action %q must be either %s or %s", rule.Name, rule.Action, ActionAllow, ActionDeny)
+		}
+		if rule.Action == ActionAllow && !rule.SkipVerification {
+			return errors.Errorf("policy rule %s: action allow skips the flavor and integrity verification, "+
+				"it requires skip-verification: true", rule.Name)
+		}
+		if rule.Enforcement != "" && !isEnforcementMode(rule.Enforcement) {
+			return errors.Errorf("policy rule %s: enforcement %q must be either %s or %s", rule.Name, rule.Enforcement, EnforcementEnforce, EnforcementAudit)
+		}
+	}
+	return nil
+}
+
+func isEnforcementMode(mode string) bool {
+	return mode == EnforcementEnforce || mode == EnforcementAudit
+}
+
+// CipherAllowed tells whether the cipher of an encrypted image is accepted
+func (policy *PolicyConfig) CipherAllowed(cipher string) bool {
+	if len(policy.AllowedCiphers) == 0 {
+		return true
+	}
+	for _, allowed := range policy.AllowedCiphers {
+		if cipher == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// imageNames returns the names the rule patterns are matched against for an image reference: its familiar and fully
+// qualified forms, with the latest tag when it has neither tag nor digest, such as nginx:latest and
+// docker.io/library/nginx:latest for nginx. The references which do not parse, such as image IDs, are matched as is.
+func imageNames(imageRef string) []string {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return []string{imageRef}
+	}
+	named = reference.TagNameOnly(named)
+	return []string{reference.FamiliarString(named), named.String()}
 }
 
-// GetEnv will read environment variables from securedockerplugin.conf if set else set default values for variables...
-func (ev *EnvVariables) GetEnv() {
-	insecureSkipVerify := ""
+// imagePattern compiles a rule image pattern, a path.Match pattern whose * also matches the / of the repository
+// paths so that *:latest matches the images of every registry and repository
+func imagePattern(pattern string) (*regexp.Regexp, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, path.ErrBadPattern
+			}
+			expr.WriteString(pattern[i : i+end+1])
+			i += end
+		case '\\':
+			if i++; i == len(pattern) {
+				return nil, path.ErrBadPattern
+			}
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// MatchRule returns the first rule matching the image reference, nil when none does. A rule matches when its
+// pattern matches the familiar or the fully qualified form of the reference, see imageNames and imagePattern.
+func (policy *PolicyConfig) MatchRule(imageRef string) *PolicyRule {
+	names := imageNames(imageRef)
+	for i := range policy.Rules {
+		pattern, err := imagePattern(policy.Rules[i].Image)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			if pattern.MatchString(name) {
+				return &policy.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// EnforcementFor returns the enforcement mode for an image and the name of the rule setting it,
+// the rule name is empty when the default enforcement mode applies
+func (policy *PolicyConfig) EnforcementFor(imageRef string) (string, string) {
+	rule := policy.MatchRule(imageRef)
+	if rule == nil {
+		return policy.Enforcement, ""
+	}
+	if rule.Enforcement == "" {
+		return policy.Enforcement, rule.Name
+	}
+	return rule.Enforcement, rule.Name
+}
 
-	ev.Username = os.Getenv("REGISTRY_USERNAME")
-	ev.Password = os.Getenv("REGISTRY_PASSWORD")
+// MatchRepository returns the first repository pattern matching the repository, empty when none does
+func (lookup *FlavorLookupConfig) MatchRepository(repository string) string {
+	for _, pattern := range lookup.RepositoryPatterns {
+		if matched, _ := path.Match(pattern, repository); matched {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// Redacted returns a copy of the configuration with the secrets masked, suitable for printing: the settings tagged
+// secret:"value" are replaced and the password of the URLs tagged secret:"userinfo" is
+func (cfg *Configuration) Redacted() *Configuration {
+	redacted := *cfg
+	visitSecrets(reflect.ValueOf(&redacted).Elem(), "", func(name, masking string, setting reflect.Value) {
+		if setting.String() == "" {
+			return
+		}
+		if masking == "userinfo" {
+			setting.SetString(redactURL(setting.String()))
+			return
+		}
+		setting.SetString(redactedValue)
+	})
+	return &redacted
+}
+
+// visitSecrets calls visit with the name, masking and value of the secret settings of a configuration section.
+// The sections are nested structs, copied with the configuration, so the secrets must not be held in lists.
+func visitSecrets(section reflect.Value, prefix string, visit func(name, masking string, setting reflect.Value)) {
+	for i := 0; i < section.NumField(); i++ {
+		field := section.Type().Field(i)
+		name := prefix + strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if masking, ok := field.Tag.Lookup("secret"); ok && field.Type.Kind() == reflect.String {
+			visit(name, masking, section.Field(i))
+		} else if field.Type.Kind() == reflect.Struct {
+			visitSecrets(section.Field(i), name+".", visit)
+		}
+	}
+}
 
-	ev.SchemeType = os.Getenv("REGISTRY_SCHEME_TYPE")
-	if ev.SchemeType == "" {
-		ev.SchemeType = "https"
+// redactURL masks the password of a URL, the whole value when it cannot be parsed
+func redactURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return redactedValue
+	}
+	if parsed.User == nil {
+		return value
 	}
+	if _, hasPassword := parsed.User.Password(); !hasPassword {
+		return value
+	}
+	parsed.User = url.UserPassword(parsed.User.Username(), redactedValue)
+	return parsed.String()
+}
 
-	insecureSkipVerify = os.Getenv("INSECURE_SKIP_VERIFY")
-	if len(insecureSkipVerify) == 0 {
-		//if variable is not set in env default value false will be set
-		insecureSkipVerify = "false"
+// String returns the configuration in the file format with the secrets masked
+func (cfg *Configuration) String() string {
+	data, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err.Error()
 	}
-	ev.SkipVerify, _ = strconv.ParseBool(insecureSkipVerify)
+	return string(data)
 }
@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"secure-docker-plugin/v3/capture"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/plugin"
+	"strings"
+	"testing"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	original := env.config()
+	defer env.setConfig(original)
+
+	dir, err := ioutil.TempDir(env.dir, "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := *original
+	cfg.Capture = config.CaptureConfig{Enabled: true, Dir: dir, DeniedOnly: true, MaxBundles: 1}
+	env.setConfig(&cfg)
+
+	// The secrets passed to the container must not end up in the bundle
+	req := loadRequest(t, "create-tampered")
+	var body map[string]interface{}
+	if err = json.Unmarshal(req.RequestBody, &body); err != nil {
+		t.Fatal(err)
+	}
+	body["Env"] = []string{"DB_PASSWORD=s3cr3t"}
+	if req.RequestBody, err = json.Marshal(body); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := env.sdp.AuthZReq(loadRequest(t, "create-signed")); !resp.Allow {
+		t.Fatalf("create denied: %s", resp.Msg)
+	}
+	denied := env.sdp.AuthZReq(req)
+	if denied.Allow {
+		t.Fatal("create of the tampered image allowed")
+	}
+
+	bundles, err := filepath.Glob(filepath.Join(dir, "bundle-*.json"))
+	if err != nil || len(bundles) != 1 {
+		t.Fatalf("Bundles = %v, want the denied request only", bundles)
+	}
+	data, err := ioutil.ReadFile(bundles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cr3t") {
+		t.Error("The environment variable value was captured")
+	}
+
+	bundle, err := capture.Load(bundles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, resp, err := plugin.Replay(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Code != plugin.CodeDigestMismatch || resp != denied {
+		t.Errorf("Replayed decision = %+v, response %+v, want the captured response %+v", decision, resp, denied)
+	}
+}
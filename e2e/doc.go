@@ -0,0 +1,9 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package e2e holds the end-to-end tests of the secure docker plugin. They run the plugin against in-process
+// fakes of the docker daemon, the workload agent, a docker registry and a notary server, and drive it with the
+// authorization requests and the Kubernetes admission reviews recorded in testdata.
+package e2e
@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// dockerAPIVersion is the docker engine API version served by the fake daemon
+const dockerAPIVersion = "1.40"
+
+var (
+	imageInspectURI     = regexp.MustCompile(`^(/v[0-9.]+)?/images/(.+)/json$`)
+	containerInspectURI = regexp.MustCompile(`^(/v[0-9.]+)?/containers/([^/]+)/json$`)
+)
+
+// fakeDockerd serves the docker engine API calls made by the plugin from in memory images and containers
+type fakeDockerd struct {
+	mtx        sync.Mutex
+	images     []types.ImageInspect
+	containers []types.ContainerJSON
+	server     *http.Server
+}
+
+func newFakeDockerd() *fakeDockerd {
+	return &fakeDockerd{}
+}
+
+func (dockerd *fakeDockerd) addImage(image types.ImageInspect) {
+	dockerd.mtx.Lock()
+	defer dockerd.mtx.Unlock()
+	dockerd.images = append(dockerd.images, image)
+}
+
+func (dockerd *fakeDockerd) addContainer(ctr types.ContainerJSON) {
+	dockerd.mtx.Lock()
+	defer dockerd.mtx.Unlock()
+	dockerd.containers = append(dockerd.containers, ctr)
+}
+
+// serve serves the API on a listener until close is called
+func (dockerd *fakeDockerd) serve(listener net.Listener) {
+	dockerd.server = &http.Server{Handler: http.HandlerFunc(dockerd.handle)}
+	go dockerd.server.Serve(listener)
+}
+
+func (dockerd *fakeDockerd) close() {
+	dockerd.server.Close()
+}
+
+func (dockerd *fakeDockerd) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Api-Version", dockerAPIVersion)
+	w.Header().Set("Content-Type", "application/json")
+
+	if strings.HasSuffix(r.URL.Path, "/_ping") {
+		w.Write([]byte("OK"))
+		return
+	}
+	if match := imageInspectURI.FindStringSubmatch(r.URL.Path); match != nil && r.Method == http.MethodGet {
+		if image, ok := dockerd.findImage(match[2]); ok {
+			json.NewEncoder(w).Encode(image)
+			return
+		}
+		notFound(w, "No such image: "+match[2])
+		return
+	}
+	if match := containerInspectURI.FindStringSubmatch(r.URL.Path); match != nil && r.Method == http.MethodGet {
+		if ctr, ok := dockerd.findContainer(match[2]); ok {
+			json.NewEncoder(w).Encode(ctr)
+			return
+		}
+		notFound(w, "No such container: "+match[2])
+		return
+	}
+	w.WriteHeader(http.StatusNotImplemented)
+	json.NewEncoder(w).Encode(map[string]string{"message": "not implemented by the fake daemon: " + r.URL.Path})
+}
+
+func notFound(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// findImage looks an image up by ID, with or without the sha256: prefix, or by repository tag
+func (dockerd *fakeDockerd) findImage(ref string) (types.ImageInspect, bool) {
+	dockerd.mtx.Lock()
+	defer dockerd.mtx.Unlock()
+	for _, image := range dockerd.images {
+		if image.ID == ref || strings.TrimPrefix(image.ID, "sha256:") == ref {
+			return image, true
+		}
+		for _, tag := range image.RepoTags {
+			if tag == ref {
+				return image, true
+			}
+		}
+	}
+	return types.ImageInspect{}, false
+}
+
+// findContainer looks a container up by ID, ID prefix or name
+func (dockerd *fakeDockerd) findContainer(ref string) (types.ContainerJSON, bool) {
+	dockerd.mtx.Lock()
+	defer dockerd.mtx.Unlock()
+	for _, ctr := range dockerd.containers {
+		if strings.HasPrefix(ctr.ID, ref) || ctr.Name == "/"+ref {
+			return ctr, true
+		}
+	}
+	return types.ContainerJSON{}, false
+}
+
+// newImage returns an image with its security metadata, none when securityMetaData is empty
+func newImage(id, repoTag, securityMetaData string) types.ImageInspect {
+	image := types.ImageInspect{
+		ID:       id,
+		RepoTags: []string{repoTag},
+		GraphDriver: types.GraphDriverData{
+			Name: "overlay2",
+			Data: map[string]string{},
+		},
+	}
+	if securityMetaData != "" {
+		image.GraphDriver.Data["security-meta-data"] = securityMetaData
+	}
+	return image
+}
+
+// newContainer returns a running container of an image
+func newContainer(id, name, imageID, imageRef, startedAt string) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    id,
+			Name:  "/" + name,
+			Image: imageID,
+			State: &types.ContainerState{
+				Status:    "running",
+				Running:   true,
+				StartedAt: startedAt,
+			},
+		},
+		Config: &container.Config{Image: imageRef},
+	}
+}
@@ -0,0 +1,411 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/plugin"
+	"secure-docker-plugin/v3/state"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla/fake"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+const (
+	// containerID is the container created in the recorded create response
+	containerID        = "c0ffee0000000000000000000000000000000000000000000000000000c0ffee"
+	containerStartedAt = "2020-11-03T10:15:42.123456789Z"
+	hostHardwareUUID   = "4219b2f5-c6ba-4fbb-a4b6-1c8a1b6b1e2a"
+
+	// integrityMetaData is the security metadata of an image requiring integrity only
+	integrityMetaData = `{"RequiresConfidentiality":false,"RequiresIntegrity":true,"KeyHandle":"","KeySize":"",` +
+		`"KeyType":"","CryptCipher":"","KeyFilePath":"","IsEmptyLayer":false,"IsSecurityTransformed":false}`
+)
+
+// fakeImage is an image known to the fakes
+type fakeImage struct {
+	repository string
+	tag        string
+	// local images are known to the docker daemon, the others only to the registry
+	local bool
+	// flavor is the image flavor served by the workload agent, none when empty
+	flavor string
+	// signed records the manifest digest in the notary server, signedDigest overrides it
+	signed       bool
+	signedDigest string
+}
+
+var images = []fakeImage{
+	{repository: "app", tag: "1.0", local: true, signed: true, flavor: integrityFlavor("app")},
+	{repository: "unsigned", tag: "1.0", local: true, flavor: integrityFlavor("unsigned")},
+	{repository: "tampered", tag: "1.0", local: true, signed: true, signedDigest: "sha256:" + strings.Repeat("d", 64),
+		flavor: integrityFlavor("tampered")},
+	{repository: "noflavor", tag: "1.0", local: true},
+	{repository: "remote", tag: "2.0", flavor: `{"meta":{"id":"flavor-remote"},"encryption_required":false,"integrity_enforced":false}`},
+	{repository: "secret", tag: "1.0", local: true, flavor: `{"meta":{"id":"flavor-secret"},"encryption_required":true,` +
+		`"encryption":{"key_url":"https://kbs.example.com/v1/keys/1/transfer"},"integrity_enforced":false}`},
+}
+
+func integrityFlavor(name string) string {
+	return fmt.Sprintf(`{"meta":{"id":"flavor-%s"},"encryption_required":false,"integrity_enforced":true,`+
+		`"integrity":{"notary_url":"%s"}}`, name, notaryURL)
+}
+
+// id returns the image ID
+func (image fakeImage) id() string {
+	sum := sha256.Sum256([]byte(image.repository + ":" + image.tag))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (image fakeImage) ref() string {
+	return registryHost + "/" + image.repository + ":" + image.tag
+}
+
+// fakeHost is the host the trust reports are created for
+type fakeHost struct{}
+
+func (fakeHost) HardwareUUID() (string, error) {
+	return hostHardwareUUID, nil
+}
+
+// testEnv is the plugin under test and its fakes
+type testEnv struct {
+	dir       string
+	flavorDir string
+	dockerd   *fakeDockerd
+	trust     *fakeTrustServer
+	wla       *fake.Server
+	sdp       *plugin.SecureDockerPlugin
+	// cfg is the configuration the engines decide with
+	cfg atomic.Value
+	// transport reaches the registry and notary hosts through the fake trust server
+	transport http.RoundTripper
+	// podman is the fake podman CLI inspecting the images of the fake docker daemon
+	podman []string
+}
+
+var env *testEnv
+
+func TestMain(m *testing.M) {
+	// The OCI hook inspects the images with the podman CLI
+	if filepath.Base(os.Args[0]) == "podman" {
+		os.Exit(runFakePodmanCLI(os.Args[1:]))
+	}
+
+	var err error
+	env, err = setup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "e2e setup failed:", err)
+		if env != nil {
+			env.teardown()
+		}
+		os.Exit(1)
+	}
+	code := m.Run()
+	env.teardown()
+	os.Exit(code)
+}
+
+func setup() (*testEnv, error) {
+	dir, err := ioutil.TempDir("", "sdp-e2e")
+	if err != nil {
+		return nil, err
+	}
+	env := &testEnv{dir: dir, dockerd: newFakeDockerd(), trust: newFakeTrustServer()}
+
+	// The test binary is the fake podman CLI
+	executable, err := os.Executable()
+	if err != nil {
+		return env, err
+	}
+	binDir := filepath.Join(dir, "bin")
+	if err = os.Mkdir(binDir, 0700); err != nil {
+		return env, err
+	}
+	podman := filepath.Join(binDir, "podman")
+	if err = os.Symlink(executable, podman); err != nil {
+		return env, err
+	}
+
+	// The registry and notary hosts are reached through the fake trust server acting as HTTP proxy
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return env, err
+	}
+	go http.Serve(proxy, env.trust)
+	env.transport = &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxy.Addr().String()})}
+
+	dockerSocket := filepath.Join(dir, "docker.sock")
+	dockerListener, err := net.Listen("unix", dockerSocket)
+	if err != nil {
+		return env, err
+	}
+	env.dockerd.serve(dockerListener)
+	env.podman = []string{podman, "--url", "unix://" + dockerSocket}
+
+	env.flavorDir = filepath.Join(dir, "flavors")
+	if err = os.Mkdir(env.flavorDir, 0700); err != nil {
+		return env, err
+	}
+	for _, image := range images {
+		if err = env.addImage(image); err != nil {
+			return env, err
+		}
+	}
+	app := images[0]
+	env.dockerd.addContainer(newContainer(containerID, "web", app.id(), app.ref(), containerStartedAt))
+
+	wlaSocket := filepath.Join(dir, "wlagent.sock")
+	env.wla, err = fake.Listen(wlaSocket, fake.Options{FlavorDir: env.flavorDir})
+	if err != nil {
+		return env, err
+	}
+
+	cfg, err := config.LoadConfiguration(filepath.Join(dir, "config.yml"))
+	if err != nil {
+		return env, err
+	}
+	cfg.Docker.Host = "unix://" + dockerSocket
+	cfg.Wla.Socket = wlaSocket
+	cfg.Wla.ConnectTimeout = config.Duration{Duration: 5 * time.Second}
+	cfg.Registry.SchemeType = "http"
+	cfg.Registry.TokenURL = registryURL + "/token?service=registry&scope=repository:%s:pull"
+	cfg.Policy.FlavorNotFound = config.ActionDeny
+	cfg.TrustReport.SpoolDir = filepath.Join(dir, "spool")
+	cfg.TrustReport.WatchEvents = false
+	cfg.Reverify.Interval = config.Duration{}
+	cfg.State.Dir = filepath.Join(dir, "state")
+	cfg.Notary.TrustDir = filepath.Join(dir, "trust")
+	cfg.Reverify.RevocationFile = filepath.Join(dir, "revoked.json")
+	if err = cfg.Validate(); err != nil {
+		return env, err
+	}
+	env.setConfig(cfg)
+
+	env.sdp, err = plugin.NewPlugin(cfg.Docker.Host, cfg.Wla.Socket, plugin.WithConfig(env.config),
+		plugin.WithTransport(env.transport), plugin.WithHardwareInfo(fakeHost{}))
+	if err != nil {
+		return env, err
+	}
+	env.sdp.Start()
+	return env, nil
+}
+
+// config returns the configuration the engines decide with
+func (env *testEnv) config() *config.Configuration {
+	return env.cfg.Load().(*config.Configuration)
+}
+
+// setConfig replaces the configuration the engines decide with
+func (env *testEnv) setConfig(cfg *config.Configuration) {
+	env.cfg.Store(cfg)
+}
+
+// newEngine returns an engine deciding with the configuration and the fakes of the environment
+func (env *testEnv) newEngine() *plugin.Engine {
+	return plugin.NewEngine(env.config().Wla.Socket, plugin.WithConfig(env.config),
+		plugin.WithTransport(env.transport), plugin.WithHardwareInfo(fakeHost{}))
+}
+
+// addImage publishes an image in the fakes
+func (env *testEnv) addImage(image fakeImage) error {
+	manifest := fakeManifest{ImageID: image.id()}
+	env.trust.addManifest(image.repository, image.tag, manifest)
+	if image.signed {
+		digest := image.signedDigest
+		if digest == "" {
+			digest = manifestDigest(manifest)
+		}
+		if err := env.trust.sign(image.repository, image.tag, digest); err != nil {
+			return err
+		}
+	}
+	if image.local {
+		securityMetaData := ""
+		if image.signed {
+			securityMetaData = integrityMetaData
+		}
+		// The local images were pulled from the registry
+		pulled := newImage(image.id(), image.ref(), securityMetaData)
+		pulled.RepoDigests = []string{registryHost + "/" + image.repository + "@" + manifestDigest(manifest)}
+		env.dockerd.addImage(pulled)
+	}
+	if image.flavor == "" {
+		return nil
+	}
+	return env.addFlavor(strings.TrimPrefix(image.id(), "sha256:"), image.flavor)
+}
+
+// addFlavor serves a flavor for a flavor key value, such as an image ID, a manifest digest or a repository
+func (env *testEnv) addFlavor(key, flavor string) error {
+	return ioutil.WriteFile(filepath.Join(env.flavorDir, util.GetUUIDFromImageID(key)+".json"), []byte(flavor), 0600)
+}
+
+func (env *testEnv) teardown() {
+	if env.sdp != nil {
+		env.sdp.Cleanup()
+	}
+	if env.wla != nil {
+		env.wla.Close()
+	}
+	if env.dockerd.server != nil {
+		env.dockerd.close()
+	}
+	os.RemoveAll(env.dir)
+}
+
+// loadRequest reads a recorded authorization request from testdata
+func loadRequest(t *testing.T, name string) authorization.Request {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req authorization.Request
+	if err = json.Unmarshal(data, &req); err != nil {
+		t.Fatalf("Invalid request %s: %v", name, err)
+	}
+	return req
+}
+
+// eventually polls condition until it holds or timeout expires
+func eventually(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// terminations returns the number of container terminations recorded by the plugin
+func terminations() int64 {
+	return expvar.Get("sdp_container_terminations").(*expvar.Int).Value()
+}
+
+func TestAuthZReqDecisions(t *testing.T) {
+	tests := []struct {
+		request string
+		allow   bool
+		code    string
+	}{
+		{request: "create-signed", allow: true},
+		{request: "create-unsigned", code: "SDP-SIGNATURE-MISSING"},
+		{request: "create-tampered", code: "SDP-DIGEST-MISMATCH"},
+		{request: "create-no-flavor", code: "SDP-FLAVOR-NOT-FOUND"},
+		{request: "create-remote", allow: true},
+		{request: "create-not-encrypted", code: "SDP-IMAGE-NOT-ENCRYPTED"},
+		{request: "list-containers", allow: true},
+		{request: "started", allow: true},
+	}
+	for _, test := range tests {
+		t.Run(test.request, func(t *testing.T) {
+			resp := env.sdp.AuthZReq(loadRequest(t, test.request))
+			if resp.Allow != test.allow {
+				t.Fatalf("Allow = %v, want %v (%s)", resp.Allow, test.allow, resp.Msg)
+			}
+			if test.code != "" && !strings.Contains(resp.Msg, "["+test.code+"]") {
+				t.Errorf("Msg = %q, want denial code %s", resp.Msg, test.code)
+			}
+			if test.allow && resp.Msg != "" {
+				t.Errorf("Msg = %q for an allowed request", resp.Msg)
+			}
+		})
+	}
+}
+
+func TestRemoteImageResolvedWithRegistryToken(t *testing.T) {
+	env.trust.mtx.Lock()
+	tokens := env.trust.tokens
+	env.trust.mtx.Unlock()
+
+	decision := env.sdp.VerifyImage(registryHost + "/remote:2.0")
+	if !decision.Allow || decision.FlavorID != "flavor-remote" {
+		t.Fatalf("Decision = %+v, want allowed with flavor-remote", decision)
+	}
+	env.trust.mtx.Lock()
+	defer env.trust.mtx.Unlock()
+	if env.trust.tokens == tokens {
+		t.Error("The registry token endpoint was not called")
+	}
+}
+
+func TestCreatedContainerState(t *testing.T) {
+	if resp := env.sdp.AuthZReq(loadRequest(t, "create-signed")); !resp.Allow {
+		t.Fatalf("create denied: %s", resp.Msg)
+	}
+	if resp := env.sdp.AuthZRes(loadRequest(t, "created-signed")); !resp.Allow {
+		t.Fatalf("create response denied: %s", resp.Msg)
+	}
+
+	status, err := env.sdp.ContainerStatus("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := images[0]
+	if status.ContainerID != containerID || status.FlavorID != "flavor-app" || !status.IntegrityVerified {
+		t.Errorf("Status = %+v, want the integrity verified with flavor-app", status)
+	}
+	if want := manifestDigest(fakeManifest{ImageID: app.id()}); status.Digest != want {
+		t.Errorf("Digest = %s, want %s", status.Digest, want)
+	}
+	if status.Signer != "targets/releases" {
+		t.Errorf("Signer = %s, want the targets/releases delegation", status.Signer)
+	}
+}
+
+func TestTrustReports(t *testing.T) {
+	if resp := env.sdp.AuthZRes(loadRequest(t, "started")); !resp.Allow {
+		t.Fatalf("start response denied: %s", resp.Msg)
+	}
+	reported := eventually(5*time.Second, func() bool {
+		return len(env.wla.Manifests()) > 0
+	})
+	if !reported {
+		t.Fatal("No trust report received by the workload agent")
+	}
+
+	recorded := terminations()
+	if resp := env.sdp.AuthZRes(loadRequest(t, "stopped")); !resp.Allow {
+		t.Fatalf("stop response denied: %s", resp.Msg)
+	}
+	if !eventually(5*time.Second, func() bool { return terminations() > recorded }) {
+		t.Error("Stop of the reported container not recorded")
+	}
+}
+
+func TestContainerRemovedByName(t *testing.T) {
+	if _, err := env.sdp.ContainerStatus(containerID); err != nil {
+		t.Fatalf("No state recorded for the container: %v", err)
+	}
+	recorded := terminations()
+	if resp := env.sdp.AuthZRes(loadRequest(t, "removed")); !resp.Allow {
+		t.Fatalf("remove response denied: %s", resp.Msg)
+	}
+	if !eventually(5*time.Second, func() bool { return terminations() > recorded }) {
+		t.Error("Removal of the reported container not recorded")
+	}
+	if _, err := env.sdp.ContainerStatus(containerID); err != state.ErrNotFound {
+		t.Errorf("ContainerStatus returned %v after the removal, want %v", err, state.ErrNotFound)
+	}
+}
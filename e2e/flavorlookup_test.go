@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"fmt"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/plugin"
+	"secure-docker-plugin/v3/util"
+	"strings"
+	"testing"
+)
+
+func lookupFlavor(id string) string {
+	return fmt.Sprintf(`{"meta":{"id":"%s"},"encryption_required":false,"integrity_enforced":false}`, id)
+}
+
+func TestFlavorLookupKeys(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("e", 64)
+	digested := fakeImage{repository: "lookup/digest", tag: "1.0", local: true}
+	image := newImage(digested.id(), digested.ref(), "")
+	image.RepoDigests = []string{registryHost + "/lookup/digest@" + digest}
+	env.dockerd.addImage(image)
+
+	for _, image := range []fakeImage{
+		{repository: "lookup/tag", tag: "1.0", local: true},
+		{repository: "lookup/repository", tag: "2.0", local: true},
+		{repository: "team/pattern", tag: "1.0", local: true},
+	} {
+		if err := env.addImage(image); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flavors := map[string]string{
+		digest:                                  "flavor-digest",
+		registryHost + "/lookup/tag:1.0":        "flavor-tag",
+		registryHost + "/lookup/tag":            "flavor-tag-repository",
+		registryHost + "/lookup/repository":     "flavor-repository",
+		registryHost + "/team/*":                "flavor-team",
+		registryHost + "/lookup/digest":         "flavor-digest-repository",
+		registryHost + "/lookup/repository:1.0": "flavor-other-tag",
+	}
+	flavorKeys := make(map[string]string)
+	for key, id := range flavors {
+		flavorKeys[id] = key
+		if err := env.addFlavor(key, lookupFlavor(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	original := env.config()
+	defer env.setConfig(original)
+	cfg := *original
+	cfg.FlavorLookup.RepositoryPatterns = []string{registryHost + "/team/*"}
+	env.setConfig(&cfg)
+
+	tests := []struct {
+		image  string
+		flavor string
+		key    string
+	}{
+		{image: "app:1.0", flavor: "flavor-app", key: config.FlavorKeyImageID},
+		{image: "lookup/digest:1.0", flavor: "flavor-digest", key: config.FlavorKeyDigest},
+		{image: "lookup/tag:1.0", flavor: "flavor-tag", key: config.FlavorKeyTag},
+		{image: "lookup/repository:2.0", flavor: "flavor-repository", key: config.FlavorKeyRepository},
+		{image: "team/pattern:1.0", flavor: "flavor-team", key: config.FlavorKeyRepositoryPattern},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			decision := env.sdp.VerifyImage(registryHost + "/" + test.image)
+			if decision.FlavorID != test.flavor || decision.FlavorKey != test.key {
+				t.Fatalf("Decision = %+v, want flavor %s found by %s", decision, test.flavor, test.key)
+			}
+			if value, ok := flavorKeys[test.flavor]; ok && decision.FlavorKeyUUID != util.GetUUIDFromImageID(value) {
+				t.Errorf("Flavor key UUID = %s, want the UUID of %s", decision.FlavorKeyUUID, value)
+			}
+		})
+	}
+
+	// The repository flavor takes precedence once listed first
+	cfg.FlavorLookup.Keys = []string{config.FlavorKeyRepository, config.FlavorKeyTag}
+	env.setConfig(&cfg)
+	if decision := env.sdp.VerifyImage(registryHost + "/lookup/tag:1.0"); decision.FlavorID != "flavor-tag-repository" {
+		t.Errorf("Decision = %+v, want the repository flavor", decision)
+	}
+
+	// Only the configured keys are looked up
+	cfg.FlavorLookup.Keys = []string{config.FlavorKeyImageID}
+	env.setConfig(&cfg)
+	if decision := env.sdp.VerifyImage(registryHost + "/lookup/repository:2.0"); decision.Code != plugin.CodeFlavorNotFound {
+		t.Errorf("Decision = %+v, want %s", decision, plugin.CodeFlavorNotFound)
+	}
+}
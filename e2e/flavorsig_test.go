@@ -0,0 +1,187 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/plugin"
+	"testing"
+	"time"
+)
+
+// flavorSigner issues a flavor signing certificate from a test CA and signs flavors like the Workload Service
+type flavorSigner struct {
+	key             *rsa.PrivateKey
+	certificateFile string
+	trustedCAFile   string
+}
+
+func newCertificate(template, parent *x509.Certificate, key *rsa.PublicKey, parentKey *rsa.PrivateKey) ([]byte, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func newFlavorSigner(dir string) (*flavorSigner, error) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "e2e root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caPEM, err := newCertificate(ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	leafPEM, err := newCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "e2e flavor signing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := &flavorSigner{
+		key:             key,
+		certificateFile: filepath.Join(dir, "flavor-signing.pem"),
+		trustedCAFile:   filepath.Join(dir, "trusted-ca.pem"),
+	}
+	if err = ioutil.WriteFile(signer.certificateFile, leafPEM, 0600); err != nil {
+		return nil, err
+	}
+	return signer, ioutil.WriteFile(signer.trustedCAFile, caPEM, 0600)
+}
+
+// sign returns the signed flavor document, the Workload Service signs the JSON of the image flavor object
+func (signer *flavorSigner) sign(flavor string) (string, error) {
+	content, err := json.Marshal(struct {
+		Flavor json.RawMessage `json:"flavor"`
+	}{json.RawMessage(flavor)})
+	if err != nil {
+		return "", err
+	}
+	digest := sha512.Sum384(content)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signer.key, crypto.SHA384, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signed, err := json.Marshal(struct {
+		Flavor    json.RawMessage `json:"flavor"`
+		Signature string          `json:"signature"`
+	}{json.RawMessage(flavor), base64.StdEncoding.EncodeToString(signature)})
+	return string(signed), err
+}
+
+func TestFlavorSignatures(t *testing.T) {
+	dir, err := ioutil.TempDir(env.dir, "flavorsig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newFlavorSigner(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedFlavor, err := signer.sign(`{"meta":{"id":"flavor-signed"},"encryption_required":false,"integrity_enforced":false}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The flavor served by a compromised workload agent no longer matches its signature
+	forged, err := signer.sign(`{"meta":{"id":"flavor-forged"},"encryption_required":true,"integrity_enforced":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forgedFlavor map[string]interface{}
+	if err = json.Unmarshal([]byte(forged), &forgedFlavor); err != nil {
+		t.Fatal(err)
+	}
+	forgedFlavor["flavor"] = map[string]interface{}{"meta": map[string]string{"id": "flavor-forged"}}
+	forgedData, err := json.Marshal(forgedFlavor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range []fakeImage{
+		{repository: "signed", tag: "1.0", local: true, flavor: signedFlavor},
+		{repository: "forged", tag: "1.0", local: true, flavor: string(forgedData)},
+	} {
+		if err = env.addImage(image); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	original := env.config()
+	defer env.setConfig(original)
+	cfg := *original
+	cfg.FlavorSignature = config.FlavorSignatureConfig{Certificate: signer.certificateFile, TrustedCA: signer.trustedCAFile}
+	// Configuring the certificate denies the unsigned flavors without setting policy.unsigned-flavor
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	env.setConfig(&cfg)
+
+	tests := []struct {
+		image string
+		allow bool
+		code  plugin.DenialCode
+	}{
+		{image: "signed:1.0", allow: true},
+		{image: "forged:1.0", code: plugin.CodeFlavorSigInvalid},
+		{image: "app:1.0", code: plugin.CodeFlavorUnsigned},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			decision := env.sdp.VerifyImage(registryHost + "/" + test.image)
+			if decision.Allow != test.allow || decision.Code != test.code {
+				t.Fatalf("Decision = %+v, want allow %v with code %q", decision, test.allow, test.code)
+			}
+			if test.allow && !decision.FlavorSignatureVerified {
+				t.Error("The flavor signature was not verified")
+			}
+		})
+	}
+
+	// A certificate gone after the configuration was validated is a configuration error, not a bad flavor
+	if err = os.Remove(signer.certificateFile); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := cfg
+	if err = reloaded.Validate(); err == nil {
+		t.Error("Configuration validated without its flavor signing certificate")
+	}
+	env.setConfig(&reloaded)
+	if decision := env.sdp.VerifyImage(registryHost + "/signed:1.0"); decision.Code != plugin.CodeConfigInvalid {
+		t.Errorf("Decision = %+v without the certificate, want code %q", decision, plugin.CodeConfigInvalid)
+	}
+}
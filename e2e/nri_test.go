@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"path/filepath"
+	"secure-docker-plugin/v3/nri"
+	"secure-docker-plugin/v3/ocihook"
+	"secure-docker-plugin/v3/plugin"
+	"strings"
+	"testing"
+)
+
+func TestNRIPlugin(t *testing.T) {
+	cfg := env.config()
+	engine := env.newEngine()
+	nriPlugin := nri.New(ocihook.New(engine, ocihook.CommandInspector{Command: env.podman},
+		filepath.Join(env.dir, "nri-spool")))
+	annotation := cfg.OCIHook.ImageAnnotations[0]
+	request := func(id, state, image string) nri.Request {
+		return nri.Request{Version: "0.1", ID: id, SandboxID: "nri-sandbox", State: state,
+			Spec: &nri.Spec{Annotations: map[string]string{annotation: image}}}
+	}
+
+	// The tasks of denied images fail to be created, the pod sandboxes are not verified
+	if _, err := nriPlugin.Invoke(request("nri-tampered", nri.StateCreate, registryHost+"/tampered:1.0")); err == nil ||
+		!strings.Contains(err.Error(), "["+string(plugin.CodeDigestMismatch)+"]") {
+		t.Errorf("Error = %v, want a denial with %s", err, plugin.CodeDigestMismatch)
+	}
+	if _, err := nriPlugin.Invoke(request("nri-sandbox", nri.StateCreate, registryHost+"/noflavor:1.0")); err != nil {
+		t.Errorf("Pod sandbox denied: %v", err)
+	}
+
+	// An allowed task is reported on its creation, NRI v0.1 having no start request, and its termination on its
+	// deletion, which is also how containerd cleans up a task whose start failed
+	manifests := len(env.wla.Manifests())
+	result, err := nriPlugin.Invoke(request("nri-app", nri.StateCreate, registryHost+"/app:1.0"))
+	if err != nil {
+		t.Fatalf("Container denied: %v", err)
+	}
+	if result.Plugin != nri.PluginName || result.Version != "0.1" {
+		t.Errorf("Result = %+v, want the result of %s", result, nri.PluginName)
+	}
+	if len(env.wla.Manifests()) != manifests+1 {
+		t.Errorf("Manifests received = %d, want %d", len(env.wla.Manifests()), manifests+1)
+	}
+	recorded := terminations()
+	if _, err = nriPlugin.Invoke(request("nri-app", nri.StateDelete, registryHost+"/app:1.0")); err != nil {
+		t.Fatal(err)
+	}
+	if terminations() != recorded+1 {
+		t.Errorf("Terminations recorded = %d, want %d", terminations(), recorded+1)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"secure-docker-plugin/v3/ocihook"
+	"secure-docker-plugin/v3/plugin"
+	"secure-docker-plugin/v3/wla"
+	"strings"
+	"testing"
+)
+
+func TestOCIHook(t *testing.T) {
+	cfg := env.config()
+	engine := env.newEngine()
+	spoolDir := filepath.Join(env.dir, "oci-spool")
+	hook := ocihook.New(engine, ocihook.CommandInspector{Command: env.podman}, spoolDir)
+	annotation := cfg.OCIHook.ImageAnnotations[0]
+
+	// The image is read from the bundle configuration when the state has no annotations
+	bundle, err := ioutil.TempDir(env.dir, "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := json.Marshal(map[string]interface{}{
+		"ociVersion":  "1.0.2",
+		"annotations": map[string]string{annotation: registryHost + "/app:1.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(bundle, "config.json"), spec, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		state ocihook.State
+		code  plugin.DenialCode
+	}{
+		{name: "signed", state: ocihook.State{Status: ocihook.StatusCreating,
+			Annotations: map[string]string{annotation: registryHost + "/app:1.0"}}},
+		{name: "bundle annotation", state: ocihook.State{Status: ocihook.StatusCreated, Bundle: bundle}},
+		{name: "tampered", state: ocihook.State{Status: ocihook.StatusCreating,
+			Annotations: map[string]string{annotation: registryHost + "/tampered:1.0"}}, code: plugin.CodeDigestMismatch},
+		{name: "no flavor", state: ocihook.State{Status: ocihook.StatusCreating,
+			Annotations: map[string]string{annotation: registryHost + "/noflavor:1.0"}}, code: plugin.CodeFlavorNotFound},
+		{name: "unannotated", state: ocihook.State{Status: ocihook.StatusCreating}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.state.OCIVersion = "1.0.2"
+			test.state.ID = "oci-" + strings.Replace(test.name, " ", "-", -1)
+			data, err := json.Marshal(test.state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, err := ocihook.ReadState(strings.NewReader(string(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = hook.Run(state)
+			if test.code == "" && err != nil {
+				t.Fatalf("Container denied: %v", err)
+			}
+			if test.code != "" && (err == nil || !strings.Contains(err.Error(), "["+string(test.code)+"]")) {
+				t.Fatalf("Error = %v, want a denial with %s", err, test.code)
+			}
+		})
+	}
+
+	// The poststart hook reports the container to the workload agent, the poststop hook records its termination
+	manifests := len(env.wla.Manifests())
+	state := ocihook.State{OCIVersion: "1.0.2", ID: "oci-reported", Status: ocihook.StatusRunning,
+		Annotations: map[string]string{annotation: registryHost + "/app:1.0"}}
+	if err = hook.Run(state); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.wla.Manifests()) != manifests+1 {
+		t.Errorf("Manifests received = %d, want %d", len(env.wla.Manifests()), manifests+1)
+	}
+	state.Status = ocihook.StatusStopped
+	recorded := terminations()
+	if err = hook.Run(state); err != nil {
+		t.Fatal(err)
+	}
+	if terminations() != recorded+1 {
+		t.Errorf("Terminations recorded = %d, want %d", terminations(), recorded+1)
+	}
+
+	// A report the workload agent failed to take is spooled and sent by the next hook run, in another process
+	env.wla.SetFailures(1, wla.MethodCreateInstanceTrustReport)
+	defer env.wla.SetFailures(0)
+	manifests = len(env.wla.Manifests())
+	state = ocihook.State{OCIVersion: "1.0.2", ID: "oci-retried", Status: ocihook.StatusRunning,
+		Annotations: map[string]string{annotation: registryHost + "/app:1.0"}}
+	if err = hook.Run(state); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.wla.Manifests()) != manifests {
+		t.Fatalf("Manifests received = %d despite the failure, want %d", len(env.wla.Manifests()), manifests)
+	}
+	env.wla.SetFailures(0)
+	next := ocihook.New(env.newEngine(),
+		ocihook.CommandInspector{Command: env.podman}, spoolDir)
+	state.ID = "oci-next"
+	if err = next.Run(state); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.wla.Manifests()) != manifests+2 {
+		t.Errorf("Manifests received = %d, want %d with the spooled one", len(env.wla.Manifests()), manifests+2)
+	}
+}
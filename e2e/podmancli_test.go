@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// runFakePodmanCLI stands in for `podman --url unix://<socket> image inspect`, which the OCI hook runs to inspect the
+// images. It looks the image up in the fake docker daemon listening on the socket and prints it like podman, as a list
+// of images whose ID has no digest algorithm. The test binary runs it when invoked as podman.
+func runFakePodmanCLI(args []string) int {
+	if len(args) != 5 || args[0] != "--url" || !strings.HasPrefix(args[1], "unix://") || args[2] != "image" ||
+		args[3] != "inspect" {
+		fmt.Fprintln(os.Stderr, "fake podman: only --url unix://<socket> image inspect <image> is supported")
+		return 125
+	}
+	socket := strings.TrimPrefix(args[1], "unix://")
+	args = args[2:]
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://podman/images/" + args[2] + "/json")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 125
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Error: %s: image not known\n", args[2])
+		return 125
+	}
+	var image types.ImageInspect
+	if err = json.NewDecoder(resp.Body).Decode(&image); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 125
+	}
+	image.ID = strings.TrimPrefix(image.ID, "sha256:")
+	out, err := json.MarshalIndent([]types.ImageInspect{image}, "", "    ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 125
+	}
+	fmt.Println(string(out))
+	return 0
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"secure-docker-plugin/v3/integrity/fakenotary"
+	"sync"
+)
+
+const (
+	registryHost = "registry.example.com:5000"
+	notaryHost   = "notary.example.com:4443"
+	notaryURL    = "http://" + notaryHost
+	registryURL  = "http://" + registryHost
+
+	// registryToken is the bearer token issued by the fake registry token endpoint
+	registryToken = "e2e-token"
+)
+
+var manifestURI = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+
+// fakeManifest is a schema 2 manifest served by the fake registry
+type fakeManifest struct {
+	ImageID string
+}
+
+// fakeTrustServer serves a docker registry with its token endpoint and a notary server, telling them apart by
+// host name. It is reached as an HTTP proxy, so the plugin uses the usual URLs.
+type fakeTrustServer struct {
+	mtx       sync.Mutex
+	manifests map[string]fakeManifest
+	// tokens counts the tokens issued
+	tokens int
+	notary *fakenotary.Server
+}
+
+func newFakeTrustServer() *fakeTrustServer {
+	return &fakeTrustServer{
+		manifests: make(map[string]fakeManifest),
+		notary:    fakenotary.New(fakenotary.Options{Role: "targets/releases"}),
+	}
+}
+
+// manifestJSON returns the manifest of an image as served by the registry
+func manifestJSON(manifest fakeManifest) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"digest":    manifest.ImageID,
+		},
+	})
+	return data
+}
+
+// manifestDigest returns the digest of the manifest of an image
+func manifestDigest(manifest fakeManifest) string {
+	sum := sha256.Sum256(manifestJSON(manifest))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// addManifest publishes an image in the registry under repository:tag
+func (server *fakeTrustServer) addManifest(repository, tag string, manifest fakeManifest) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	server.manifests[repository+":"+tag] = manifest
+}
+
+// sign signs the digest of a tag in the notary server
+func (server *fakeTrustServer) sign(repository, tag, digest string) error {
+	return server.notary.Sign(registryHost+"/"+repository, tag, digest)
+}
+
+func (server *fakeTrustServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Host {
+	case registryHost:
+		server.serveRegistry(w, r)
+	case notaryHost:
+		server.notary.ServeHTTP(w, r)
+	default:
+		http.Error(w, "unknown host "+r.Host, http.StatusBadGateway)
+	}
+}
+
+func (server *fakeTrustServer) serveRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		server.mtx.Lock()
+		server.tokens++
+		server.mtx.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"token": registryToken})
+		return
+	}
+
+	match := manifestURI.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+registryToken {
+		w.Header().Set("Www-Authenticate", `Bearer realm="`+registryURL+`/token"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	server.mtx.Lock()
+	manifest, ok := server.manifests[match[1]+":"+match[2]]
+	server.mtx.Unlock()
+	if !ok {
+		http.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+	w.Header().Set("Docker-Content-Digest", manifestDigest(manifest))
+	w.Write(manifestJSON(manifest))
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/webhook"
+	"strings"
+	"testing"
+)
+
+// postReview posts a recorded admission review of testdata to the webhook and returns the review answered
+func postReview(t *testing.T, url, name string) (webhook.AdmissionReview, webhook.AdmissionReview) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent webhook.AdmissionReview
+	if err = json.Unmarshal(data, &sent); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url+webhook.ValidateURI, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Status = %s, want 200 OK", resp.Status)
+	}
+	var review webhook.AdmissionReview
+	if err = json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Response == nil {
+		t.Fatal("Admission review has no response")
+	}
+	return sent, review
+}
+
+func TestAdmissionWebhook(t *testing.T) {
+	engine := env.newEngine()
+	server := httptest.NewServer(webhook.New(engine))
+	defer server.Close()
+
+	tests := []struct {
+		review string
+		allow  bool
+		// denials are the containers denied with their denial code
+		denials []string
+	}{
+		// The encryption of the secret image is only verified by the node
+		{review: "admission-pod-signed", allow: true},
+		{review: "admission-pod-denied", denials: []string{"container tampered: [SDP-DIGEST-MISMATCH]",
+			"container noflavor: [SDP-FLAVOR-NOT-FOUND]"}},
+		{review: "admission-pod-ephemeral", denials: []string{"container debugger: [SDP-SIGNATURE-MISSING]"}},
+		{review: "admission-deployment", allow: true},
+	}
+	for _, test := range tests {
+		t.Run(test.review, func(t *testing.T) {
+			sent, review := postReview(t, server.URL, test.review)
+			if review.APIVersion != sent.APIVersion || review.Kind != "AdmissionReview" ||
+				review.Response.UID != sent.Request.UID {
+				t.Errorf("Review %s %s for %s, want %s AdmissionReview for %s", review.APIVersion, review.Kind,
+					review.Response.UID, sent.APIVersion, sent.Request.UID)
+			}
+			if review.Response.Allowed != test.allow {
+				t.Fatalf("Allowed = %v, want %v: %+v", review.Response.Allowed, test.allow, review.Response.Result)
+			}
+			if test.allow {
+				return
+			}
+			if review.Response.Result == nil || review.Response.Result.Code != http.StatusForbidden {
+				t.Fatalf("Status = %+v, want 403", review.Response.Result)
+			}
+			for _, denial := range test.denials {
+				if !strings.Contains(review.Response.Result.Message, denial) {
+					t.Errorf("Message %q does not report %q", review.Response.Result.Message, denial)
+				}
+			}
+			if strings.Contains(review.Response.Result.Message, "container web:") {
+				t.Errorf("Message %q reports the allowed container", review.Response.Result.Message)
+			}
+		})
+	}
+
+	// In audit mode the pod is admitted with a warning per container that would be denied
+	t.Run("audit", func(t *testing.T) {
+		original := env.config()
+		defer env.setConfig(original)
+		cfg := *original
+		cfg.Policy.Enforcement = config.EnforcementAudit
+		env.setConfig(&cfg)
+
+		_, review := postReview(t, server.URL, "admission-pod-denied")
+		if !review.Response.Allowed || len(review.Response.Warnings) != 2 {
+			t.Fatalf("Response = %+v, want allowed with 2 warnings", review.Response)
+		}
+	})
+
+	// A dry run is decided without side effects: neither counted nor pinning the roots of trust
+	t.Run("dry run", func(t *testing.T) {
+		dryRun := fakeImage{repository: "dryrun", tag: "1.0", signed: true, flavor: integrityFlavor("dryrun")}
+		if err := env.addImage(dryRun); err != nil {
+			t.Fatal(err)
+		}
+		pin := filepath.Join(env.config().Notary.TrustDir, url.PathEscape(notaryURL), "tuf", registryHost, "dryrun",
+			"metadata", "root.json")
+		denied := expvar.Get("sdp_requests_denied").String()
+
+		_, review := postReview(t, server.URL, "admission-pod-dry-run")
+		if review.Response.Allowed || review.Response.Result == nil ||
+			!strings.Contains(review.Response.Result.Message, "container noflavor: [SDP-FLAVOR-NOT-FOUND]") ||
+			strings.Contains(review.Response.Result.Message, "container app:") {
+			t.Fatalf("Response = %+v, want the noflavor container denied", review.Response)
+		}
+		if counted := expvar.Get("sdp_requests_denied").String(); counted != denied {
+			t.Errorf("Denied requests = %s after a dry run, want %s", counted, denied)
+		}
+		if _, err := os.Stat(pin); !os.IsNotExist(err) {
+			t.Errorf("Root of trust pinned by a dry run: %v", err)
+		}
+
+		if decision := engine.AdmitRemote(dryRun.ref(), false); !decision.Allow {
+			t.Fatalf("Decision = %+v, want allowed", decision)
+		}
+		if _, err := os.Stat(pin); err != nil {
+			t.Errorf("Root of trust not pinned: %v", err)
+		}
+	})
+
+	resp, err := http.Get(server.URL + webhook.ValidateURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %s, want 405", resp.Status)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package flavorsig verifies the signatures of the image flavors signed by the Workload Service
+package flavorsig
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	// ErrUnsigned is returned for a flavor without signature
+	ErrUnsigned = errors.New("flavor is not signed")
+	// ErrNoCertificate is returned when no flavor signing certificate is configured to verify a signed flavor
+	ErrNoCertificate = errors.New("no flavor signing certificate is configured")
+)
+
+// CertificateError is a flavor signing certificate, or CA certificate, which cannot be read or is not trusted:
+// a misconfiguration of the host rather than a fault of the flavors
+type CertificateError struct {
+	Err error
+}
+
+func (err *CertificateError) Error() string {
+	return err.Err.Error()
+}
+
+// Cause returns the underlying error
+func (err *CertificateError) Cause() error {
+	return err.Err
+}
+
+// Verifier verifies the flavor signatures with the flavor signing certificate
+type Verifier struct {
+	certificate   *x509.Certificate
+	intermediates *x509.CertPool
+	roots         *x509.CertPool
+}
+
+// readCertificates reads the certificates of a PEM file
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read certificate file %s", path)
+	}
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid certificate in %s", path)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, errors.Errorf("No certificate found in %s", path)
+	}
+	return certificates, nil
+}
+
+// NewVerifier loads the flavor signing certificate, followed by its intermediate CA certificates in certificateFile,
+// and the root CA certificates it must chain to from trustedCAFile. The errors are CertificateError values.
+func NewVerifier(certificateFile, trustedCAFile string) (*Verifier, error) {
+	chain, err := readCertificates(certificateFile)
+	if err != nil {
+		return nil, &CertificateError{Err: err}
+	}
+	if _, ok := chain[0].PublicKey.(*rsa.PublicKey); !ok {
+		return nil, &CertificateError{
+			Err: errors.Errorf("Flavor signing certificate %s does not have an RSA key", certificateFile)}
+	}
+	roots, err := readCertificates(trustedCAFile)
+	if err != nil {
+		return nil, &CertificateError{Err: err}
+	}
+
+	verifier := &Verifier{
+		certificate:   chain[0],
+		intermediates: x509.NewCertPool(),
+		roots:         x509.NewCertPool(),
+	}
+	for _, certificate := range chain[1:] {
+		verifier.intermediates.AddCert(certificate)
+	}
+	for _, certificate := range roots {
+		verifier.roots.AddCert(certificate)
+	}
+	if err = verifier.verifyChain(); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+// verifyChain checks that the signing certificate is currently valid, chains to a trusted CA and may sign code:
+// a certificate, or CA, restricted to other extended key usages such as TLS is not accepted
+func (verifier *Verifier) verifyChain() error {
+	_, err := verifier.certificate.Verify(x509.VerifyOptions{
+		Intermediates: verifier.intermediates,
+		Roots:         verifier.roots,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return &CertificateError{Err: errors.Wrap(err, "Flavor signing certificate is not trusted")}
+	}
+	return nil
+}
+
+// SignedContent returns the document signed by the Workload Service for a flavor: the flavor JSON, as received,
+// wrapped in an image flavor object
+func SignedContent(flavor []byte) []byte {
+	content := append([]byte(`{"flavor":`), flavor...)
+	return append(content, '}')
+}
+
+// Verify checks the base64 RSA PKCS #1 v1.5 SHA-384 signature of a flavor, ErrUnsigned when signature is empty
+func (verifier *Verifier) Verify(flavor []byte, signature string) error {
+	if signature == "" {
+		return ErrUnsigned
+	}
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.Wrap(err, "Flavor signature is not base64 encoded")
+	}
+	if err = verifier.verifyChain(); err != nil {
+		return err
+	}
+
+	digest := sha512.Sum384(SignedContent(flavor))
+	err = rsa.VerifyPKCS1v15(verifier.certificate.PublicKey.(*rsa.PublicKey), crypto.SHA384, digest[:], signatureBytes)
+	return errors.Wrap(err, "Flavor signature does not match the flavor signing certificate")
+}
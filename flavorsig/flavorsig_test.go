@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package flavorsig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signedFlavor is the flavor document served by the Workload Service
+type signedFlavor struct {
+	Flavor    json.RawMessage `json:"flavor"`
+	Signature string          `json:"signature"`
+}
+
+// readSignedFlavor reads the flavor signed by the Workload Service with the certificate of testdata
+func readSignedFlavor(t *testing.T) signedFlavor {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "signed-flavor.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed signedFlavor
+	if err = json.Unmarshal(data, &signed); err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerifyWorkloadServiceSignature(t *testing.T) {
+	verifier, err := NewVerifier(filepath.Join("testdata", "flavor-signing.pem"),
+		filepath.Join("testdata", "trusted-ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := readSignedFlavor(t)
+	if err = verifier.Verify(signed.Flavor, signed.Signature); err != nil {
+		t.Errorf("Signature of the Workload Service rejected: %v", err)
+	}
+
+	tampered := bytes.Replace(signed.Flavor, []byte(`"integrity_enforced":true`), []byte(`"integrity_enforced":false`), 1)
+	if err = verifier.Verify(tampered, signed.Signature); err == nil {
+		t.Error("Signature of a modified flavor accepted")
+	}
+	if err = verifier.Verify(signed.Flavor, ""); err != ErrUnsigned {
+		t.Errorf("Verify returned %v without signature, want ErrUnsigned", err)
+	}
+}
+
+func TestNewVerifierChecksTheKeyUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdp-flavorsig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedCA := filepath.Join(dir, "trusted-ca.pem")
+	if err = ioutil.WriteFile(trustedCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		usages   []x509.ExtKeyUsage
+		accepted bool
+	}{
+		{name: "code signing", usages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, accepted: true},
+		{name: "no extended key usage", accepted: true},
+		{name: "TLS server", usages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+				SerialNumber: big.NewInt(int64(i + 2)),
+				Subject:      pkix.Name{CommonName: "flavor signing"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  test.usages,
+			}, ca, &caKey.PublicKey, caKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certificate := filepath.Join(dir, "flavor-signing.pem")
+			if err = ioutil.WriteFile(certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+				0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err = NewVerifier(certificate, trustedCA)
+			if (err == nil) != test.accepted {
+				t.Errorf("NewVerifier returned %v, want accepted %v", err, test.accepted)
+			}
+			if _, ok := err.(*CertificateError); err != nil && !ok {
+				t.Errorf("NewVerifier returned %T, want a CertificateError", err)
+			}
+		})
+	}
+}
+
+func TestNewVerifierMissingCertificate(t *testing.T) {
+	_, err := NewVerifier(filepath.Join("testdata", "missing.pem"), filepath.Join("testdata", "trusted-ca.pem"))
+	if _, ok := err.(*CertificateError); !ok {
+		t.Errorf("NewVerifier returned %v, want a CertificateError", err)
+	}
+}
@@ -7,7 +7,9 @@ require (
 	github.com/docker/go-plugins-helpers v0.0.0-20181025120712-1e6269c305b8
 	github.com/google/uuid v1.1.1
 	github.com/pkg/errors v0.9.1
+	github.com/theupdateframework/notary v0.7.0
 	gopkg.in/retry.v1 v1.0.3
+	gopkg.in/yaml.v2 v2.4.0
 	intel/isecl/lib/flavor/v3 v3.6.1
 	intel/isecl/lib/platform-info/v3 v3.6.1
 	intel/isecl/lib/vml/v3 v3.6.1
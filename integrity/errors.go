@@ -0,0 +1,58 @@
+package integrity
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+import (
+	"fmt"
+)
+
+// Kinds of integrity verification failures
+const (
+	// NotaryUnspecified is reported when the flavor enforces integrity without a notary URL
+	NotaryUnspecified = "notary-unspecified"
+	// InvalidImageRef is reported when the image reference cannot be parsed
+	InvalidImageRef = "invalid-image-ref"
+	// NotaryUnreachable is reported when the notary server cannot be contacted
+	NotaryUnreachable = "notary-unreachable"
+	// SignatureMissing is reported when the notary server has no signature for the image tag
+	SignatureMissing = "signature-missing"
+	// DigestMismatch is reported when the image manifest digest does not match the signed digest
+	DigestMismatch = "digest-mismatch"
+	// TrustDataInvalid is reported when the trust data of the notary server fails the TUF verification: invalid or
+	// missing signatures, expired metadata, metadata older than the cached one or a root of trust not signed by the
+	// pinned one
+	TrustDataInvalid = "trust-data-invalid"
+	// VerificationFailed is reported for the remaining verification failures
+	VerificationFailed = "verification-failed"
+)
+
+// Error describes why the integrity of an image could not be verified
+type Error struct {
+	Kind      string
+	ImageRef  string
+	Tag       string
+	NotaryURL string
+	// Detail holds the underlying error
+	Detail string
+}
+
+func (e *Error) Error() string {
+	switch e.Kind {
+	case NotaryUnspecified:
+		return "notary URL is not specified in the flavor"
+	case InvalidImageRef:
+		return fmt.Sprintf("unable to parse image reference %s: %s", e.ImageRef, e.Detail)
+	case NotaryUnreachable:
+		return fmt.Sprintf("notary server %s is unreachable: %s", e.NotaryURL, e.Detail)
+	case SignatureMissing:
+		return fmt.Sprintf("signature missing for tag %s of %s in notary %s", e.Tag, e.ImageRef, e.NotaryURL)
+	case DigestMismatch:
+		return fmt.Sprintf("digest of %s does not match the signed digest: %s", e.ImageRef, e.Detail)
+	case TrustDataInvalid:
+		return fmt.Sprintf("invalid trust data for %s in notary %s: %s", e.ImageRef, e.NotaryURL, e.Detail)
+	}
+	return fmt.Sprintf("signature verification of %s failed: %s", e.ImageRef, e.Detail)
+}
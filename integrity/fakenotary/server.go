@@ -0,0 +1,447 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package fakenotary is a notary server simulator serving signed TUF trust data over HTTP, for integration tests
+// without a notary server.
+package fakenotary
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	trustPrefix = "/_trust/tuf/"
+	targetsRole = "targets"
+)
+
+// Options configures the simulator
+type Options struct {
+	// Role is the role the tags are signed in, the targets role when empty. A delegation such as targets/releases,
+	// where docker trust sign adds the tags, is delegated by its parent roles: targets/qa/nightly is delegated by
+	// targets/qa, itself delegated by targets.
+	Role string
+	// Expires is how long the trust data is valid, a year when 0. A negative duration serves expired trust data.
+	Expires time.Duration
+}
+
+// Server serves the trust data of the repositories signed with Sign
+type Server struct {
+	opts  Options
+	mtx   sync.Mutex
+	repos map[string]*repository
+}
+
+// repository is the trust data of a GUN, its files are signed again on every change
+type repository struct {
+	keys map[string]*signingKey
+	// root is only signed again when the root keys change, like notary does, roots keeps every version of it
+	root        []byte
+	rootVersion int
+	roots       map[int][]byte
+	// previousRoot cross-signs the root after a rotation
+	previousRoot *signingKey
+	version      int
+	targets      map[string]string
+	files        map[string][]byte
+	// previous are the files published before the last change
+	previous map[string][]byte
+}
+
+// signingKey is a private key with its TUF public key
+type signingKey struct {
+	private *ecdsa.PrivateKey
+	public  map[string]interface{}
+	id      string
+}
+
+// newKey generates a key, the root keys of a GUN are published as a self-signed certificate for the GUN like notary
+// does, the other keys with an empty gun
+func newKey(gun string) (*signingKey, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	public, err := publicKey(private, gun)
+	if err != nil {
+		return nil, err
+	}
+	return &signingKey{private: private, public: public, id: keyID(public)}, nil
+}
+
+// New creates a simulator
+func New(opts Options) *Server {
+	if opts.Expires == 0 {
+		opts.Expires = 365 * 24 * time.Hour
+	}
+	return &Server{opts: opts, repos: make(map[string]*repository)}
+}
+
+// Sign signs the manifest digest of a tag, such as sha256:4f1c..., in the repository gun
+func (server *Server) Sign(gun, tag, digest string) error {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	repo, err := server.repository(gun)
+	if err != nil {
+		return err
+	}
+	repo.targets[tag] = digest
+	return server.publish(repo)
+}
+
+// Unsign removes the signature of a tag
+func (server *Server) Unsign(gun, tag string) error {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	repo, ok := server.repos[gun]
+	if !ok {
+		return errors.Errorf("no trust data for %s", gun)
+	}
+	delete(repo.targets, tag)
+	return server.publish(repo)
+}
+
+// RotateRoot replaces the root key of a repository, the new root is signed by the previous root key as well when
+// crossSign is set
+func (server *Server) RotateRoot(gun string, crossSign bool) error {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	repo, ok := server.repos[gun]
+	if !ok {
+		return errors.Errorf("no trust data for %s", gun)
+	}
+	key, err := newKey(gun)
+	if err != nil {
+		return err
+	}
+	repo.previousRoot = nil
+	if crossSign {
+		repo.previousRoot = repo.keys["root"]
+	}
+	repo.keys["root"] = key
+	repo.root = nil
+	repo.rootVersion++
+	return server.publish(repo)
+}
+
+// Rollback serves again the trust data published before the last change of a repository, like a compromised server
+// or a man in the middle replaying trust data which is still validly signed and not expired
+func (server *Server) Rollback(gun string) error {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	repo, ok := server.repos[gun]
+	if !ok || repo.previous == nil {
+		return errors.Errorf("no previous trust data for %s", gun)
+	}
+	repo.files = repo.previous
+	return nil
+}
+
+// Freeze serves the trust data of a repository as a server which stopped updating it would once it expired: the
+// same versions, expired an hour ago
+func (server *Server) Freeze(gun string) error {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	repo, ok := server.repos[gun]
+	if !ok {
+		return errors.Errorf("no trust data for %s", gun)
+	}
+	files := repo.files
+	err := server.sign(repo, time.Now().Add(-time.Hour))
+	repo.previous = files
+	return err
+}
+
+// Tamper replaces the digest of a tag in the served trust data without signing it again
+func (server *Server) Tamper(gun, tag, digest string) error {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	repo, ok := server.repos[gun]
+	if !ok {
+		return errors.Errorf("no trust data for %s", gun)
+	}
+	path := server.delegationPath()
+	role := path[len(path)-1]
+	sum, _ := hex.DecodeString(strings.TrimPrefix(digest, "sha256:"))
+	var file struct {
+		Signed     map[string]interface{} `json:"signed"`
+		Signatures json.RawMessage        `json:"signatures"`
+	}
+	if err := json.Unmarshal(repo.files[role], &file); err != nil {
+		return err
+	}
+	targets := file.Signed["targets"].(map[string]interface{})
+	targets[tag] = target(sum)
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	repo.files[role] = data
+	return nil
+}
+
+func (server *Server) repository(gun string) (*repository, error) {
+	if repo, ok := server.repos[gun]; ok {
+		return repo, nil
+	}
+	repo := &repository{
+		keys:        make(map[string]*signingKey),
+		rootVersion: 1,
+		roots:       make(map[int][]byte),
+		targets:     make(map[string]string),
+	}
+	roles := append([]string{"root", "snapshot", "timestamp"}, server.delegationPath()...)
+	for _, role := range roles {
+		certificateGUN := ""
+		if role == "root" {
+			certificateGUN = gun
+		}
+		key, err := newKey(certificateGUN)
+		if err != nil {
+			return nil, err
+		}
+		repo.keys[role] = key
+	}
+	server.repos[gun] = repo
+	return repo, nil
+}
+
+// delegationPath returns the targets role followed by the delegations leading to the role the tags are signed in
+func (server *Server) delegationPath() []string {
+	path := []string{targetsRole}
+	if server.opts.Role == "" {
+		return path
+	}
+	names := strings.Split(server.opts.Role, "/")
+	for i := 2; i <= len(names); i++ {
+		path = append(path, strings.Join(names[:i], "/"))
+	}
+	return path
+}
+
+// publish signs the trust data of a repository again, with a new version
+func (server *Server) publish(repo *repository) error {
+	repo.version++
+	previous := repo.files
+	if err := server.sign(repo, time.Now().Add(server.opts.Expires)); err != nil {
+		return err
+	}
+	repo.previous = previous
+	return nil
+}
+
+// sign signs the trust data of a repository, each targets role delegating to the next of the delegation path
+func (server *Server) sign(repo *repository, expiry time.Time) error {
+	expires := expiry.UTC().Format(time.RFC3339)
+	targets := make(map[string]interface{})
+	for tag, digest := range repo.targets {
+		sum, _ := hex.DecodeString(strings.TrimPrefix(digest, "sha256:"))
+		targets[tag] = target(sum)
+	}
+	files := make(map[string][]byte)
+	path := server.delegationPath()
+	for i := len(path) - 1; i >= 0; i-- {
+		role := map[string]interface{}{
+			"_type":       "Targets",
+			"version":     repo.version,
+			"expires":     expires,
+			"targets":     map[string]interface{}{},
+			"delegations": map[string]interface{}{"keys": map[string]interface{}{}, "roles": []interface{}{}},
+		}
+		if i == len(path)-1 {
+			role["targets"] = targets
+		} else {
+			delegate := repo.keys[path[i+1]]
+			role["delegations"] = map[string]interface{}{
+				"keys": map[string]interface{}{delegate.id: delegate.public},
+				"roles": []interface{}{map[string]interface{}{
+					"name": path[i+1], "keyids": []string{delegate.id}, "threshold": 1, "paths": []string{""},
+				}},
+			}
+		}
+		var err error
+		if files[path[i]], err = sign(role, repo.keys[path[i]]); err != nil {
+			return err
+		}
+	}
+
+	if repo.root == nil {
+		root, err := server.signRoot(repo, expires)
+		if err != nil {
+			return err
+		}
+		repo.root = root
+		repo.roots[repo.rootVersion] = root
+	}
+	files["root"] = repo.root
+
+	meta := make(map[string]interface{})
+	for role, data := range files {
+		meta[role] = fileMeta(data)
+	}
+	var err error
+	snapshot := map[string]interface{}{"_type": "Snapshot", "version": repo.version, "expires": expires, "meta": meta}
+	if files["snapshot"], err = sign(snapshot, repo.keys["snapshot"]); err != nil {
+		return err
+	}
+	timestamp := map[string]interface{}{
+		"_type":   "Timestamp",
+		"version": repo.version,
+		"expires": expires,
+		"meta":    map[string]interface{}{"snapshot": fileMeta(files["snapshot"])},
+	}
+	if files["timestamp"], err = sign(timestamp, repo.keys["timestamp"]); err != nil {
+		return err
+	}
+	repo.files = files
+	return nil
+}
+
+func (server *Server) signRoot(repo *repository, expires string) ([]byte, error) {
+	keys := make(map[string]interface{})
+	roles := make(map[string]interface{})
+	for _, role := range []string{"root", targetsRole, "snapshot", "timestamp"} {
+		keys[repo.keys[role].id] = repo.keys[role].public
+		roles[role] = map[string]interface{}{"keyids": []string{repo.keys[role].id}, "threshold": 1}
+	}
+	root := map[string]interface{}{
+		"_type":               "Root",
+		"version":             repo.rootVersion,
+		"expires":             expires,
+		"consistent_snapshot": false,
+		"keys":                keys,
+		"roles":               roles,
+	}
+	signers := []*signingKey{repo.keys["root"]}
+	if repo.previousRoot != nil {
+		signers = append(signers, repo.previousRoot)
+	}
+	return sign(root, signers...)
+}
+
+func target(sum []byte) map[string]interface{} {
+	return map[string]interface{}{"hashes": map[string]string{"sha256": base64.StdEncoding.EncodeToString(sum)},
+		"length": 1024}
+}
+
+func fileMeta(data []byte) map[string]interface{} {
+	sum := sha256.Sum256(data)
+	return map[string]interface{}{"hashes": map[string]string{"sha256": base64.StdEncoding.EncodeToString(sum[:])},
+		"length": len(data)}
+}
+
+// publicKey returns the TUF public key of a key, a self-signed certificate for gun when not empty like the root keys
+// of notary
+func publicKey(key *ecdsa.PrivateKey, gun string) (map[string]interface{}, error) {
+	if gun == "" {
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"keytype": "ecdsa",
+			"keyval": map[string]interface{}{"private": nil, "public": der}}, nil
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: gun},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return map[string]interface{}{"keytype": "ecdsa-x509",
+		"keyval": map[string]interface{}{"private": nil, "public": certPEM}}, nil
+}
+
+// keyID is the ID notary gives a key: the SHA-256 of its canonical JSON
+func keyID(key map[string]interface{}) string {
+	data, _ := json.Marshal(key)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign signs a role with keys, encoding/json sorts the object keys so the role is marshalled in its canonical form
+func sign(role map[string]interface{}, keys ...*signingKey) ([]byte, error) {
+	signed, err := json.Marshal(role)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(signed)
+	var signatures []interface{}
+	for _, key := range keys {
+		r, s, err := ecdsa.Sign(rand.Reader, key.private, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// The signature is the concatenation of r and s, each padded to the 32 bytes of the curve
+		sig := make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rBytes):32], rBytes)
+		copy(sig[64-len(sBytes):], sBytes)
+		signatures = append(signatures, map[string]interface{}{"keyid": key.id, "method": "ecdsa", "sig": sig})
+	}
+	return json.Marshal(map[string]interface{}{"signed": json.RawMessage(signed), "signatures": signatures})
+}
+
+// ServeHTTP serves /v2/<gun>/_trust/tuf/<role>.json, the roles by checksum as <role>.<sha256>.json and the versions
+// of the root as <version>.root.json. The checksum is not checked, the tampered trust data is served in its place.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	i := strings.Index(path, trustPrefix)
+	if r.Method != http.MethodGet || i < 0 || !strings.HasSuffix(path, ".json") {
+		http.NotFound(w, r)
+		return
+	}
+	gun, name := path[:i], strings.TrimSuffix(path[i+len(trustPrefix):], ".json")
+
+	server.mtx.Lock()
+	var data []byte
+	if repo, ok := server.repos[gun]; ok {
+		data = repo.file(name)
+	}
+	server.mtx.Unlock()
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// file returns the trust data file served for a name, nil when there is none
+func (repo *repository) file(name string) []byte {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		if name[i+1:] == "root" {
+			version, err := strconv.Atoi(name[:i])
+			if err != nil {
+				return nil
+			}
+			return repo.roots[version]
+		}
+		if _, err := hex.DecodeString(name[i+1:]); err == nil && len(name)-i-1 == 2*sha256.Size {
+			name = name[:i]
+		}
+	}
+	return repo.files[name]
+}
@@ -6,24 +6,37 @@ package integrity
  */
 
 import (
-	dockerclient "github.com/docker/docker/client"
 	"log"
-	"os/exec"
 	"strings"
 
 	"secure-docker-plugin/v3/util"
-)
 
-const (
-	dockerPullCmd            = "docker pull"
-	dockerContentTrust       = "export DOCKER_CONTENT_TRUST=1"
-	dockerContentTrustServer = dockerContentTrust + "; export DOCKER_CONTENT_TRUST_SERVER="
-	imageNameShaPrefix       = "sha256:"
-	imageTagShaSeparator     = "@sha256:"
+	"github.com/docker/distribution/reference"
 )
 
+const imageNameShaPrefix = "sha256:"
+
+// ManifestResolver returns the digest of the manifest a registry serves for an image reference
+type ManifestResolver interface {
+	ManifestDigest(imageRef string) (string, error)
+}
+
+// Signature is a verified image signature: the signed manifest digest and the notary role which signed it, targets or
+// a delegation such as targets/releases
+type Signature struct {
+	Digest string `json:"digest,omitempty"`
+	Signer string `json:"signer,omitempty"`
+}
+
+// Verifier verifies the image signatures with the notary servers without pulling the images. The manifest digest of
+// an image, read from its RepoDigests or from its registry when not pulled yet, must be the digest signed for its tag.
+type Verifier struct {
+	Notary   *Notary
+	Registry ManifestResolver
+}
+
 // getImageName returns the image name and tag for a container image
-func getImageName(dc *dockerclient.Client, imageRef string) (string, error) {
+func getImageName(dc util.ImageInspector, imageRef string) (string, error) {
 
 	imageMetadata, err := util.GetImageMetadata(dc, imageRef)
 	if err != nil {
@@ -31,19 +44,22 @@ func getImageName(dc *dockerclient.Client, imageRef string) (string, error) {
 		return "", err
 	}
 
-	if imageMetadata == nil {
+	if imageMetadata == nil || len(imageMetadata.RepoTags) == 0 {
 		return imageRef, nil
 	}
 
 	return imageMetadata.RepoTags[0], nil
 }
 
-// VerifyIntegrity is used for verifying signature with notary server
-func VerifyIntegrity(dc *dockerclient.Client, notaryServerURL, imageRef string) bool {
+// VerifyIntegrity is used for verifying signature with notary server.
+// A nil error means the image signature was verified, the signed manifest digest and its signer are returned.
+// Otherwise an *Error describes the failure.
+func (verifier *Verifier) VerifyIntegrity(dc util.ImageInspector, notaryServerURL, imageRef string) (Signature,
+	error) {
 
 	if notaryServerURL == "" {
 		log.Println("Notary URL is not specified in flavor.")
-		return false
+		return Signature{}, &Error{Kind: NotaryUnspecified, ImageRef: imageRef}
 	}
 
 	// Kubelet passes along image references as sha sums
@@ -52,40 +68,86 @@ func VerifyIntegrity(dc *dockerclient.Client, notaryServerURL, imageRef string)
 		image, err := getImageName(dc, imageRef)
 		if err != nil {
 			log.Println("Error retrieving the image name and tag.", err)
-			return false
+			return Signature{}, &Error{Kind: InvalidImageRef, ImageRef: imageRef, Detail: err.Error()}
 		}
 		imageRef = image
 	}
 
-	// Make sense of the image reference
-	registryAddr, imageName, tag, err := util.GetRegistryAddr(imageRef)
+	// Make sense of the image reference, the GUN of the notary repository is the fully qualified image name
+	named, err := reference.ParseNormalizedNamed(imageRef)
 	if err != nil {
-		log.Println("Failed in parsing Registry Address from Image reference.", err, imageRef)
-		return false
+		log.Println("Failed in parsing the image reference.", err, imageRef)
+		return Signature{}, &Error{Kind: InvalidImageRef, ImageRef: imageRef, Detail: err.Error()}
+	}
+	gun := named.Name()
+	tag := ""
+	if tagged, ok := reference.TagNameOnly(named).(reference.Tagged); ok {
+		tag = tagged.Tag()
 	}
 
-	finalImageRef := ""
-
-	// Handling use case where the tag name is specified with the sha256sum,
-	// with this the tag parsed by GetRegistryAddr is blank,
-	// we pass it as is in the form: registry:[port]/imagename@sha256:shasum
-	if strings.Contains(imageRef, imageTagShaSeparator) {
-		finalImageRef = registryAddr + "/" + imageName + imageTagShaSeparator + strings.Split(imageRef, imageTagShaSeparator)[1]
-	} else {
-		finalImageRef = registryAddr + "/" + imageName + ":" + tag
+	targets, err := verifier.Notary.Targets(notaryServerURL, gun)
+	if err != nil {
+		if notaryErr, ok := err.(*Error); ok {
+			notaryErr.ImageRef, notaryErr.Tag = imageRef, tag
+		}
+		return Signature{}, err
 	}
 
-	trustPullCmd := dockerContentTrustServer + notaryServerURL + ";" + dockerPullCmd + " " + finalImageRef
-	log.Println("Docker trusted pull command: ", trustPullCmd)
+	// A reference by digest runs that manifest, it must be signed for one of the tags of the repository
+	if digested, ok := named.(reference.Digested); ok {
+		digest := digested.Digest().String()
+		_, role, signed := targets.Signed(digest)
+		if !signed {
+			return Signature{}, &Error{Kind: SignatureMissing, ImageRef: imageRef, Tag: digest,
+				NotaryURL: notaryServerURL}
+		}
+		return Signature{Digest: digest, Signer: role}, nil
+	}
 
-	trustPullCmdOut, trustPullCmdErr := exec.Command("bash", "-c", trustPullCmd).Output()
-	log.Println("Trusted pull returned: ", string(trustPullCmdOut))
+	signedDigest, role, signed := targets.Lookup(tag)
+	if !signed {
+		return Signature{}, &Error{Kind: SignatureMissing, ImageRef: imageRef, Tag: tag, NotaryURL: notaryServerURL}
+	}
+	digest, err := verifier.imageDigest(dc, imageRef, named)
+	if err != nil {
+		kind := VerificationFailed
+		if _, unknown := err.(*noDigestError); unknown {
+			kind = DigestMismatch
+		}
+		return Signature{}, &Error{Kind: kind, ImageRef: imageRef, Tag: tag, NotaryURL: notaryServerURL,
+			Detail: err.Error()}
+	}
+	if digest != signedDigest {
+		return Signature{}, &Error{Kind: DigestMismatch, ImageRef: imageRef, Tag: tag, NotaryURL: notaryServerURL,
+			Detail: "image digest " + digest + ", " + role + " signed " + signedDigest}
+	}
+	log.Printf("Digest %s of %s signed by %s in notary %s", digest, imageRef, role, notaryServerURL)
+	return Signature{Digest: signedDigest, Signer: role}, nil
+}
 
-	// Was there an error? if yes, then assume not trusted and don't allow
-	if trustPullCmdErr != nil {
-		log.Println("Trust Inspect returned error: ", trustPullCmdErr.Error())
-		return false
+// imageDigest returns the manifest digest of the image docker runs for a tag: the digest of the local image, or of
+// the manifest the registry serves when the image is not pulled yet
+func (verifier *Verifier) imageDigest(dc util.ImageInspector, imageRef string, named reference.Named) (string, error) {
+	imageMetadata, _ := util.GetImageMetadata(dc, imageRef)
+	if imageMetadata == nil {
+		digest, err := verifier.Registry.ManifestDigest(imageRef)
+		if err != nil {
+			return "", err
+		}
+		return digest, nil
+	}
+	digest := util.GetImageDigest(imageMetadata, imageRef)
+	if digest == "" {
+		return "", &noDigestError{name: named.Name()}
 	}
+	return digest, nil
+}
+
+// noDigestError is returned for a local image which was not pulled from the registry of its name
+type noDigestError struct {
+	name string
+}
 
-	return true
+func (e *noDigestError) Error() string {
+	return "the local image has no digest from " + e.name + ", it was not pulled from its registry"
 }
@@ -0,0 +1,259 @@
+package integrity
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/theupdateframework/notary/client"
+	store "github.com/theupdateframework/notary/storage"
+	"github.com/theupdateframework/notary/trustpinning"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// maxMetadataSize bounds the size of the cached TUF metadata files read without a known size
+const maxMetadataSize = 16 << 20
+
+// The targets roles the tags are looked up in, in the order docker looks them up: the tags docker trust sign adds
+// to the targets/releases delegation take precedence over the targets role and its other delegations
+const (
+	roleTargets  = "targets"
+	roleReleases = "targets/releases"
+)
+
+// Notary reads the signed targets of the repositories from notary servers with the notary client library, verifying
+// their TUF metadata like the docker content trust does but without pulling the images.
+// The trust data of a repository is cached in TrustDir per notary server: its root of trust, pinned the first time it
+// is fetched, and the last verified metadata, whose versions the metadata fetched later must not roll back.
+type Notary struct {
+	TrustDir string
+	Client   *http.Client
+	// ReadOnly verifies the trust data against the cached one without updating the cache, for the dry runs
+	ReadOnly bool
+}
+
+// NewNotary creates a notary client caching the trust data in trustDir, every request is bounded by timeout.
+// The notary servers are reached with transport, http.DefaultTransport when nil.
+func NewNotary(trustDir string, timeout time.Duration, transport http.RoundTripper) *Notary {
+	return &Notary{
+		TrustDir: trustDir,
+		Client:   &http.Client{Timeout: timeout, Transport: transport},
+	}
+}
+
+// Targets are the verified targets of a repository, the tags signed with the digest of their manifest
+type Targets struct {
+	targets map[string]*client.TargetWithRole
+}
+
+// Lookup returns the signed manifest digest of a tag and the role that signed it, ok is false when the tag is not
+// signed
+func (targets *Targets) Lookup(tag string) (digest, role string, ok bool) {
+	target, found := targets.targets[tag]
+	if !found {
+		return "", "", false
+	}
+	sum, hashed := target.Hashes["sha256"]
+	if !hashed {
+		return "", "", false
+	}
+	return "sha256:" + hex.EncodeToString(sum), target.Role.String(), true
+}
+
+// Signed tells whether a manifest digest is signed for any tag of the repository, returning the tag and role
+func (targets *Targets) Signed(digest string) (tag, role string, ok bool) {
+	tags := make([]string, 0, len(targets.targets))
+	for name := range targets.targets {
+		tags = append(tags, name)
+	}
+	sort.Strings(tags)
+	for _, name := range tags {
+		if signed, role, _ := targets.Lookup(name); signed == digest {
+			return name, role, true
+		}
+	}
+	return "", "", false
+}
+
+// Targets fetches and verifies the trust data of a repository, identified by its GUN such as
+// registry.example.com/app. All the delegations are followed, nested ones included. The trust data of a repository
+// without signature is reported as SignatureMissing.
+func (notary *Notary) Targets(notaryURL, gun string) (*Targets, error) {
+	fail := func(kind string, err error) (*Targets, error) {
+		return nil, &Error{Kind: kind, ImageRef: gun, NotaryURL: notaryURL, Detail: err.Error()}
+	}
+	serverURL := strings.TrimSuffix(notaryURL, "/")
+	remote, err := store.NewHTTPStore(serverURL+"/v2/"+gun+"/_trust/tuf/", "", "json", "key",
+		clientTransport{client: notary.Client})
+	if err != nil {
+		return fail(VerificationFailed, err)
+	}
+
+	repo, _, err := client.LoadTUFRepo(client.TUFLoadOptions{
+		GUN:          data.GUN(gun),
+		TrustPinning: trustpinning.TrustPinConfig{},
+		Cache:        notary.cache(serverURL, gun),
+		RemoteStore:  remote,
+	})
+	if err != nil {
+		return fail(kindOf(err), err)
+	}
+	listed, err := client.NewReadOnly(repo).ListTargets(roleReleases, roleTargets)
+	if err != nil {
+		return fail(TrustDataInvalid, err)
+	}
+	verified := &Targets{targets: make(map[string]*client.TargetWithRole)}
+	for _, target := range listed {
+		verified.targets[target.Name] = target
+	}
+	return verified, nil
+}
+
+// kindOf returns the kind of failure of an error of the notary client library
+func kindOf(err error) string {
+	switch err.(type) {
+	case client.ErrRepositoryNotExist, client.ErrRepoNotInitialized:
+		return SignatureMissing
+	case store.NetworkError, store.ErrServerUnavailable, store.ErrOffline:
+		return NotaryUnreachable
+	}
+	return TrustDataInvalid
+}
+
+// cacheDir returns the directory the trust data of a repository served by a notary server is cached in, laid out like
+// the trust directory of docker
+func (notary *Notary) cacheDir(serverURL, gun string) string {
+	return filepath.Join(notary.TrustDir, url.PathEscape(serverURL), "tuf", filepath.FromSlash(gun), "metadata")
+}
+
+// cache returns the cache of the trust data of a repository
+func (notary *Notary) cache(serverURL, gun string) store.MetadataStore {
+	cache := &trustCache{dir: notary.cacheDir(serverURL, gun)}
+	if notary.ReadOnly {
+		cache.updates = store.NewMemoryStore(nil)
+	}
+	return cache
+}
+
+// clientTransport sends the requests of the notary client library with an HTTP client, bounding them by its timeout
+type clientTransport struct {
+	client *http.Client
+}
+
+func (transport clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return transport.client.Do(req)
+}
+
+// trustCache stores the trust data of a repository in a directory. The files are replaced atomically, the plugin,
+// the OCI hook and the admission webhook sharing them. A read-only cache keeps the metadata updated in memory.
+type trustCache struct {
+	dir string
+	// updates holds the metadata updated through a read-only cache
+	updates *store.MemoryStore
+}
+
+func (cache *trustCache) path(name string) string {
+	return filepath.Join(cache.dir, filepath.FromSlash(name)+".json")
+}
+
+// GetSized reads the metadata of a role, up to size bytes
+func (cache *trustCache) GetSized(name string, size int64) ([]byte, error) {
+	if cache.updates != nil {
+		if meta, err := cache.updates.GetSized(name, size); err == nil {
+			return meta, nil
+		}
+	}
+	file, err := os.Open(cache.path(name))
+	if os.IsNotExist(err) {
+		return nil, store.ErrMetaNotFound{Resource: name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if size == store.NoSizeLimit {
+		size = maxMetadataSize
+	}
+	meta, err := ioutil.ReadAll(io.LimitReader(file, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(meta)) > size {
+		return nil, store.ErrMaliciousServer{}
+	}
+	return meta, nil
+}
+
+// Set stores the metadata of a role
+func (cache *trustCache) Set(name string, meta []byte) error {
+	if cache.updates != nil {
+		return cache.updates.Set(name, meta)
+	}
+	path := cache.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "Unable to create trust directory %s", filepath.Dir(path))
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".meta")
+	if err != nil {
+		return errors.Wrap(err, "Unable to cache the trust data")
+	}
+	_, err = tmp.Write(meta)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "Unable to cache the trust data")
+	}
+	return nil
+}
+
+// SetMulti stores the metadata of several roles
+func (cache *trustCache) SetMulti(metas map[string][]byte) error {
+	for name, meta := range metas {
+		if err := cache.Set(name, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes the metadata of a role
+func (cache *trustCache) Remove(name string) error {
+	if cache.updates != nil {
+		return cache.updates.Remove(name)
+	}
+	if err := os.Remove(cache.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RemoveAll deletes the trust data of the repository
+func (cache *trustCache) RemoveAll() error {
+	if cache.updates != nil {
+		return cache.updates.RemoveAll()
+	}
+	return os.RemoveAll(cache.dir)
+}
+
+// Location names the cache in the messages of the notary client library
+func (cache *trustCache) Location() string {
+	return cache.dir
+}
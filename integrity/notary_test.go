@@ -0,0 +1,308 @@
+package integrity
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"secure-docker-plugin/v3/integrity/fakenotary"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	gun         = "registry.example.com/app"
+	imageRef    = gun + ":1.0"
+	digest      = "sha256:4f1c5b7ce8a9c1b5d3c7f3e5c9a7b1d3f5e7a9c1b3d5f7e9a1c3b5d7f9e1a3c5"
+	otherDigest = "sha256:4f2a6c8e0b1d3f5a7c9e1b3d5f7a9c1e3b5d7f9a1c3e5b7d9f1a3c5e7b9d1f3a"
+)
+
+// testNotary is a notary client of a fake notary server, caching the trust data in a temporary directory
+type testNotary struct {
+	*Notary
+	server  *fakenotary.Server
+	url     string
+	cleanup func()
+}
+
+func newTestNotary(t *testing.T, opts fakenotary.Options) *testNotary {
+	dir, err := ioutil.TempDir("", "sdp-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fakenotary.New(opts)
+	httpServer := httptest.NewServer(server)
+	return &testNotary{
+		Notary: NewNotary(dir, 5*time.Second, nil),
+		server: server,
+		url:    httpServer.URL,
+		cleanup: func() {
+			httpServer.Close()
+			os.RemoveAll(dir)
+		},
+	}
+}
+
+// kind returns the kind of an integrity error
+func kind(err error) string {
+	if integrityErr, ok := err.(*Error); ok {
+		return integrityErr.Kind
+	}
+	return ""
+}
+
+func TestTargets(t *testing.T) {
+	for _, signer := range []string{"", roleReleases, "targets/qa", "targets/qa/nightly"} {
+		notary := newTestNotary(t, fakenotary.Options{Role: signer})
+		if err := notary.server.Sign(gun, "1.0", digest); err != nil {
+			t.Fatal(err)
+		}
+		targets, err := notary.Targets(notary.url, gun)
+		if err != nil {
+			t.Fatalf("Signed by %q: %v", signer, err)
+		}
+		wantRole := signer
+		if signer == "" {
+			wantRole = roleTargets
+		}
+		if signed, role, ok := targets.Lookup("1.0"); !ok || signed != digest || role != wantRole {
+			t.Errorf("Signed by %q: Lookup(1.0) = %s, %s, %v, want %s, %s", signer, signed, role, ok, digest,
+				wantRole)
+		}
+		if _, _, ok := targets.Lookup("2.0"); ok {
+			t.Errorf("Signed by %q: unsigned tag 2.0 found", signer)
+		}
+		if tag, _, ok := targets.Signed(digest); !ok || tag != "1.0" {
+			t.Errorf("Signed by %q: Signed(%s) = %s, %v, want 1.0", signer, digest, tag, ok)
+		}
+		notary.cleanup()
+	}
+}
+
+func TestTargetsFailures(t *testing.T) {
+	tamper := func(server *fakenotary.Server) error {
+		return server.Tamper(gun, "1.0", otherDigest)
+	}
+	tests := []struct {
+		name     string
+		opts     fakenotary.Options
+		unsigned bool
+		prepare  func(server *fakenotary.Server) error
+		kind     string
+	}{
+		{name: "no trust data", unsigned: true, kind: SignatureMissing},
+		{name: "expired", opts: fakenotary.Options{Expires: -time.Hour}, kind: TrustDataInvalid},
+		{name: "tampered targets", prepare: tamper, kind: TrustDataInvalid},
+		{name: "tampered delegation", opts: fakenotary.Options{Role: roleReleases}, prepare: tamper,
+			kind: TrustDataInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			notary := newTestNotary(t, test.opts)
+			defer notary.cleanup()
+			if !test.unsigned {
+				if err := notary.server.Sign(gun, "1.0", digest); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.prepare != nil {
+				if err := test.prepare(notary.server); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := notary.Targets(notary.url, gun); kind(err) != test.kind {
+				t.Errorf("Targets returned %v, want a %s error", err, test.kind)
+			}
+		})
+	}
+}
+
+func TestNotaryUnreachable(t *testing.T) {
+	notary := newTestNotary(t, fakenotary.Options{})
+	notary.cleanup()
+	if _, err := notary.Targets(notary.url, gun); kind(err) != NotaryUnreachable {
+		t.Errorf("Targets returned %v, want a %s error", err, NotaryUnreachable)
+	}
+}
+
+func TestReplayedTrustDataRejected(t *testing.T) {
+	tests := map[string]func(notary *testNotary) error{
+		// The tag was signed for another image, the trust data signing the previous one is served again once the
+		// new one was verified
+		"rollback": func(notary *testNotary) error {
+			if err := notary.server.Sign(gun, "1.0", otherDigest); err != nil {
+				return err
+			}
+			if _, err := notary.Targets(notary.url, gun); err != nil {
+				return err
+			}
+			return notary.server.Rollback(gun)
+		},
+		// The server stopped updating the trust data, which expired since
+		"freeze": func(notary *testNotary) error {
+			return notary.server.Freeze(gun)
+		},
+	}
+	for name, replay := range tests {
+		t.Run(name, func(t *testing.T) {
+			notary := newTestNotary(t, fakenotary.Options{Role: roleReleases})
+			defer notary.cleanup()
+			if err := notary.server.Sign(gun, "1.0", digest); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := notary.Targets(notary.url, gun); err != nil {
+				t.Fatal(err)
+			}
+			if err := replay(notary); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := notary.Targets(notary.url, gun); kind(err) != TrustDataInvalid {
+				t.Errorf("Targets returned %v for replayed trust data, want a %s error", err, TrustDataInvalid)
+			}
+		})
+	}
+}
+
+func TestRootRotation(t *testing.T) {
+	notary := newTestNotary(t, fakenotary.Options{})
+	defer notary.cleanup()
+	if err := notary.server.Sign(gun, "1.0", digest); err != nil {
+		t.Fatal(err)
+	}
+	// The first root is pinned, a root rotated with the pinned key replaces it
+	if _, err := notary.Targets(notary.url, gun); err != nil {
+		t.Fatal(err)
+	}
+	if err := notary.server.RotateRoot(gun, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := notary.Targets(notary.url, gun); err != nil {
+		t.Fatalf("Rotated root rejected: %v", err)
+	}
+	// A root not signed by the pinned one is rejected, until the cached trust data is removed
+	if err := notary.server.RotateRoot(gun, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := notary.Targets(notary.url, gun); kind(err) != TrustDataInvalid {
+		t.Fatalf("Targets returned %v with a new root of trust, want a %s error", err, TrustDataInvalid)
+	}
+	if err := os.RemoveAll(notary.cacheDir(notary.url, gun)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := notary.Targets(notary.url, gun); err != nil {
+		t.Errorf("Targets returned %v once the pinned root was removed", err)
+	}
+}
+
+func TestRootsPinnedPerServer(t *testing.T) {
+	// Two notary servers with their own root of trust for the same repository
+	notary := newTestNotary(t, fakenotary.Options{})
+	defer notary.cleanup()
+	other := fakenotary.New(fakenotary.Options{})
+	otherServer := httptest.NewServer(other)
+	defer otherServer.Close()
+	for _, server := range []*fakenotary.Server{notary.server, other} {
+		if err := server.Sign(gun, "1.0", digest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, url := range []string{notary.url, otherServer.URL, notary.url + "/"} {
+		if _, err := notary.Targets(url, gun); err != nil {
+			t.Errorf("Targets(%s) returned %v", url, err)
+		}
+	}
+}
+
+// fakeImages inspects the images of a fixed list
+type fakeImages map[string]types.ImageInspect
+
+func (images fakeImages) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte,
+	error) {
+	if image, ok := images[imageID]; ok {
+		return image, nil, nil
+	}
+	return types.ImageInspect{}, nil, errors.Errorf("No such image: %s", imageID)
+}
+
+// fakeRegistry serves the manifest digest of every image
+type fakeRegistry string
+
+func (registry fakeRegistry) ManifestDigest(imageRef string) (string, error) {
+	if registry == "" {
+		return "", errors.Errorf("manifest unknown: %s", imageRef)
+	}
+	return string(registry), nil
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	notary := newTestNotary(t, fakenotary.Options{Role: roleReleases})
+	defer notary.cleanup()
+	if err := notary.server.Sign(gun, "1.0", digest); err != nil {
+		t.Fatal(err)
+	}
+	pulled := types.ImageInspect{ID: "sha256:c0ffee", RepoTags: []string{imageRef},
+		RepoDigests: []string{gun + "@" + digest}}
+	tests := []struct {
+		name     string
+		imageRef string
+		images   fakeImages
+		registry fakeRegistry
+		kind     string
+	}{
+		{name: "pulled image", imageRef: imageRef, images: fakeImages{imageRef: pulled}},
+		{name: "image ID", imageRef: "sha256:c0ffee", images: fakeImages{"sha256:c0ffee": pulled, imageRef: pulled}},
+		{name: "remote image", imageRef: imageRef, registry: digest},
+		{name: "digest reference", imageRef: gun + "@" + digest},
+		{name: "other image pulled", imageRef: imageRef, images: fakeImages{imageRef: {ID: "sha256:c0ffee",
+			RepoTags: []string{imageRef}, RepoDigests: []string{gun + "@" + otherDigest}}}, kind: DigestMismatch},
+		{name: "image built locally", imageRef: imageRef, images: fakeImages{imageRef: {ID: "sha256:c0ffee",
+			RepoTags: []string{imageRef}}}, kind: DigestMismatch},
+		{name: "other image in the registry", imageRef: imageRef, registry: otherDigest, kind: DigestMismatch},
+		{name: "registry unreachable", imageRef: imageRef, kind: VerificationFailed},
+		{name: "unsigned tag", imageRef: gun + ":2.0", kind: SignatureMissing},
+		{name: "unsigned digest", imageRef: gun + "@" + otherDigest, kind: SignatureMissing},
+		{name: "invalid reference", imageRef: "Registry/App", kind: InvalidImageRef},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := &Verifier{Notary: notary.Notary, Registry: test.registry}
+			if test.images == nil {
+				test.images = fakeImages{}
+			}
+			signed, err := verifier.VerifyIntegrity(test.images, notary.url, test.imageRef)
+			if kind(err) != test.kind {
+				t.Fatalf("VerifyIntegrity returned %v, want a %q error", err, test.kind)
+			}
+			if test.kind == "" && (signed.Digest != digest || signed.Signer != roleReleases) {
+				t.Errorf("VerifyIntegrity returned %+v, want digest %s signed by %s", signed, digest, roleReleases)
+			}
+		})
+	}
+	if _, err := (&Verifier{Notary: notary.Notary}).VerifyIntegrity(fakeImages{}, "", imageRef); kind(err) !=
+		NotaryUnspecified {
+		t.Errorf("VerifyIntegrity returned %v without a notary URL, want a %s error", err, NotaryUnspecified)
+	}
+}
+
+func TestReadOnlyNotaryPinsNothing(t *testing.T) {
+	notary := newTestNotary(t, fakenotary.Options{})
+	defer notary.cleanup()
+	if err := notary.server.Sign(gun, "1.0", digest); err != nil {
+		t.Fatal(err)
+	}
+	notary.ReadOnly = true
+	if _, err := notary.Targets(notary.url, gun); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(notary.cacheDir(notary.url, gun)); !os.IsNotExist(err) {
+		t.Errorf("Trust data cached by a read-only notary client: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	// listenFdsStart is the first file descriptor passed by systemd socket activation
+	listenFdsStart = 3
+)
+
+// activationListener returns the listener inherited from systemd socket activation.
+// A nil listener is returned when the process was not started by a socket unit,
+// in which case the caller is expected to create the plugin socket itself.
+func activationListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return nil, nil
+	}
+
+	// The variables are meant for this process only, make sure they are not
+	// inherited by the commands executed by the plugin
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if nfds > 1 {
+		log.Printf("%d sockets passed by systemd, only the first one will be used", nfds)
+	}
+
+	f := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_"+strconv.Itoa(listenFdsStart))
+	defer f.Close()
+
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "SDP: Failed to use the socket passed by systemd")
+	}
+	return listener, nil
+}
@@ -6,27 +6,28 @@
 package main
 
 import (
+	"expvar"
 	"flag"
+	"fmt"
 	"github.com/docker/go-plugins-helpers/authorization"
 	"log"
+	"os"
 	"os/user"
+	"secure-docker-plugin/v3/config"
 	"secure-docker-plugin/v3/plugin"
-	"secure-docker-plugin/v3/util"
 	"strconv"
 )
 
-const (
-	defaultDockerHost = "unix:///var/run/docker.sock"
-	pluginSocket      = "/run/docker/plugins/secure-docker-plugin.sock"
-)
-
 var (
-	// Version holds the version number for the WLA binary
+	// Version holds the version number for the plugin binary
 	Version = ""
-	// BuildDate holds the build date for the WLA binary
+	// BuildDate holds the build date for the plugin binary
 	BuildDate = ""
-	// GitHash holds the commit hash for the WLA binary
+	// GitHash holds the commit hash for the plugin binary
 	GitHash = ""
+	// Branch and Time hold the branch and time of the build, set by the packaging along with Version
+	Branch = ""
+	Time   = ""
 )
 
 func recovery() {
@@ -35,33 +36,124 @@ func recovery() {
 	}
 }
 
-func main() {
-	log.Println("Plugin init")
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [options] [command]
+
+Runs the authorization plugin when no command is given.
+
+Commands:
+  config validate             Validate the configuration and print the effective settings
+  verify <image>              Resolve, fetch the flavor of and verify an image, print the result
+  simulate --request <file>   Run a captured authorization request and print the decision
+  status <container>          Print the recorded decision and trust report status of a container
+  replay <bundle>             Take again the decision of a captured request and compare it with the captured one
+  oci-hook                    Run as an OCI runtime hook on the container state read from stdin
+  invoke                      Run as a containerd NRI v0.1 plugin on the request read from stdin
+  webhook                     Serve the Kubernetes validating admission webhook
+  version                     Print the version information
+
+Options:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
 
-	flDockerHost := flag.String("host", defaultDockerHost, "Specifies the host where docker is running")
+func main() {
+	flConfigFile := flag.String("config", config.DefaultConfigFile, "Specifies the plugin configuration file")
+	flDockerHost := flag.String("host", "", "Specifies the host where docker is running, overrides docker.host from the configuration file")
+	flag.Usage = usage
 	flag.Parse()
 
+	args := flag.Args()
+	if len(args) == 0 {
+		serve(*flConfigFile, *flDockerHost)
+		return
+	}
+
+	switch args[0] {
+	case "config":
+		os.Exit(configCommand(args[1:], *flConfigFile, *flDockerHost))
+	case "verify":
+		os.Exit(verifyCommand(args[1:], *flConfigFile, *flDockerHost))
+	case "simulate":
+		os.Exit(simulateCommand(args[1:], *flConfigFile, *flDockerHost))
+	case "status":
+		os.Exit(statusCommand(args[1:], *flConfigFile, *flDockerHost))
+	case "replay":
+		os.Exit(replayCommand(args[1:]))
+	case "oci-hook":
+		os.Exit(ociHookCommand(args[1:], *flConfigFile))
+	case "invoke":
+		os.Exit(nriCommand(args[1:], *flConfigFile))
+	case "webhook":
+		os.Exit(webhookCommand(args[1:], *flConfigFile))
+	case "version":
+		os.Exit(versionCommand())
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+}
+
+// serve runs the authorization plugin until the listener fails
+func serve(configFile, dockerHost string) {
+	log.Println("Plugin init")
+
 	defer recovery()
 
-	// Create sdp instance
-	sdp, err := plugin.NewPlugin(*flDockerHost, util.WlagentSocketFile)
+	cfg, err := loadConfiguration(configFile, dockerHost)
 	if err != nil {
 		log.Fatal(err)
 	}
+	config.Set(cfg)
+	if err = applyLogging(cfg); err != nil {
+		log.Fatal(err)
+	}
 
-	// Start service handler on the local sock
-	u, err := user.Lookup("root")
+	// Create sdp instance
+	sdp, err := plugin.NewPlugin(cfg.Docker.Host, cfg.Wla.Socket)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	gid, err := strconv.Atoi(u.Gid)
+	handleReload(sdp, configFile, dockerHost)
+	sdp.Start()
+
+	handler := authorization.NewHandler(sdp)
+	// Decision counters and other runtime metrics
+	handler.HandleFunc("/debug/vars", expvar.Handler().ServeHTTP)
+	// Recorded decision and trust report status of the containers
+	handler.HandleFunc(plugin.StatusURI, sdp.ServeStatus)
+	// Workload agent connection state, for health checks
+	handler.HandleFunc(plugin.HealthURI, sdp.ServeHealth)
+
+	// Serve on the socket inherited from secure-docker-plugin.socket when started
+	// by systemd, so the plugin socket stays in place across service restarts
+	listener, err := activationListener()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	handler := authorization.NewHandler(sdp)
-	if err := handler.ServeUnix(pluginSocket, gid); err != nil {
+	if listener != nil {
+		log.Println("Serving on the socket passed by systemd")
+		err = handler.Serve(listener)
+	} else {
+		// Start service handler on the local sock
+		var u *user.User
+		u, err = user.Lookup("root")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var gid int
+		gid, err = strconv.Atoi(u.Gid)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = handler.ServeUnix(cfg.Plugin.Socket, gid)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 
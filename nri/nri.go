@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package nri is the containerd Node Resource Interface adapter of the decision engine. Containerd runs the NRI v0.1
+// plugins of /opt/nri/bin as <plugin> invoke with the request on stdin when it creates and deletes a task, and fails
+// the creation of the tasks whose plugin fails. The requests are handled like the OCI runtime hooks.
+//
+// NRI v0.1 has no start request: a task is reported as started once its creation is allowed, before it actually
+// starts. A task whose start fails is deleted by containerd with a delete request, which reports its termination;
+// the plugin must be the last one of the NRI configuration so that no other plugin fails the creation of a task
+// already reported.
+package nri
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"secure-docker-plugin/v3/ocihook"
+)
+
+// PluginName is the name the results are reported under
+const PluginName = "secure-docker-plugin"
+
+// States of the tasks the plugins are invoked for
+const (
+	StateCreate = "create"
+	StateDelete = "delete"
+	StateUpdate = "update"
+	StatePause  = "pause"
+	StateResume = "resume"
+)
+
+// Request is the part of the NRI v0.1 request read by the plugin
+type Request struct {
+	Version   string `json:"version"`
+	ID        string `json:"id"`
+	SandboxID string `json:"sandboxID,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+	State     string `json:"state"`
+	Spec      *Spec  `json:"spec"`
+}
+
+// Spec is the part of the container configuration passed in the requests read by the plugin
+type Spec struct {
+	Annotations map[string]string `json:"annotations"`
+}
+
+// Result is the result of a plugin, containerd passes it to the plugins invoked after it
+type Result struct {
+	Version  string            `json:"version"`
+	Plugin   string            `json:"plugin"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ReadRequest reads a request passed to the plugin
+func ReadRequest(r io.Reader) (Request, error) {
+	var request Request
+	if err := json.NewDecoder(r).Decode(&request); err != nil {
+		return request, errors.Wrap(err, "Invalid NRI request")
+	}
+	if request.ID == "" {
+		return request, errors.New("NRI request has no container ID")
+	}
+	return request, nil
+}
+
+// Plugin decides on the tasks of containerd with the OCI hook of the engine
+type Plugin struct {
+	hook *ocihook.Hook
+}
+
+// New returns a plugin deciding with hook
+func New(hook *ocihook.Hook) *Plugin {
+	return &Plugin{hook: hook}
+}
+
+// Invoke handles a request. It returns an error for a container denied on its creation, the reporting errors are
+// only logged. The pod sandboxes are not verified, their pause image is not the workload.
+func (plugin *Plugin) Invoke(request Request) (*Result, error) {
+	result := &Result{Version: request.Version, Plugin: PluginName, Metadata: map[string]string{}}
+	if request.ID == request.SandboxID {
+		return result, nil
+	}
+	state := ocihook.State{OCIVersion: request.Version, ID: request.ID, Pid: request.Pid}
+	if request.Spec != nil {
+		state.Annotations = request.Spec.Annotations
+	}
+
+	switch request.State {
+	case StateCreate:
+		// The task is created but not started: it is decided like the prestart hooks, and reported like the
+		// poststart hooks once allowed as there is no start request. Should the start fail, the delete request of
+		// the task reports its termination.
+		state.Status = ocihook.StatusCreated
+		if err := plugin.hook.Run(state); err != nil {
+			return nil, err
+		}
+		state.Status = ocihook.StatusRunning
+		plugin.hook.Run(state)
+	case StateDelete:
+		state.Status = ocihook.StatusStopped
+		plugin.hook.Run(state)
+	default:
+		log.Printf("Container %s %s request, nothing to do", request.ID, request.State)
+	}
+	return result, nil
+}
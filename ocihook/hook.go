@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package ocihook is the OCI runtime hook adapter of the decision engine. Run by runc or crun as a createRuntime or
+// prestart hook, for Podman, CRI-O or containerd, it fails the hook of the containers whose image is denied, so the
+// runtime does not start them. Run as a poststart and poststop hook, it reports the containers to the workload agent.
+package ocihook
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/plugin"
+	"secure-docker-plugin/v3/trustreport"
+	"secure-docker-plugin/v3/util"
+	"strings"
+)
+
+// Container statuses of the OCI runtime specification, telling the hook being run
+const (
+	// StatusCreating is the status seen by the createRuntime hooks
+	StatusCreating = "creating"
+	// StatusCreated is the status seen by the prestart hooks
+	StatusCreated = "created"
+	// StatusRunning is the status seen by the poststart hooks
+	StatusRunning = "running"
+	// StatusStopped is the status seen by the poststop hooks
+	StatusStopped = "stopped"
+)
+
+// State is the state of a container passed to the hooks on stdin, as defined by the OCI runtime specification
+type State struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// spec is the part of the container configuration of the bundle read by the hook
+type spec struct {
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ReadState reads the container state passed to a hook
+func ReadState(r io.Reader) (State, error) {
+	var state State
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return state, errors.Wrap(err, "Invalid container state")
+	}
+	if state.ID == "" {
+		return state, errors.New("Container state has no container ID")
+	}
+	return state, nil
+}
+
+// Hook takes the decisions of the engine on the containers of a runtime
+type Hook struct {
+	engine *plugin.Engine
+	images util.ImageInspector
+	// reports keeps the reports until the workload agent accepted them, across the hook runs
+	reports *trustreport.Spool
+}
+
+// New returns a hook deciding with engine, the images of the container runtime are inspected with images. The reports
+// are spooled in spoolDir, a hook run only ends once the pending reports were sent or failed.
+func New(engine *plugin.Engine, images util.ImageInspector, spoolDir string) *Hook {
+	// The spool is flushed by every hook run rather than retried in the background, the delays are not used
+	reports := trustreport.NewSpool(spoolDir, engine.SendReport, 0, 0)
+	return &Hook{engine: engine, images: images, reports: reports}
+}
+
+// imageRef returns the image of a container from the first configured annotation set, in the state or in the
+// configuration of the container bundle
+func imageRef(state State, annotations []string) string {
+	sources := []map[string]string{state.Annotations}
+	if state.Bundle != "" {
+		var bundleSpec spec
+		data, err := ioutil.ReadFile(filepath.Join(state.Bundle, "config.json"))
+		if err == nil {
+			err = json.Unmarshal(data, &bundleSpec)
+		}
+		if err != nil {
+			log.Printf("Unable to read the configuration of container %s: %v", state.ID, err)
+		}
+		sources = append(sources, bundleSpec.Annotations)
+	}
+	for _, annotation := range annotations {
+		for _, source := range sources {
+			if image := source[annotation]; image != "" {
+				return image
+			}
+		}
+	}
+	return ""
+}
+
+// Run handles a hook of a container, the hook run is told by the container status. It returns an error for a
+// container denied by the createRuntime or prestart hooks, the reporting errors of the other hooks are only logged.
+func (hook *Hook) Run(state State) error {
+	cfg := hook.engine.Config()
+	image := imageRef(state, cfg.OCIHook.ImageAnnotations)
+
+	switch state.Status {
+	case StatusCreating, StatusCreated:
+		if image == "" {
+			log.Printf("Container %s has no image annotation, applying policy %s", state.ID, cfg.OCIHook.Unannotated)
+			if cfg.OCIHook.Unannotated == config.ActionAllow {
+				return nil
+			}
+			return errors.Errorf("container %s denied: no image annotation among %s", state.ID,
+				strings.Join(cfg.OCIHook.ImageAnnotations, ", "))
+		}
+		decision := hook.engine.Admit(hook.images, image)
+		if !decision.Allow {
+			return errors.New(decision.Message(cfg.Policy.RedactDenialDetails))
+		}
+	case StatusRunning:
+		if image == "" {
+			return nil
+		}
+		imageInfo, _, err := hook.images.ImageInspectWithRaw(context.Background(), image)
+		if err == nil {
+			err = hook.report(state.ID, image, strings.TrimPrefix(imageInfo.ID, "sha256:"), trustreport.EventStart)
+		}
+		if err != nil {
+			log.Printf("Failed to report the start of container %s: %v", state.ID, err)
+		}
+	case StatusStopped:
+		if err := hook.report(state.ID, "", "", trustreport.EventStop); err != nil {
+			log.Printf("Failed to report the stop of container %s: %v", state.ID, err)
+		}
+	default:
+		log.Printf("Container %s has status %q, nothing to do", state.ID, state.Status)
+	}
+	return nil
+}
+
+// report spools the report of a container event and sends the pending reports, the reports which could not be sent
+// are retried by the next hook run
+func (hook *Hook) report(containerID, imageRef, imageID, event string) error {
+	report, err := hook.engine.ContainerReport(hook.images, containerID, imageRef, imageID, event)
+	if err != nil || report == nil {
+		return err
+	}
+	if err = hook.reports.Deliver(*report); err != nil {
+		return err
+	}
+	if err = hook.reports.Flush(); err != nil {
+		log.Printf("%d report(s) left for the next hook run: %v", hook.reports.Pending(), err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package ocihook
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// CommandInspector inspects the images with the image inspect command of a docker compatible CLI, such as podman,
+// or nerdctl for containerd
+type CommandInspector struct {
+	// Command is the CLI with its global options, such as nerdctl --namespace k8s.io
+	Command []string
+}
+
+// ImageInspectWithRaw returns the docker compatible description of an image
+func (inspector CommandInspector) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect,
+	[]byte, error) {
+	args := append(append([]string{}, inspector.Command[1:]...), "image", "inspect", image)
+	out, err := exec.CommandContext(ctx, inspector.Command[0], args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			err = errors.Errorf("%s: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return types.ImageInspect{}, nil, errors.Wrapf(err, "%s image inspect %s failed", inspector.Command[0], image)
+	}
+
+	var images []json.RawMessage
+	if err = json.Unmarshal(out, &images); err != nil {
+		return types.ImageInspect{}, nil, errors.Wrapf(err, "Invalid %s image inspect output", inspector.Command[0])
+	}
+	if len(images) == 0 {
+		return types.ImageInspect{}, nil, errors.Errorf("No such image: %s", image)
+	}
+	var imageInfo types.ImageInspect
+	if err = json.Unmarshal(images[0], &imageInfo); err != nil {
+		return types.ImageInspect{}, nil, errors.Wrapf(err, "Invalid %s image inspect output", inspector.Command[0])
+	}
+	// Podman reports the image ID without the digest algorithm
+	if imageInfo.ID != "" && !strings.Contains(imageInfo.ID, ":") {
+		imageInfo.ID = "sha256:" + imageInfo.ID
+	}
+	return imageInfo, images[0], nil
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// Decision counters, exported on the plugin socket under /debug/vars
+	allowedRequests = expvar.NewInt("sdp_requests_allowed")
+	deniedRequests  = expvar.NewInt("sdp_requests_denied")
+	auditedRequests = expvar.NewInt("sdp_requests_audited")
+
+	auditmtx sync.Mutex
+)
+
+// auditRecord is written to logging.audit-file for every request denied in audit mode
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Decision Decision  `json:"decision"`
+}
+
+// recordDecision logs the decision taken on a create request and updates the decision counters, the audited
+// decisions are appended to auditFile when not empty
+func recordDecision(decision Decision, auditFile string) {
+	switch {
+	case decision.Audited:
+		auditedRequests.Add(1)
+		log.Printf("[AUDIT] %s would be denied by %s: %s", decision.ImageRef, decision.policySource(), decision.Reason)
+		writeAuditRecord(decision, auditFile)
+	case decision.Allow:
+		allowedRequests.Add(1)
+		log.Printf("[ALLOWED] %s: %s", decision.ImageRef, decision.Reason)
+	default:
+		deniedRequests.Add(1)
+		log.Printf("[DENIED] %s: %s", decision.ImageRef, decision.Reason)
+	}
+}
+
+// writeAuditRecord appends the decision to auditFile, when one is configured
+func writeAuditRecord(decision Decision, auditFile string) {
+	if auditFile == "" {
+		return
+	}
+
+	record, err := json.Marshal(auditRecord{Time: time.Now().UTC(), Decision: decision})
+	if err != nil {
+		log.Printf("Error marshalling audit record: %v", err)
+		return
+	}
+
+	auditmtx.Lock()
+	defer auditmtx.Unlock()
+	f, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Printf("Unable to open audit file %s: %v", auditFile, err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(record, '\n')); err != nil {
+		log.Printf("Unable to write audit record to %s: %v", auditFile, err)
+	}
+}
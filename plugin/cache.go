@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"log"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
+	"sync"
+	"time"
+)
+
+type cachedFlavor struct {
+	flavor  wla.Flavor
+	expires time.Time
+}
+
+// flavorCache keeps the flavors fetched from the workload agent for cache.flavor-ttl
+type flavorCache struct {
+	mtx     sync.Mutex
+	flavors map[string]cachedFlavor
+}
+
+func (cache *flavorCache) get(imageUUID string) (wla.Flavor, bool) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	cached, ok := cache.flavors[imageUUID]
+	if !ok || time.Now().After(cached.expires) {
+		return wla.Flavor{}, false
+	}
+	return cached.flavor, true
+}
+
+func (cache *flavorCache) put(imageUUID string, flvr wla.Flavor, ttl time.Duration) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	if cache.flavors == nil {
+		cache.flavors = make(map[string]cachedFlavor)
+	}
+	now := time.Now()
+	for id, cached := range cache.flavors {
+		if now.After(cached.expires) {
+			delete(cache.flavors, id)
+		}
+	}
+	cache.flavors[imageUUID] = cachedFlavor{flavor: flvr, expires: now.Add(ttl)}
+}
+
+func (cache *flavorCache) clear() {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	cache.flavors = nil
+}
+
+// getImageFlavor returns the image flavor from the cache, fetching it from the workload agent when needed
+func (engine *Engine) getImageFlavor(agent wla.Agent, imageUUID string) (wla.Flavor, error) {
+	ttl := engine.config().Cache.FlavorTTL.Duration
+	if ttl > 0 {
+		if flvr, ok := engine.flavors.get(imageUUID); ok {
+			return flvr, nil
+		}
+	}
+
+	flvr, err := agent.FetchFlavor(imageUUID)
+	if err != nil {
+		return flvr, err
+	}
+	if ttl > 0 {
+		engine.flavors.put(imageUUID, flvr, ttl)
+	}
+	return flvr, nil
+}
+
+// findImageFlavor looks the flavor of an image up with each of its keys in turn, the first flavor found applies.
+// It returns a NotFound error when no key has a flavor and stops at the first other error.
+// The flavors looked up are recorded with rec when not nil.
+func (engine *Engine) findImageFlavor(agent wla.Agent, keys []util.FlavorKey,
+	rec *recorder) (wla.Flavor, util.FlavorKey, error) {
+	for _, key := range keys {
+		flvr, err := engine.getImageFlavor(agent, key.UUID)
+		rec.flavor(key.UUID, flvr, err)
+		if wla.IsNotFound(err) {
+			continue
+		}
+		if err == nil {
+			log.Printf("Found flavor %s by %s %s", flvr.Meta.ID, key.Kind, key.Value)
+		}
+		return flvr, key, err
+	}
+	return wla.Flavor{}, util.FlavorKey{}, &wla.Error{Kind: wla.NotFound, Method: wla.MethodFetchFlavor}
+}
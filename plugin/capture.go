@@ -0,0 +1,261 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"secure-docker-plugin/v3/capture"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/flavorsig"
+	"secure-docker-plugin/v3/integrity"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// capturedRequests counts the capture bundles written
+var capturedRequests = expvar.NewInt("sdp_requests_captured")
+
+// recorder records the responses a decision depends on into a capture bundle.
+// A nil recorder records nothing and leaves the clients untouched.
+type recorder struct {
+	mtx    sync.Mutex
+	bundle *capture.Bundle
+}
+
+// newRecorder starts the capture of a request, nil when the capture is disabled
+func newRecorder(req authorization.Request, cfg *config.Configuration) *recorder {
+	if !cfg.Capture.Enabled {
+		return nil
+	}
+	return &recorder{bundle: capture.NewBundle(req, cfg.String())}
+}
+
+// sentinels are the errors recorded by kind, so they are replayed as is
+var sentinels = map[string]error{
+	"flavor-unsigned":       flavorsig.ErrUnsigned,
+	"flavor-no-certificate": flavorsig.ErrNoCertificate,
+}
+
+// certificateFailure is the kind of the recorded flavorsig.CertificateError values
+const certificateFailure = "flavor-certificate"
+
+// failure records an error, keeping the kind of the workload agent, flavor certificate and docker not found errors
+func failure(err error) *capture.Failure {
+	if err == nil {
+		return nil
+	}
+	for kind, sentinel := range sentinels {
+		if err == sentinel {
+			return &capture.Failure{Kind: kind, Message: err.Error()}
+		}
+	}
+	if _, ok := err.(*flavorsig.CertificateError); ok {
+		return &capture.Failure{Kind: certificateFailure, Message: err.Error()}
+	}
+	if wlaErr, ok := err.(*wla.Error); ok {
+		recorded := &capture.Failure{Kind: wlaErr.Kind, Method: wlaErr.Method}
+		if wlaErr.Err != nil {
+			recorded.Message = wlaErr.Err.Error()
+		}
+		return recorded
+	}
+	if dockerclient.IsErrNotFound(err) {
+		return &capture.Failure{Kind: capture.NotFound, Message: err.Error()}
+	}
+	return &capture.Failure{Message: err.Error()}
+}
+
+func (rec *recorder) record(update func(bundle *capture.Bundle)) {
+	if rec == nil {
+		return
+	}
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	update(rec.bundle)
+}
+
+func (rec *recorder) docker(dc DockerClient) DockerClient {
+	if rec == nil {
+		return dc
+	}
+	return recordingDocker{DockerClient: dc, rec: rec}
+}
+
+func (rec *recorder) registry(registry util.Registry) util.Registry {
+	if rec == nil {
+		return registry
+	}
+	return recordingRegistry{registry: registry, rec: rec}
+}
+
+func (rec *recorder) agent(agent wla.Agent) wla.Agent {
+	if rec == nil {
+		return agent
+	}
+	return recordingAgent{Agent: agent, rec: rec}
+}
+
+func (rec *recorder) integrity(verifier IntegrityVerifier) IntegrityVerifier {
+	if rec == nil {
+		return verifier
+	}
+	return recordingIntegrity{verifier: verifier, rec: rec}
+}
+
+func (rec *recorder) flavorVerifier(verifier FlavorVerifier) FlavorVerifier {
+	if rec == nil {
+		return verifier
+	}
+	return recordingFlavorVerifier{verifier: verifier, rec: rec}
+}
+
+// wla records the workload agent connection, wlac is nil when the workload agent is not installed
+func (rec *recorder) wla(wlac WlaClient, err error) {
+	rec.record(func(bundle *capture.Bundle) {
+		bundle.Wla = &capture.Wla{Installed: wlac != nil || err != nil, Error: failure(err)}
+	})
+}
+
+// flavor records a flavor, fetched from the workload agent or from the flavor cache
+func (rec *recorder) flavor(imageUUID string, flvr wla.Flavor, err error) {
+	rec.record(func(bundle *capture.Bundle) {
+		recorded := capture.Flavor{Error: failure(err)}
+		if err == nil {
+			recorded.Flavor = &flvr
+		}
+		bundle.Flavors[imageUUID] = recorded
+	})
+}
+
+func (rec *recorder) revocation(imageID, reason string) {
+	rec.record(func(bundle *capture.Bundle) {
+		bundle.Revocations[imageID] = reason
+	})
+}
+
+// save writes the bundle with the decision to capture.dir, only the denials are kept with capture.denied-only
+func (rec *recorder) save(decision Decision, resp authorization.Response, cfg *config.CaptureConfig) {
+	if rec == nil || (cfg.DeniedOnly && decision.Code == "") {
+		return
+	}
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	data, err := json.Marshal(decision)
+	if err != nil {
+		log.Println("Error marshalling the captured decision: ", err)
+		return
+	}
+	rec.bundle.Decision = data
+	rec.bundle.Response = resp
+	path, err := capture.Save(cfg.Dir, rec.bundle, cfg.MaxBundles)
+	if err != nil {
+		log.Println("Failed to save the capture bundle: ", err)
+		return
+	}
+	capturedRequests.Add(1)
+	log.Printf("Request %s %s captured in %s", rec.bundle.Request.RequestMethod, rec.bundle.Request.RequestURI, path)
+}
+
+// recordingDocker records the image and container inspections
+type recordingDocker struct {
+	DockerClient
+	rec *recorder
+}
+
+func (dc recordingDocker) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	inspect, raw, err := dc.DockerClient.ImageInspectWithRaw(ctx, imageID)
+	dc.rec.record(func(bundle *capture.Bundle) {
+		recorded := capture.Image{Error: failure(err)}
+		if err == nil {
+			recorded.Inspect = &inspect
+		}
+		bundle.Images[imageID] = recorded
+	})
+	return inspect, raw, err
+}
+
+func (dc recordingDocker) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	inspect, err := dc.DockerClient.ContainerInspect(ctx, container)
+	dc.rec.record(func(bundle *capture.Bundle) {
+		recorded := capture.Container{Error: failure(err)}
+		if err == nil {
+			recorded.Inspect = &inspect
+		}
+		bundle.Containers[container] = recorded
+	})
+	return inspect, err
+}
+
+// recordingRegistry records the digests resolved with the registry
+type recordingRegistry struct {
+	registry util.Registry
+	rec      *recorder
+}
+
+func (registry recordingRegistry) ImageDigest(imageRef string) (string, error) {
+	digest, err := registry.registry.ImageDigest(imageRef)
+	registry.rec.record(func(bundle *capture.Bundle) {
+		bundle.Digests[imageRef] = capture.Digest{Digest: digest, Error: failure(err)}
+	})
+	return digest, err
+}
+
+// recordingAgent records the key requests, the flavors are recorded by the recorder as they may come from the cache
+type recordingAgent struct {
+	wla.Agent
+	rec *recorder
+}
+
+func (agent recordingAgent) FetchKey(keyURL string) ([]byte, error) {
+	key, err := agent.Agent.FetchKey(keyURL)
+	agent.rec.record(func(bundle *capture.Bundle) {
+		bundle.Keys[keyURL] = capture.Key{Size: len(key), Error: failure(err)}
+	})
+	return key, err
+}
+
+// recordingIntegrity records the signature verifications
+type recordingIntegrity struct {
+	verifier IntegrityVerifier
+	rec      *recorder
+}
+
+func (verifier recordingIntegrity) VerifyIntegrity(dc util.ImageInspector, notaryURL, imageRef string) (
+	integrity.Signature, error) {
+	signature, err := verifier.verifier.VerifyIntegrity(dc, notaryURL, imageRef)
+	verifier.rec.record(func(bundle *capture.Bundle) {
+		recorded := capture.Integrity{Digest: signature.Digest, Signer: signature.Signer}
+		if integrityErr, ok := err.(*integrity.Error); ok {
+			recorded.IntegrityError = integrityErr
+		} else {
+			recorded.Error = failure(err)
+		}
+		bundle.Integrity[capture.IntegrityKey(notaryURL, imageRef)] = recorded
+	})
+	return signature, err
+}
+
+// recordingFlavorVerifier records the flavor signature verifications
+type recordingFlavorVerifier struct {
+	verifier FlavorVerifier
+	rec      *recorder
+}
+
+func (verifier recordingFlavorVerifier) VerifyFlavor(flvr wla.Flavor) error {
+	err := verifier.verifier.VerifyFlavor(flvr)
+	verifier.rec.record(func(bundle *capture.Bundle) {
+		bundle.FlavorSignatures[flvr.Meta.ID] = failure(err)
+	})
+	return err
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"secure-docker-plugin/v3/integrity"
+)
+
+// DenialCode is a stable identifier of the reason a request was denied, returned to the docker client
+type DenialCode string
+
+// Denial codes
+const (
+	CodeInvalidRequest    DenialCode = "SDP-INVALID-REQUEST"
+	CodeDockerUnavailable DenialCode = "SDP-DOCKER-UNAVAILABLE"
+	CodeImageUnresolved   DenialCode = "SDP-IMAGE-UNRESOLVED"
+	CodeWlaUnavailable    DenialCode = "SDP-WLA-UNAVAILABLE"
+	CodeFlavorFetchFailed DenialCode = "SDP-FLAVOR-FETCH-FAILED"
+	CodeFlavorNotFound    DenialCode = "SDP-FLAVOR-NOT-FOUND"
+	CodePolicyRule        DenialCode = "SDP-POLICY-RULE"
+	CodeNotaryUnspecified DenialCode = "SDP-NOTARY-UNSPECIFIED"
+	CodeNotaryUnreachable DenialCode = "SDP-NOTARY-UNREACHABLE"
+	CodeSignatureMissing  DenialCode = "SDP-SIGNATURE-MISSING"
+	CodeDigestMismatch    DenialCode = "SDP-DIGEST-MISMATCH"
+	CodeTrustDataInvalid  DenialCode = "SDP-TRUST-DATA-INVALID"
+	CodeIntegrityFailed   DenialCode = "SDP-INTEGRITY-FAILED"
+	CodeSignatureRevoked  DenialCode = "SDP-SIGNATURE-REVOKED"
+	CodeImageNotPresent   DenialCode = "SDP-IMAGE-NOT-PRESENT"
+	CodeImageNotEncrypted DenialCode = "SDP-IMAGE-NOT-ENCRYPTED"
+	CodeCipherNotAllowed  DenialCode = "SDP-CIPHER-NOT-ALLOWED"
+	CodeKeyUnavailable    DenialCode = "SDP-KEY-UNAVAILABLE"
+	CodeFlavorUnsigned    DenialCode = "SDP-FLAVOR-UNSIGNED"
+	CodeFlavorSigInvalid  DenialCode = "SDP-FLAVOR-SIGNATURE-INVALID"
+	CodeConfigInvalid     DenialCode = "SDP-CONFIG-INVALID"
+)
+
+// denialSummaries are the messages returned instead of the details when policy.redact-denial-details is set
+var denialSummaries = map[DenialCode]string{
+	CodeInvalidRequest:    "the request could not be parsed",
+	CodeDockerUnavailable: "the docker daemon could not be reached",
+	CodeImageUnresolved:   "the image could not be resolved",
+	CodeWlaUnavailable:    "the workload agent could not be reached",
+	CodeFlavorFetchFailed: "the image flavor could not be fetched",
+	CodeFlavorNotFound:    "the image has no flavor",
+	CodePolicyRule:        "the image is denied by a policy rule",
+	CodeNotaryUnspecified: "the image flavor has no notary server",
+	CodeNotaryUnreachable: "the notary server could not be reached",
+	CodeSignatureMissing:  "the image is not signed",
+	CodeDigestMismatch:    "the image does not match its signed digest",
+	CodeTrustDataInvalid:  "the image signature data is invalid",
+	CodeIntegrityFailed:   "the image integrity could not be verified",
+	CodeSignatureRevoked:  "the image signature was revoked",
+	CodeImageNotPresent:   "the image requires confidentiality but is not present on the node",
+	CodeImageNotEncrypted: "the image requires confidentiality but is not encrypted",
+	CodeCipherNotAllowed:  "the image is encrypted with a cipher which is not allowed",
+	CodeKeyUnavailable:    "the image key could not be obtained",
+	CodeFlavorUnsigned:    "the image flavor is not signed",
+	CodeFlavorSigInvalid:  "the image flavor signature is invalid",
+	CodeConfigInvalid:     "the plugin configuration is invalid",
+}
+
+// integrityCodes maps the integrity verification failures to denial codes
+var integrityCodes = map[string]DenialCode{
+	integrity.NotaryUnspecified:  CodeNotaryUnspecified,
+	integrity.InvalidImageRef:    CodeImageUnresolved,
+	integrity.NotaryUnreachable:  CodeNotaryUnreachable,
+	integrity.SignatureMissing:   CodeSignatureMissing,
+	integrity.DigestMismatch:     CodeDigestMismatch,
+	integrity.TrustDataInvalid:   CodeTrustDataInvalid,
+	integrity.VerificationFailed: CodeIntegrityFailed,
+}
+
+// denialMessage formats the message returned to the docker client for a denial
+func denialMessage(code DenialCode, detail string, redact bool) string {
+	return "secure-docker-plugin: " + denialDetail(code, detail, redact)
+}
+
+// denialDetail formats the denial code and detail, the detail is replaced by the summary of the code when redact is set
+func denialDetail(code DenialCode, detail string, redact bool) string {
+	if redact || detail == "" {
+		detail = denialSummaries[code]
+	}
+	return fmt.Sprintf("[%s] %s", code, detail)
+}
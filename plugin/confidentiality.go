@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"log"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
+	"strings"
+
+	dockerclient "github.com/docker/docker/client"
+)
+
+// verifyConfidentiality checks that an image whose flavor requires encryption was encrypted locally with an
+// allowed cipher and that its key can be obtained from the workload agent
+func (engine *Engine) verifyConfidentiality(decision Decision, images util.ImageInspector, agent wla.Agent,
+	flvr wla.Flavor) Decision {
+	imageInfo, _, err := images.ImageInspectWithRaw(context.Background(), decision.ImageID)
+	if dockerclient.IsErrNotFound(err) {
+		return decision.deny(CodeImageNotPresent, "flavor "+flvr.Meta.ID+" requires encryption but image "+
+			decision.ImageRef+" is not present on the node")
+	}
+	if err != nil {
+		return decision.deny(CodeImageUnresolved, "unable to inspect image "+decision.ImageRef+": "+err.Error())
+	}
+	securityMetaData, err := util.ImageSecurityMetaData(&imageInfo)
+	if err != nil {
+		log.Println("Error getting security meta data: ", err)
+		return decision.deny(CodeImageNotEncrypted, "unable to read the security metadata of image "+decision.ImageRef+": "+err.Error())
+	}
+	if securityMetaData == nil || !securityMetaData.RequiresConfidentiality {
+		return decision.deny(CodeImageNotEncrypted, "flavor "+flvr.Meta.ID+" requires encryption but image "+
+			decision.ImageRef+" has no confidentiality metadata")
+	}
+	if !securityMetaData.IsSecurityTransformed {
+		return decision.deny(CodeImageNotEncrypted, "flavor "+flvr.Meta.ID+" requires encryption but image "+
+			decision.ImageRef+" is not encrypted")
+	}
+
+	policy := engine.config().Policy
+	for _, cipher := range securityMetaData.Ciphers() {
+		if !policy.CipherAllowed(cipher) {
+			return decision.deny(CodeCipherNotAllowed, "image "+decision.ImageRef+" is encrypted with cipher "+
+				cipher+" which is not in policy.allowed-ciphers")
+		}
+	}
+
+	key, err := agent.FetchKey(flvr.Encryption.KeyURL)
+	if err != nil {
+		return decision.deny(CodeKeyUnavailable, "unable to obtain the key of image "+decision.ImageRef+": "+err.Error())
+	}
+	// Only the availability of the key matters, do not keep it around
+	for i := range key {
+		key[i] = 0
+	}
+
+	decision.ConfidentialityVerified = true
+	return decision
+}
+
+// VerifyContainerStart checks the confidentiality requirements of the image of a container about to be started,
+// the containers created before the image flavor required encryption are caught here. The key of a container whose
+// confidentiality was verified at creation with the same flavor is not fetched again.
+func (plugin *SecureDockerPlugin) VerifyContainerStart(containerRef string) Decision {
+	return plugin.verifyContainerStart(containerRef, nil)
+}
+
+// verifyContainerStart checks a container start, recording the responses the decision depends on with rec
+func (plugin *SecureDockerPlugin) verifyContainerStart(containerRef string, rec *recorder) Decision {
+	decision := Decision{}
+
+	dc, err := plugin.getDockerClient()
+	if err != nil {
+		plugin.closeDockerClient()
+		return decision.deny(CodeDockerUnavailable, "docker daemon unavailable: "+err.Error())
+	}
+	dc = rec.docker(dc)
+	instanceInfo, err := dc.ContainerInspect(context.Background(), containerRef)
+	if err != nil {
+		return decision.deny(CodeImageUnresolved, "unable to inspect container "+containerRef+": "+err.Error())
+	}
+	if instanceInfo.Config != nil {
+		decision.ImageRef = instanceInfo.Config.Image
+	}
+	decision.ImageID = strings.TrimPrefix(instanceInfo.Image, "sha256:")
+	decision.ImageUUID = util.GetUUIDFromImageID(decision.ImageID)
+
+	wlac, err := plugin.getWlaClient()
+	rec.wla(wlac, err)
+	if err != nil {
+		return decision.deny(CodeWlaUnavailable, "workload agent unavailable: "+err.Error())
+	}
+	if wlac == nil {
+		policy := plugin.config().Policy
+		return decision.apply(policy.WlaUnavailable, CodeWlaUnavailable, "workload agent is not installed")
+	}
+
+	agent := rec.agent(wlac)
+	imageInfo, _ := util.GetImageMetadata(dc, decision.ImageID)
+	keys := util.GetFlavorKeys(&plugin.config().FlavorLookup, decision.ImageRef, decision.ImageID,
+		util.GetImageDigest(imageInfo, decision.ImageRef))
+	flvr, key, err := plugin.findImageFlavor(agent, keys, rec)
+	// The flavor policy was applied when the container was created
+	if wla.IsNotFound(err) {
+		return decision.allow("image " + decision.ImageRef + " has no flavor")
+	}
+	if err != nil {
+		return decision.deny(CodeFlavorFetchFailed, "flavor fetch failed for image "+decision.ImageRef+": "+err.Error())
+	}
+	decision.FlavorID = flvr.Meta.ID
+	decision.FlavorKey = key.Kind
+	decision.FlavorKeyUUID = key.UUID
+	decision, ok := plugin.verifyFlavorSignature(decision, flvr, rec)
+	if !ok {
+		return decision
+	}
+	if !flvr.EncryptionRequired {
+		return decision.allow("image " + decision.ImageRef + " does not require confidentiality")
+	}
+	decision.ConfidentialityRequired = true
+
+	if created, err := plugin.states.Get(instanceInfo.ID); err == nil && created.ConfidentialityVerified &&
+		created.FlavorID == flvr.Meta.ID && created.ImageID == decision.ImageID {
+		decision.ConfidentialityVerified = true
+		return decision.allow("image confidentiality verified when the container was created")
+	}
+	decision = plugin.verifyConfidentiality(decision, dc, agent, flvr)
+	if !decision.ConfidentialityVerified {
+		return decision
+	}
+	return decision.allow("image encrypted with an allowed cipher and its key available")
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"secure-docker-plugin/v3/state"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+	"intel/isecl/lib/flavor/v3"
+)
+
+const encryptedMetaData = `{"RequiresConfidentiality": true, "IsSecurityTransformed": true, "KeyHandle": "f2c863b9",
+	"KeySize": "256", "KeyType": "key-type-keyrings", "CryptCipher": "aes-xts-plain64"}`
+
+// keyAgent is a workload agent client serving the flavors of a fixed list and a key, counting the key fetches
+type keyAgent struct {
+	flavorAgent
+	key     []byte
+	fetches int
+}
+
+func (agent *keyAgent) FetchKey(keyURL string) ([]byte, error) {
+	agent.fetches++
+	if agent.key == nil {
+		return nil, errors.Errorf("no key for %s", keyURL)
+	}
+	return append([]byte(nil), agent.key...), nil
+}
+
+func (agent *keyAgent) OnConnect(onConnect func()) {}
+
+// encryptedFlavor is a flavor requiring encryption
+func encryptedFlavor(id string) wla.Flavor {
+	return wla.Flavor{Image: flavor.Image{Meta: flavor.Meta{ID: id}, EncryptionRequired: true,
+		Encryption: &flavor.Encryption{KeyURL: "https://kbs.example.com/keys/" + id}}}
+}
+
+// imageWithMetaData is an image with the security metadata data
+func imageWithMetaData(data string) types.ImageInspect {
+	image := types.ImageInspect{ID: "sha256:c0ffee"}
+	image.GraphDriver.Data = map[string]string{"security-meta-data": data}
+	return image
+}
+
+func TestVerifyConfidentiality(t *testing.T) {
+	tests := []struct {
+		name   string
+		images imagesByRef
+		key    []byte
+		code   DenialCode
+	}{
+		{name: "encrypted", images: imagesByRef{"c0ffee": imageWithMetaData(encryptedMetaData)}, key: []byte("key")},
+		{name: "not present", images: imagesByRef{}, code: CodeImageNotPresent},
+		{name: "no metadata", images: imagesByRef{"c0ffee": {ID: "sha256:c0ffee"}}, code: CodeImageNotEncrypted},
+		{name: "not encrypted", images: imagesByRef{"c0ffee": imageWithMetaData(`{"RequiresConfidentiality": true}`)},
+			code: CodeImageNotEncrypted},
+		{name: "cipher not allowed", images: imagesByRef{"c0ffee": imageWithMetaData(`{"RequiresConfidentiality": true,
+			"IsSecurityTransformed": true, "KeyHandle": "f2c863b9", "KeySize": "256", "KeyType": "key-type-keyrings",
+			"CryptCipher": "aes-cbc-essiv:sha256"}`)}, code: CodeCipherNotAllowed},
+		{name: "key unavailable", images: imagesByRef{"c0ffee": imageWithMetaData(encryptedMetaData)},
+			code: CodeKeyUnavailable},
+	}
+	engine := NewEngine("/nonexistent/wlagent.sock", withConfig(testConfig(t, "/nonexistent")))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := &keyAgent{key: test.key}
+			decision := engine.verifyConfidentiality(Decision{ImageRef: "app:1.0", ImageID: "c0ffee"},
+				test.images, agent, encryptedFlavor("flavor-app"))
+			if decision.Code != test.code || decision.ConfidentialityVerified != (test.code == "") {
+				t.Errorf("Decision = %+v, want code %q", decision, test.code)
+			}
+		})
+	}
+}
+
+// startDocker is a docker daemon running the containers and images of fixed lists
+type startDocker struct {
+	DockerClient
+	images     imagesByRef
+	containers map[string]types.ContainerJSON
+}
+
+func (docker startDocker) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte,
+	error) {
+	return docker.images.ImageInspectWithRaw(ctx, image)
+}
+
+func (docker startDocker) ContainerInspect(ctx context.Context, containerRef string) (types.ContainerJSON, error) {
+	if info, ok := docker.containers[containerRef]; ok {
+		return info, nil
+	}
+	return types.ContainerJSON{}, notFoundError("No such container: " + containerRef)
+}
+
+func TestContainerStartKeyCheckedAtCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdp-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := imageWithMetaData(encryptedMetaData)
+	docker := startDocker{images: imagesByRef{"c0ffee": image}, containers: make(map[string]types.ContainerJSON)}
+	verified, unverified := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	for _, id := range []string{verified, unverified} {
+		docker.containers[id] = types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: id,
+			Image: image.ID}, Config: &container.Config{Image: "app:1.0"}}
+	}
+	agent := &keyAgent{key: []byte("key")}
+	agent.flavors = map[string]wla.Flavor{util.GetUUIDFromImageID("c0ffee"): encryptedFlavor("flavor-app")}
+	sdp := newPlugin("unix:///nonexistent/docker.sock", "/nonexistent/wlagent.sock",
+		WithDockerClient(func(host string) (DockerClient, error) {
+			return docker, nil
+		}),
+		WithWlaClient(agent), withConfig(testConfig(t, dir)))
+	err = sdp.states.Put(state.ContainerStatus{ContainerID: verified, ImageID: "c0ffee", FlavorID: "flavor-app",
+		ConfidentialityVerified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decision := sdp.VerifyContainerStart(verified); !decision.Allow || agent.fetches != 0 {
+		t.Errorf("Decision = %+v after %d key fetches, want allowed without fetching the key", decision,
+			agent.fetches)
+	}
+	if decision := sdp.VerifyContainerStart(unverified); !decision.Allow || agent.fetches != 1 {
+		t.Errorf("Decision = %+v after %d key fetches, want allowed once the key was fetched", decision,
+			agent.fetches)
+	}
+}
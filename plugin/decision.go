@@ -0,0 +1,271 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/integrity"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// Decision is the outcome of the image policy evaluation along with the reasoning behind it
+type Decision struct {
+	Allow bool `json:"allow"`
+	// Code identifies the denial reason, it is kept in audit mode to report what would have been denied
+	Code              DenialCode `json:"code,omitempty"`
+	Reason            string     `json:"reason"`
+	ImageRef          string     `json:"image_ref,omitempty"`
+	ImageID           string     `json:"image_id,omitempty"`
+	ImageUUID         string     `json:"image_uuid,omitempty"`
+	FlavorID          string     `json:"flavor_id,omitempty"`
+	IntegrityRequired bool       `json:"integrity_required"`
+	IntegrityVerified bool       `json:"integrity_verified"`
+	NotaryURL         string     `json:"notary_url,omitempty"`
+	// FlavorKey is the kind of key the flavor was found with, FlavorKeyUUID the UUID of that key: the image UUID
+	// the workload agent knows the image by, reported in the trust reports
+	FlavorKey     string `json:"flavor_key,omitempty"`
+	FlavorKeyUUID string `json:"flavor_key_uuid,omitempty"`
+	// FlavorSignatureVerified is set once the flavor signature was verified with the flavor signing certificate
+	FlavorSignatureVerified bool `json:"flavor_signature_verified"`
+	// Digest is the image digest the notary server signature was verified for, Signer the notary role which signed it
+	Digest string `json:"digest,omitempty"`
+	Signer string `json:"signer,omitempty"`
+	// ConfidentialityVerified is set once the image was found encrypted with an allowed cipher and its key available
+	ConfidentialityRequired bool `json:"confidentiality_required"`
+	ConfidentialityVerified bool `json:"confidentiality_verified"`
+	// Enforcement is the enforcement mode applied, set by the policy rule Rule when not empty
+	Enforcement string `json:"enforcement,omitempty"`
+	Rule        string `json:"rule,omitempty"`
+	// Audited is set when the request was allowed only because of the audit mode
+	Audited bool `json:"audited,omitempty"`
+	// Passthrough is set for requests the image policy does not apply to
+	Passthrough bool `json:"passthrough,omitempty"`
+}
+
+func (decision Decision) allow(reason string) Decision {
+	decision.Allow = true
+	decision.Code = ""
+	decision.Reason = reason
+	return decision
+}
+
+func (decision Decision) deny(code DenialCode, reason string) Decision {
+	decision.Allow = false
+	decision.Code = code
+	decision.Reason = reason
+	return decision
+}
+
+// apply allows or denies according to a policy action
+func (decision Decision) apply(action string, code DenialCode, reason string) Decision {
+	if action == config.ActionAllow {
+		return decision.allow(reason + ", allowed by policy")
+	}
+	return decision.deny(code, reason+", denied by policy")
+}
+
+// policySource names what set the enforcement mode of the decision
+func (decision Decision) policySource() string {
+	if decision.Rule != "" {
+		return "policy rule " + decision.Rule
+	}
+	return "policy"
+}
+
+// enforce applies the enforcement mode configured for the image: in audit mode a denied request is let through
+func (decision Decision) enforce(policy *config.PolicyConfig) Decision {
+	decision.Enforcement, decision.Rule = policy.EnforcementFor(decision.ImageRef)
+	if !decision.Allow && decision.Enforcement == config.EnforcementAudit {
+		decision.Allow = true
+		decision.Audited = true
+	}
+	return decision
+}
+
+// Response converts the decision into the response returned to the docker daemon.
+// A denial carries the denial code and reason, the reason is replaced by a generic message when redact is set.
+func (decision Decision) Response(redact bool) authorization.Response {
+	if decision.Allow {
+		return authorization.Response{Allow: true}
+	}
+	return authorization.Response{Allow: false, Msg: decision.Message(redact)}
+}
+
+// Message returns the denial message with the denial code and reason, the reason is replaced by a generic message
+// when redact is set
+func (decision Decision) Message(redact bool) string {
+	return denialMessage(decision.Code, decision.Reason, redact)
+}
+
+// Detail returns the denial code and reason without the plugin name, for the messages reporting several decisions
+func (decision Decision) Detail(redact bool) string {
+	return denialDetail(decision.Code, decision.Reason, redact)
+}
+
+// Authorize evaluates a docker request, container create requests are checked against the image policy and
+// container start requests against the confidentiality requirements of the image.
+// The decision accounts for the enforcement mode, use VerifyImage for the plain policy evaluation.
+func (plugin *SecureDockerPlugin) Authorize(req authorization.Request) Decision {
+	return plugin.authorize(req, nil)
+}
+
+// authorize evaluates a request, recording the responses the decision depends on with rec when not nil
+func (plugin *SecureDockerPlugin) authorize(req authorization.Request, rec *recorder) Decision {
+	decision := plugin.evaluate(req, rec)
+	if decision.Passthrough {
+		return decision
+	}
+	return decision.enforce(&plugin.config().Policy)
+}
+
+func (plugin *SecureDockerPlugin) evaluate(req authorization.Request, rec *recorder) Decision {
+	//Parse request and the request body
+	reqURI, err := url.QueryUnescape(req.RequestURI)
+	if err != nil {
+		log.Println("Error retrieving the request URI", err)
+		return Decision{}.deny(CodeInvalidRequest, "invalid request URI: "+err.Error())
+	}
+	reqURL, err := url.ParseRequestURI(reqURI)
+	if err != nil {
+		log.Println("Error retrieving the request URL", err)
+		return Decision{}.deny(CodeInvalidRequest, "invalid request URL: "+err.Error())
+	}
+
+	// Containers created before their image required confidentiality are checked again when started
+	if match := containerActionURI.FindStringSubmatch(reqURL.Path); match != nil && match[3] == "start" &&
+		req.RequestMethod == http.MethodPost && containerRef.MatchString(match[2]) {
+		return plugin.verifyContainerStart(match[2], rec)
+	}
+
+	// Checking reqURL Path for the request type
+	// If request type is not /containers/create, then passthrough the request
+	if !strings.HasSuffix(reqURL.Path, containerCreateURI) {
+		// Passthrough request - not a run request
+		return Decision{Passthrough: true}.allow("not a container create request")
+	}
+
+	// Request path contains /containers/create request so request body will be parsed
+	// Extract image reference from request
+	return plugin.verifyImage(util.GetImageRef(req), plugin.config().Reverify.BlockRevoked, rec)
+}
+
+// VerifyImage resolves the image, fetches its flavor and verifies the image confidentiality and integrity when the
+// flavor requires them
+func (plugin *SecureDockerPlugin) VerifyImage(imageRef string) Decision {
+	return plugin.verifyImage(imageRef, plugin.config().Reverify.BlockRevoked, nil)
+}
+
+// verifyImage evaluates an image known to the docker daemon, denying the images with a revoked signature when
+// checkRevoked is set. The responses the decision depends on are recorded with rec when not nil.
+func (plugin *SecureDockerPlugin) verifyImage(imageRef string, checkRevoked bool, rec *recorder) Decision {
+	// Policy rules with an action decide without looking at the flavor
+	if decision, decided := plugin.ruleDecision(imageRef); decided {
+		return decision
+	}
+
+	dc, err := plugin.getDockerClient()
+	if err != nil {
+		log.Println("Error retrieving the image id.", err)
+		plugin.closeDockerClient()
+		return Decision{ImageRef: imageRef}.deny(CodeDockerUnavailable, "docker daemon unavailable: "+err.Error())
+	}
+	return plugin.verifyImageWith(rec.docker(dc), imageRef, checkRevoked, true, plugin.integrity, rec)
+}
+
+// verifyImageWith evaluates an image inspected with the images of the container runtime, denying the images with a
+// revoked signature when checkRevoked is set. The encryption of the image is only verified with verifyEncryption, it
+// needs the image on the node. The image signature is verified with verifier. The responses the decision depends on
+// are recorded with rec when not nil.
+func (engine *Engine) verifyImageWith(images util.ImageInspector, imageRef string, checkRevoked, verifyEncryption bool,
+	verifier IntegrityVerifier, rec *recorder) Decision {
+	decision := Decision{ImageRef: imageRef}
+	policy := engine.config().Policy
+
+	// Image ID is needed to fetch image flavor
+	imageID, digest, err := util.ResolveImage(images, rec.registry(engine.registry), imageRef)
+	if err != nil {
+		log.Println("Error retrieving the image id.", err)
+		return decision.deny(CodeImageUnresolved, "unable to resolve image "+imageRef+": "+err.Error())
+	}
+	decision.ImageID = imageID
+
+	decision.ImageUUID = util.GetUUIDFromImageID(imageID)
+
+	// The signature of the image was found revoked by the periodic verification
+	if checkRevoked {
+		if reason, revoked := engine.revocations.get(imageID); revoked {
+			rec.revocation(imageID, reason)
+			return decision.deny(CodeSignatureRevoked, "signature of image "+imageRef+" was revoked: "+reason)
+		}
+	}
+
+	wlac, err := engine.getWlaClient()
+	rec.wla(wlac, err)
+	if err != nil {
+		log.Println("Error retrieving the image id.", err)
+		return decision.deny(CodeWlaUnavailable, "workload agent unavailable: "+err.Error())
+	}
+
+	// Apply the policy configured for a missing wlagent when the wlagent client is nil
+	if wlac == nil {
+		log.Printf("WLA is not available, applying policy %s", policy.WlaUnavailable)
+		return decision.apply(policy.WlaUnavailable, CodeWlaUnavailable, "workload agent is not installed")
+	}
+	agent := rec.agent(wlac)
+	// Get Image flavor
+	keys := util.GetFlavorKeys(&engine.config().FlavorLookup, imageRef, imageID, digest)
+	flavor, key, err := engine.findImageFlavor(agent, keys, rec)
+	if wla.IsNotFound(err) {
+		log.Printf("Flavor does not exist for the image %s, applying policy %s", imageRef, policy.FlavorNotFound)
+		return decision.apply(policy.FlavorNotFound, CodeFlavorNotFound, "no flavor for image "+imageRef)
+	}
+	if err != nil {
+		log.Println("Error retrieving the image flavor.", err)
+		return decision.deny(CodeFlavorFetchFailed, "flavor fetch failed for image "+imageRef+": "+err.Error())
+	}
+	decision.FlavorID = flavor.Meta.ID
+	decision.FlavorKey = key.Kind
+	decision.FlavorKeyUUID = key.UUID
+	decision, ok := engine.verifyFlavorSignature(decision, flavor, rec)
+	if !ok {
+		return decision
+	}
+
+	decision.ConfidentialityRequired = flavor.EncryptionRequired
+	if decision.ConfidentialityRequired && !verifyEncryption {
+		log.Printf("Image %s requires confidentiality, its encryption is verified on the node", imageRef)
+	} else if decision.ConfidentialityRequired {
+		decision = engine.verifyConfidentiality(decision, images, agent, flavor)
+		if !decision.ConfidentialityVerified {
+			return decision
+		}
+	}
+
+	decision.IntegrityRequired = flavor.IntegrityEnforced
+	if !decision.IntegrityRequired {
+		return decision.allow("flavor " + flavor.Meta.ID + " does not enforce integrity")
+	}
+
+	decision.NotaryURL = strings.TrimSuffix(flavor.Integrity.NotaryURL, "/")
+	signature, err := rec.integrity(verifier).VerifyIntegrity(images, decision.NotaryURL, imageRef)
+	if err != nil {
+		code := CodeIntegrityFailed
+		if integrityErr, ok := err.(*integrity.Error); ok {
+			code = integrityCodes[integrityErr.Kind]
+		}
+		return decision.deny(code, err.Error())
+	}
+	decision.Digest, decision.Signer = signature.Digest, signature.Signer
+	decision.IntegrityVerified = true
+	return decision.allow("image signature verified with notary " + decision.NotaryURL)
+}
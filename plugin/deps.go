@@ -0,0 +1,201 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/integrity"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	dockerclient "github.com/docker/docker/client"
+	pinfo "intel/isecl/lib/platform-info/v3/platforminfo"
+	"intel/isecl/lib/vml/v3"
+)
+
+// DockerClient is the part of the docker API used by the plugin, it is implemented by the docker client
+type DockerClient interface {
+	util.ImageInspector
+	ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error)
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerStop(ctx context.Context, container string, timeout *time.Duration) error
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	Close() error
+}
+
+// DockerClientFactory creates the docker client of a docker host, it is called again after the client was
+// closed on an error or when the docker host changed
+type DockerClientFactory func(host string) (DockerClient, error)
+
+// WlaClient is the connection to the workload agent, it is implemented by the wla package client
+type WlaClient interface {
+	wla.Agent
+	// Connect waits up to timeout for the connection, it returns wla.ErrNotInstalled when the agent is not installed
+	Connect(timeout time.Duration) error
+	Installed() bool
+	Status() wla.Status
+	OnConnect(onConnect func())
+	Reconfigure(socket string, dialTimeout, callTimeout time.Duration)
+	// Run re-establishes the broken connections until stop is closed
+	Run(stop <-chan struct{})
+	Close()
+}
+
+// IntegrityVerifier verifies the signature of an image with a notary server, returning the verified digest
+type IntegrityVerifier interface {
+	VerifyIntegrity(dc util.ImageInspector, notaryURL, imageRef string) (integrity.Signature, error)
+}
+
+// FlavorVerifier verifies the flavor signatures
+type FlavorVerifier interface {
+	// VerifyFlavor returns flavorsig.ErrUnsigned for an unsigned flavor and flavorsig.ErrNoCertificate when a
+	// signed flavor cannot be verified for lack of certificate
+	VerifyFlavor(flvr wla.Flavor) error
+}
+
+// HardwareInfo identifies the host in the trust reports
+type HardwareInfo interface {
+	HardwareUUID() (string, error)
+}
+
+// ManifestBuilder creates the container manifests sent to the workload agent in the trust reports
+type ManifestBuilder interface {
+	CreateContainerManifest(containerUUID, hardwareUUID, imageUUID string, encrypted, integrityEnforced bool) (
+		vml.Manifest, error)
+}
+
+// Option substitutes a dependency of the plugin, every EngineOption is an Option as well
+type Option interface {
+	apply(plugin *SecureDockerPlugin)
+}
+
+// EngineOption substitutes a dependency of the decision engine
+type EngineOption func(*Engine)
+
+func (option EngineOption) apply(plugin *SecureDockerPlugin) {
+	option(&plugin.Engine)
+}
+
+// pluginOption substitutes a dependency of the docker plugin which the engine does not have
+type pluginOption func(*SecureDockerPlugin)
+
+func (option pluginOption) apply(plugin *SecureDockerPlugin) {
+	option(plugin)
+}
+
+// WithDockerClient creates the docker clients with newClient
+func WithDockerClient(newClient DockerClientFactory) Option {
+	return pluginOption(func(plugin *SecureDockerPlugin) {
+		plugin.newDockerClient = newClient
+	})
+}
+
+// WithConfig makes the engine decide with the configuration returned by get, config.Get by default. The
+// configuration is read on every decision, like the reloaded one.
+func WithConfig(get func() *config.Configuration) EngineOption {
+	return func(engine *Engine) {
+		engine.config = get
+	}
+}
+
+// WithTransport reaches the registries and the notary servers with transport instead of the transport built from the
+// registry and notary configuration
+func WithTransport(transport http.RoundTripper) EngineOption {
+	return func(engine *Engine) {
+		engine.transport = transport
+	}
+}
+
+// WithWlaClient replaces the workload agent client, created from the wla configuration by default
+func WithWlaClient(wlac WlaClient) EngineOption {
+	return func(engine *Engine) {
+		engine.wla = wlac
+	}
+}
+
+// WithRegistry replaces the registry client resolving the images not available locally
+func WithRegistry(registry util.Registry) EngineOption {
+	return func(engine *Engine) {
+		engine.registry = registry
+	}
+}
+
+// WithIntegrityVerifier replaces the signature verification, done with the notary servers by default
+func WithIntegrityVerifier(verifier IntegrityVerifier) EngineOption {
+	return func(engine *Engine) {
+		engine.integrity = verifier
+	}
+}
+
+// WithFlavorVerifier replaces the flavor signature verification, done with the flavor-signature certificates by
+// default
+func WithFlavorVerifier(verifier FlavorVerifier) EngineOption {
+	return func(engine *Engine) {
+		engine.flavorVerifier = verifier
+	}
+}
+
+// WithHardwareInfo replaces the source of the host hardware UUID
+func WithHardwareInfo(hardwareInfo HardwareInfo) EngineOption {
+	return func(engine *Engine) {
+		engine.hardwareInfo = hardwareInfo
+	}
+}
+
+// WithManifestBuilder replaces the container manifest builder
+func WithManifestBuilder(manifests ManifestBuilder) EngineOption {
+	return func(engine *Engine) {
+		engine.manifests = manifests
+	}
+}
+
+// newDockerClient connects to the docker daemon with the docker client
+func newDockerClient(host string) (DockerClient, error) {
+	dc, err := dockerclient.NewClientWithOpts(dockerclient.WithHost(host), dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// notaryTrust verifies the signatures with the notary servers and the registries without pulling the images, the
+// notary settings are read on every verification
+type notaryTrust struct {
+	registry  integrity.ManifestResolver
+	config    func() *config.Configuration
+	transport http.RoundTripper
+	// dryRun leaves the cached trust data unchanged
+	dryRun bool
+}
+
+func (trust notaryTrust) VerifyIntegrity(dc util.ImageInspector, notaryURL, imageRef string) (integrity.Signature,
+	error) {
+	cfg := trust.config().Notary
+	notary := integrity.NewNotary(cfg.TrustDir, cfg.Timeout.Duration, trust.transport)
+	notary.ReadOnly = trust.dryRun
+	verifier := integrity.Verifier{Notary: notary, Registry: trust.registry}
+	return verifier.VerifyIntegrity(dc, notaryURL, imageRef)
+}
+
+// platformInfo reads the hardware UUID with the platform info library
+type platformInfo struct{}
+
+func (platformInfo) HardwareUUID() (string, error) {
+	return pinfo.HardwareUUID()
+}
+
+// vmlManifests creates the container manifests with the vml library
+type vmlManifests struct{}
+
+func (vmlManifests) CreateContainerManifest(containerUUID, hardwareUUID, imageUUID string, encrypted,
+	integrityEnforced bool) (vml.Manifest, error) {
+	return vml.CreateContainerManifest(containerUUID, hardwareUUID, imageUUID, encrypted, integrityEnforced)
+}
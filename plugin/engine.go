@@ -0,0 +1,269 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/trustreport"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Engine takes the decisions independently of the container runtime: it fetches the image flavors from the
+// workload agent, verifies the flavor signatures and the image confidentiality and integrity, and creates the
+// trust reports. The images are inspected with the util.ImageInspector of the container runtime.
+// SecureDockerPlugin drives it from the docker authorization requests, the ocihook package from the OCI runtime hooks.
+type Engine struct {
+	// Configuration in use, read on every decision
+	config func() *config.Configuration
+	// Transport to the registries and the notary servers, built from their configuration when nil
+	transport http.RoundTripper
+	// Wlagent client
+	wla WlaClient
+	// Registry resolving the images not available locally
+	registry util.Registry
+	// Signature verification of the images whose flavor enforces integrity
+	integrity IntegrityVerifier
+	// Signature verification of the flavors
+	flavorVerifier FlavorVerifier
+	// Trust report sources
+	hardwareInfo HardwareInfo
+	manifests    ManifestBuilder
+	// Flavors fetched from the workload agent
+	flavors flavorCache
+	// Images whose signature was found revoked by the periodic verification
+	revocations revocationList
+}
+
+// NewEngine creates a decision engine for the container runtimes other than docker, the workload agent, registry and
+// hardware info clients are created from the configuration unless substituted by options. The workload agent is
+// connected on first use.
+func NewEngine(wlagentSocketFile string, options ...EngineOption) *Engine {
+	engine := &Engine{}
+	engine.init(wlagentSocketFile, func() {
+		for _, option := range options {
+			option(engine)
+		}
+	})
+	return engine
+}
+
+// init sets the default dependencies of the engine, lets applyOptions substitute them and creates the clients
+// depending on the configuration in use when not substituted
+func (engine *Engine) init(wlagentSocketFile string, applyOptions func()) {
+	engine.config = config.Get
+	engine.hardwareInfo = platformInfo{}
+	engine.manifests = vmlManifests{}
+	applyOptions()
+	cfg := engine.config()
+	engine.revocations.open(cfg.Reverify.RevocationFile)
+	if engine.registry == nil {
+		engine.registry = engine.newRegistryClient()
+	}
+	if engine.integrity == nil {
+		engine.integrity = notaryTrust{registry: engine.newRegistryClient(), config: engine.config,
+			transport: engine.transport}
+	}
+	if engine.flavorVerifier == nil {
+		engine.flavorVerifier = &configuredFlavorVerifier{config: engine.config}
+	}
+	if engine.wla == nil {
+		engine.wla = wla.NewClient(wlagentSocketFile, cfg.Wla.DialTimeout.Duration, cfg.Wla.CallTimeout.Duration,
+			cfg.Wla.ReconnectMin.Duration, cfg.Wla.ReconnectMax.Duration)
+	}
+}
+
+// newRegistryClient returns a registry client with the configuration and the transport of the engine
+func (engine *Engine) newRegistryClient() *util.RegistryClient {
+	return &util.RegistryClient{Config: engine.config, Transport: engine.transport}
+}
+
+// Config returns the configuration the engine decides with
+func (engine *Engine) Config() *config.Configuration {
+	return engine.config()
+}
+
+// getWlaClient returns the workload agent client once connected, nil when the workload agent is not installed
+func (engine *Engine) getWlaClient() (WlaClient, error) {
+	err := engine.wla.Connect(0)
+	if err == wla.ErrNotInstalled {
+		log.Printf("%s file does not exist", engine.wla.Status().Socket)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "SDP: Failed to initialize WLA client")
+	}
+	return engine.wla, nil
+}
+
+// ruleDecision applies the policy rule matching an image, it returns false when no rule with an action matched and
+// the flavor decides
+func (engine *Engine) ruleDecision(imageRef string) (Decision, bool) {
+	decision := Decision{ImageRef: imageRef}
+	if rule := engine.config().Policy.MatchRule(imageRef); rule != nil && rule.Action != "" {
+		decision.Rule = rule.Name
+		return decision.apply(rule.Action, CodePolicyRule, "policy rule "+rule.Name+" matched"), true
+	}
+	return decision, false
+}
+
+// EvaluateImage resolves an image with the images of the container runtime, fetches its flavor and verifies the
+// image confidentiality and integrity when the flavor requires them. The enforcement mode is not applied.
+func (engine *Engine) EvaluateImage(images util.ImageInspector, imageRef string) Decision {
+	if decision, decided := engine.ruleDecision(imageRef); decided {
+		return decision
+	}
+	return engine.verifyImageWith(images, imageRef, engine.config().Reverify.BlockRevoked, true, engine.integrity, nil)
+}
+
+// Admit decides whether a container of an image may run, the decision accounts for the enforcement mode and is
+// logged and counted like the decisions on the docker requests
+func (engine *Engine) Admit(images util.ImageInspector, imageRef string) Decision {
+	return engine.admit(images, imageRef, true, false)
+}
+
+// AdmitRemote decides like Admit before the image is pulled, on an admission request for instance. The image is
+// resolved with the registry and its encryption, which can only be verified on the node, is not verified.
+// A dry run decides without side effects: the decision is neither counted nor written to the audit file, and the
+// trust data of the notary servers is not cached.
+func (engine *Engine) AdmitRemote(imageRef string, dryRun bool) Decision {
+	return engine.admit(remoteImages{}, imageRef, false, dryRun)
+}
+
+func (engine *Engine) admit(images util.ImageInspector, imageRef string, verifyEncryption, dryRun bool) Decision {
+	verifier := engine.integrity
+	if trust, ok := verifier.(notaryTrust); ok && dryRun {
+		trust.dryRun = true
+		verifier = trust
+	}
+	cfg := engine.config()
+	decision, decided := engine.ruleDecision(imageRef)
+	if !decided {
+		decision = engine.verifyImageWith(images, imageRef, cfg.Reverify.BlockRevoked, verifyEncryption, verifier, nil)
+	}
+	decision = decision.enforce(&cfg.Policy)
+	if dryRun {
+		log.Printf("[DRY RUN] %s allowed: %v, %s", decision.ImageRef, decision.Allow, decision.Reason)
+		return decision
+	}
+	recordDecision(decision, cfg.Logging.AuditFile)
+	return decision
+}
+
+// remoteImages inspects the images of the decisions taken before the images are pulled: none is available, so the
+// images are resolved with the registry
+type remoteImages struct{}
+
+func (remoteImages) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	return types.ImageInspect{}, nil, notFoundError("image " + imageID + " is not pulled yet")
+}
+
+// imageFlavorUUID returns the image UUID the flavor of an image is found with, the UUID of the image ID when it has
+// no flavor or the workload agent is unavailable
+func (engine *Engine) imageFlavorUUID(images util.ImageInspector, imageRef, imageID string) string {
+	wlac, err := engine.getWlaClient()
+	if err != nil || wlac == nil {
+		return util.GetUUIDFromImageID(imageID)
+	}
+	imageInfo, _ := util.GetImageMetadata(images, imageID)
+	keys := util.GetFlavorKeys(&engine.config().FlavorLookup, imageRef, imageID,
+		util.GetImageDigest(imageInfo, imageRef))
+	_, key, err := engine.findImageFlavor(wlac, keys, nil)
+	if err != nil {
+		return util.GetUUIDFromImageID(imageID)
+	}
+	return key.UUID
+}
+
+// containerManifest returns the manifest of the trust report of a container, empty when its image has no security
+// metadata. imageUUID is the image UUID the flavor of the image was found with.
+func (engine *Engine) containerManifest(images util.ImageInspector, containerUUID, imageID, imageUUID string) (string,
+	error) {
+	securityMetaData, err := util.GetSecurityMetaData(images, imageID)
+	if err != nil {
+		log.Println("Error getting security meta data: ", err)
+		return "", nil
+	}
+	if securityMetaData == nil {
+		return "", nil
+	}
+	// get host hardware UUID
+	log.Println("Retrieving host hardware UUID...")
+	hardwareUUID, err := engine.hardwareInfo.HardwareUUID()
+	if err != nil {
+		log.Println("Unable to get the host hardware UUID")
+		return "", err
+	}
+	log.Println("The host hardware UUID is :", hardwareUUID)
+	manifest, err := engine.manifests.CreateContainerManifest(containerUUID, hardwareUUID, imageUUID,
+		securityMetaData.RequiresConfidentiality, securityMetaData.RequiresIntegrity)
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to create manifest for container %s", containerUUID)
+	}
+	manifestByte, err := json.Marshal(manifest)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error marshalling manifest for container %s", containerUUID)
+	}
+	log.Println("Manifest: ", string(manifestByte))
+	return string(manifestByte), nil
+}
+
+// sendReport delivers a trust report to the workload agent. The workload agent has no method for the terminations
+// of the containers, they are recorded locally and sendReport returns false for them.
+func (engine *Engine) sendReport(report trustreport.Report) (bool, error) {
+	if trustreport.IsTermination(report.Event) {
+		recordTermination(report.ContainerID, report.Event)
+		return false, nil
+	}
+
+	wlac, err := engine.getWlaClient()
+	if err != nil {
+		return false, err
+	}
+	if wlac == nil {
+		return false, errors.New("WLA is not available")
+	}
+	if err = wlac.CreateInstanceTrustReport(report.Manifest); err != nil {
+		log.Printf("Failed to deliver %s report: %v", report.Event, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// ContainerReport creates the report of a lifecycle event of a container: the trust report of a container started
+// from the image imageRef of ID imageID, or the termination of a container. It returns nil when the image of a
+// started container has no security metadata, as there is nothing to report.
+func (engine *Engine) ContainerReport(images util.ImageInspector, containerID, imageRef, imageID, event string) (
+	*trustreport.Report, error) {
+	report := &trustreport.Report{
+		ContainerID:   containerID,
+		ContainerUUID: util.GetUUIDFromImageID(containerID),
+		Event:         event,
+	}
+	if !trustreport.IsTermination(event) {
+		imageUUID := engine.imageFlavorUUID(images, imageRef, imageID)
+		manifest, err := engine.containerManifest(images, report.ContainerUUID, imageID, imageUUID)
+		if err != nil || manifest == "" {
+			return nil, err
+		}
+		report.Manifest = manifest
+	}
+	return report, nil
+}
+
+// SendReport delivers a report created by ContainerReport to the workload agent, it is the trustreport.Sender of the
+// report spools of the runtimes other than docker
+func (engine *Engine) SendReport(report trustreport.Report) error {
+	_, err := engine.sendReport(report)
+	return err
+}
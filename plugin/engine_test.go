@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"net/http"
+	"path/filepath"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/trustreport"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"intel/isecl/lib/vml/v3"
+)
+
+// fixedHost is a host of a fixed hardware UUID
+type fixedHost string
+
+func (host fixedHost) HardwareUUID() (string, error) {
+	return string(host), nil
+}
+
+// testConfig returns the default configuration with the files the plugin writes kept in dir
+func testConfig(t *testing.T, dir string) *config.Configuration {
+	cfg, err := config.ParseConfiguration(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.State.Dir = filepath.Join(dir, "state")
+	cfg.TrustReport.SpoolDir = filepath.Join(dir, "spool")
+	cfg.Reverify.RevocationFile = filepath.Join(dir, "revoked.json")
+	cfg.Logging.AuditFile = ""
+	return cfg
+}
+
+// withConfig makes an engine decide with cfg
+func withConfig(cfg *config.Configuration) EngineOption {
+	return WithConfig(func() *config.Configuration {
+		return cfg
+	})
+}
+
+func TestNewEngineAppliesOptions(t *testing.T) {
+	agent := &connectedAgent{}
+	cfg := testConfig(t, "/nonexistent")
+	transport := &http.Transport{}
+	engine := NewEngine("/nonexistent/wlagent.sock", WithWlaClient(agent), WithHardwareInfo(fixedHost("host")),
+		withConfig(cfg), WithTransport(transport))
+	if engine.Config() != cfg {
+		t.Errorf("The configuration was not substituted")
+	}
+	if registry, ok := engine.registry.(*util.RegistryClient); !ok || registry.Transport != transport ||
+		registry.Config() != cfg {
+		t.Errorf("Registry = %+v, want a registry client with the configuration and the transport", engine.registry)
+	}
+	if engine.wla != agent {
+		t.Errorf("The workload agent client was not substituted")
+	}
+	if engine.hardwareInfo != fixedHost("host") {
+		t.Errorf("The hardware info was not substituted")
+	}
+	if trust, ok := engine.integrity.(notaryTrust); !ok || trust.transport != transport {
+		t.Errorf("Integrity verifier = %T, want the notary verification with the transport by default",
+			engine.integrity)
+	}
+}
+
+// flavorAgent is a workload agent client serving the flavors of a fixed list, by image UUID
+type flavorAgent struct {
+	connectedAgent
+	flavors map[string]wla.Flavor
+}
+
+func (agent *flavorAgent) FetchFlavor(imageUUID string) (wla.Flavor, error) {
+	if flavor, ok := agent.flavors[imageUUID]; ok {
+		return flavor, nil
+	}
+	return wla.Flavor{}, &wla.Error{Kind: wla.NotFound, Method: wla.MethodFetchFlavor}
+}
+
+// imageUUIDs records the image UUIDs of the manifests created
+type imageUUIDs []string
+
+func (uuids *imageUUIDs) CreateContainerManifest(containerUUID, hardwareUUID, imageUUID string, encrypted,
+	integrityEnforced bool) (vml.Manifest, error) {
+	*uuids = append(*uuids, imageUUID)
+	return vml.Manifest{}, nil
+}
+
+func TestContainerReportNamesTheFlavorKey(t *testing.T) {
+	const imageRef, imageID = "registry.example.com/app:1.0", "c0ffee"
+	image := types.ImageInspect{ID: "sha256:" + imageID, RepoTags: []string{imageRef}}
+	image.GraphDriver.Data = map[string]string{"security-meta-data": `{"RequiresIntegrity": true}`}
+	images := imagesByRef{imageID: image, imageRef: image}
+	tagUUID := util.GetUUIDFromImageID(imageRef)
+
+	tests := []struct {
+		name    string
+		flavors map[string]wla.Flavor
+		want    string
+	}{
+		{name: "flavor of the tag", flavors: map[string]wla.Flavor{tagUUID: {}}, want: tagUUID},
+		{name: "no flavor", want: util.GetUUIDFromImageID(imageID)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var manifests imageUUIDs
+			engine := NewEngine("/nonexistent/wlagent.sock", WithWlaClient(&flavorAgent{flavors: test.flavors}),
+				WithHardwareInfo(fixedHost("host")), WithManifestBuilder(&manifests),
+				withConfig(testConfig(t, "/nonexistent")))
+			report, err := engine.ContainerReport(images, "c0ffee01", imageRef, imageID, trustreport.EventStart)
+			if err != nil || report == nil {
+				t.Fatalf("ContainerReport returned %v, %v", report, err)
+			}
+			if len(manifests) != 1 || manifests[0] != test.want {
+				t.Errorf("Manifest image UUIDs = %v, want %s", manifests, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/pkg/errors"
+	"log"
+	"secure-docker-plugin/v3/trustreport"
+	"time"
+)
+
+// watchEvents makes sure every running container gets a trust report, including the containers
+// started while the plugin was down or started by the docker daemon itself through restart policies
+func (plugin *SecureDockerPlugin) watchEvents(stop <-chan struct{}) {
+	for {
+		err := plugin.reconcileAndWatch(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		delay := plugin.config().TrustReport.RetryMin.Duration
+		log.Printf("Docker events watcher stopped, restarting in %v: %v", delay, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// reconcileAndWatch subscribes to the container start events, queues a report for the running containers
+// and then for every started container. The worker skips the containers already reported for their current run.
+func (plugin *SecureDockerPlugin) reconcileAndWatch(stop <-chan struct{}) error {
+	dc, err := plugin.getDockerClient()
+	if err != nil {
+		plugin.closeDockerClient()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Subscribe before listing the containers, so no start is missed in between
+	messages, errs := dc.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(filters.Arg("type", "container"), filters.Arg("event", "start")),
+	})
+
+	if err = plugin.reconcileTrustReports(ctx, dc); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case message := <-messages:
+			plugin.reportQueue.Enqueue(message.Actor.ID, trustreport.EventStart)
+		case err = <-errs:
+			return errors.Wrap(err, "Error reading docker events")
+		}
+	}
+}
+
+// reconcileTrustReports queues a report for every running container
+func (plugin *SecureDockerPlugin) reconcileTrustReports(ctx context.Context, dc DockerClient) error {
+	containers, err := dc.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "Failed to list running containers")
+	}
+
+	log.Printf("Reconciling the trust reports of %d running container(s)", len(containers))
+	for _, container := range containers {
+		plugin.reportQueue.Enqueue(container.ID, trustreport.EventStart)
+	}
+	return nil
+}
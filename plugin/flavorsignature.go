@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"log"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/flavorsig"
+	"secure-docker-plugin/v3/wla"
+	"sync"
+)
+
+// configuredFlavorVerifier verifies the flavor signatures with the certificates of the configuration in use,
+// they are loaded again when the configuration is reloaded
+type configuredFlavorVerifier struct {
+	config   func() *config.Configuration
+	mtx      sync.Mutex
+	cfg      *config.Configuration
+	verifier *flavorsig.Verifier
+	err      error
+}
+
+func (verifier *configuredFlavorVerifier) load() (*flavorsig.Verifier, error) {
+	cfg := verifier.config()
+	verifier.mtx.Lock()
+	defer verifier.mtx.Unlock()
+	if verifier.cfg != cfg {
+		verifier.cfg = cfg
+		verifier.verifier, verifier.err = nil, nil
+		if cfg.FlavorSignature.Certificate != "" {
+			verifier.verifier, verifier.err = flavorsig.NewVerifier(cfg.FlavorSignature.Certificate,
+				cfg.FlavorSignature.TrustedCA)
+			if verifier.err != nil {
+				log.Println("Unable to load the flavor signing certificate: ", verifier.err)
+			}
+		}
+	}
+	return verifier.verifier, verifier.err
+}
+
+// VerifyFlavor returns flavorsig.ErrUnsigned for an unsigned flavor and flavorsig.ErrNoCertificate when
+// flavor-signature is not configured
+func (verifier *configuredFlavorVerifier) VerifyFlavor(flvr wla.Flavor) error {
+	if flvr.Signature == "" {
+		return flavorsig.ErrUnsigned
+	}
+	signatureVerifier, err := verifier.load()
+	if err != nil {
+		return err
+	}
+	if signatureVerifier == nil {
+		return flavorsig.ErrNoCertificate
+	}
+	return signatureVerifier.Verify(flvr.Raw, flvr.Signature)
+}
+
+// verifyFlavorSignature checks the flavor signature before the flavor is enforced. An unsigned flavor, or one which
+// cannot be verified for lack of certificate, is subject to policy.unsigned-flavor, a bad signature is always denied.
+// A certificate which cannot be loaded or is no longer trusted denies the flavor as a configuration error.
+// It returns false when the decision is final.
+func (engine *Engine) verifyFlavorSignature(decision Decision, flvr wla.Flavor, rec *recorder) (Decision, bool) {
+	err := rec.flavorVerifier(engine.flavorVerifier).VerifyFlavor(flvr)
+	if err == nil {
+		decision.FlavorSignatureVerified = true
+		return decision, true
+	}
+	if err == flavorsig.ErrUnsigned || err == flavorsig.ErrNoCertificate {
+		action := engine.config().UnsignedFlavorAction()
+		if action == config.ActionAllow {
+			log.Printf("Flavor %s is not verified, allowed by policy: %v", flvr.Meta.ID, err)
+			return decision, true
+		}
+		return decision.deny(CodeFlavorUnsigned, "flavor "+flvr.Meta.ID+" cannot be trusted: "+err.Error()+
+			", denied by policy"), false
+	}
+	if _, ok := err.(*flavorsig.CertificateError); ok {
+		log.Printf("Flavor %s cannot be verified, the flavor signing certificate is unusable: %v", flvr.Meta.ID, err)
+		return decision.deny(CodeConfigInvalid, "flavor-signature certificate cannot be used: "+err.Error()), false
+	}
+	log.Printf("Signature of flavor %s is invalid: %v", flvr.Meta.ID, err)
+	return decision.deny(CodeFlavorSigInvalid, "signature of flavor "+flvr.Meta.ID+" is invalid: "+err.Error()), false
+}
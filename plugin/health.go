@@ -0,0 +1,36 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"secure-docker-plugin/v3/wla"
+)
+
+// HealthURI is the plugin HTTP endpoint reporting the state of the connections of the plugin
+const HealthURI = "/health"
+
+// Health is the state of the connections of the plugin
+type Health struct {
+	Wla wla.Status `json:"wla"`
+}
+
+// Health returns the state of the connections of the plugin
+func (plugin *SecureDockerPlugin) Health() Health {
+	return Health{Wla: plugin.wla.Status()}
+}
+
+// ServeHealth serves the state of the connections of the plugin, answering 503 while an installed workload agent
+// cannot be reached
+func (plugin *SecureDockerPlugin) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	health := plugin.Health()
+	w.Header().Set("Content-Type", "application/json")
+	if health.Wla.State == wla.StateDisconnected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"expvar"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"regexp"
+	"secure-docker-plugin/v3/state"
+	"secure-docker-plugin/v3/trustreport"
+	"secure-docker-plugin/v3/util"
+)
+
+const (
+	regexForContainerActionURI = `^(/v[0-9.]+)?/containers/([^/]+)/(start|restart|stop|kill|update)$`
+	regexForContainerURI       = `^(/v[0-9.]+)?/containers/([^/]+)$`
+	regexForContainerRef       = `^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`
+)
+
+var (
+	containerActionURI = regexp.MustCompile(regexForContainerActionURI)
+	containerURI       = regexp.MustCompile(regexForContainerURI)
+	containerRef       = regexp.MustCompile(regexForContainerRef)
+
+	// lifecycleEvents maps the container actions to the lifecycle events
+	lifecycleEvents = map[string]string{
+		"start":   trustreport.EventStart,
+		"restart": trustreport.EventRestart,
+		"update":  trustreport.EventUpdate,
+		"stop":    trustreport.EventStop,
+		"kill":    trustreport.EventKill,
+	}
+
+	// Container terminations, recorded locally as the workload agent has no method for them, exported on the
+	// plugin socket under /debug/vars
+	terminations = expvar.NewInt("sdp_container_terminations")
+)
+
+// parseLifecycleEvent returns the container reference and the lifecycle event of a successful docker request,
+// the event is empty when the request is not a container lifecycle request
+func parseLifecycleEvent(method, path string, statusCode int) (string, string) {
+	if method == http.MethodDelete {
+		match := containerURI.FindStringSubmatch(path)
+		if match == nil || statusCode != http.StatusNoContent || !containerRef.MatchString(match[2]) {
+			return "", ""
+		}
+		return match[2], trustreport.EventRemove
+	}
+
+	match := containerActionURI.FindStringSubmatch(path)
+	if match == nil || !containerRef.MatchString(match[2]) {
+		return "", ""
+	}
+	// update replies with 200, the other actions with 204
+	expectedStatus := http.StatusNoContent
+	if match[3] == "update" {
+		expectedStatus = http.StatusOK
+	}
+	if statusCode != expectedStatus {
+		return "", ""
+	}
+	return match[2], lifecycleEvents[match[3]]
+}
+
+// processTrustReport creates the report of a container lifecycle event queued by AuthZRes
+func (plugin *SecureDockerPlugin) processTrustReport(containerRef, event string) error {
+	// The reports are spooled even while the workload agent socket is missing, during an agent restart for
+	// instance, the spool delivers them once it is back
+	if event == trustreport.EventRemove {
+		// The container is gone, a name or an ID prefix is resolved with the recorded container states
+		containerID, err := plugin.states.Resolve(containerRef)
+		if err != nil {
+			if !isValidContainerID(containerRef) {
+				log.Printf("Container %s removed, its removal cannot be reported without a recorded state: %v",
+					containerRef, err)
+				return nil
+			}
+			containerID = containerRef
+		}
+		if err = plugin.states.Remove(containerID); err != nil {
+			log.Println(err)
+		}
+		return plugin.reportTermination(containerID, event)
+	}
+
+	dc, err := plugin.getDockerClient()
+	if err != nil {
+		plugin.closeDockerClient()
+		return err
+	}
+
+	if trustreport.IsTermination(event) {
+		containerID := containerRef
+		if !isValidContainerID(containerID) {
+			instanceInfo, err := dc.ContainerInspect(context.Background(), containerRef)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to get the ID of container %s", containerRef)
+			}
+			containerID = instanceInfo.ID
+		}
+		return plugin.reportTermination(containerID, event)
+	}
+	return plugin.createTrustReport(dc, containerRef, event)
+}
+
+// reportTermination hands the termination of a container to the trust report spool, which records it once the
+// pending trust report of the container was delivered
+func (plugin *SecureDockerPlugin) reportTermination(containerID, event string) error {
+	return plugin.deliverTrustReport(trustreport.Report{
+		ContainerID:   containerID,
+		ContainerUUID: util.GetUUIDFromImageID(containerID),
+		Event:         event,
+	})
+}
+
+// deliverTrustReport hands a report to the trust report spool and records it in the container state
+// when it is left pending, the delivery itself is recorded by sendTrustReport
+func (plugin *SecureDockerPlugin) deliverTrustReport(report trustreport.Report) error {
+	err := plugin.reports.Deliver(report)
+	if report.Event != trustreport.EventRemove && plugin.reports.IsPending(report.ContainerUUID) {
+		plugin.recordTrustReportState(report, state.TrustReportPending)
+	}
+	return err
+}
+
+// sendTrustReport delivers a report to the workload agent and records its delivery in the container state
+func (plugin *SecureDockerPlugin) sendTrustReport(report trustreport.Report) error {
+	delivered, err := plugin.sendReport(report)
+	if err != nil || !delivered {
+		return err
+	}
+	if report.Event != trustreport.EventRemove {
+		plugin.recordTrustReportState(report, state.TrustReportDelivered)
+	}
+	return nil
+}
+
+// recordTermination logs and counts the termination of a container
+func recordTermination(containerID, event string) {
+	terminations.Add(1)
+	log.Printf("Container %s %s", containerID, event)
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"net/http"
+	"secure-docker-plugin/v3/trustreport"
+	"secure-docker-plugin/v3/wla"
+	"testing"
+	"time"
+)
+
+func TestParseLifecycleEvent(t *testing.T) {
+	tests := []struct {
+		method     string
+		path       string
+		statusCode int
+		ref        string
+		event      string
+	}{
+		{method: http.MethodPost, path: "/v1.40/containers/web/start", statusCode: http.StatusNoContent,
+			ref: "web", event: trustreport.EventStart},
+		{method: http.MethodPost, path: "/containers/web/restart", statusCode: http.StatusNoContent,
+			ref: "web", event: trustreport.EventRestart},
+		{method: http.MethodPost, path: "/v1.40/containers/c0ffee/update", statusCode: http.StatusOK,
+			ref: "c0ffee", event: trustreport.EventUpdate},
+		{method: http.MethodPost, path: "/v1.40/containers/web/stop", statusCode: http.StatusNoContent,
+			ref: "web", event: trustreport.EventStop},
+		{method: http.MethodPost, path: "/v1.40/containers/web/kill", statusCode: http.StatusNoContent,
+			ref: "web", event: trustreport.EventKill},
+		{method: http.MethodDelete, path: "/v1.40/containers/web", statusCode: http.StatusNoContent,
+			ref: "web", event: trustreport.EventRemove},
+		// Failed or unrelated requests are not reported
+		{method: http.MethodPost, path: "/v1.40/containers/web/start", statusCode: http.StatusNotModified},
+		{method: http.MethodPost, path: "/v1.40/containers/web/update", statusCode: http.StatusNoContent},
+		{method: http.MethodDelete, path: "/v1.40/containers/web", statusCode: http.StatusConflict},
+		{method: http.MethodPost, path: "/v1.40/containers/web/pause", statusCode: http.StatusNoContent},
+		{method: http.MethodDelete, path: "/v1.40/images/web", statusCode: http.StatusNoContent},
+		{method: http.MethodPost, path: "/v1.40/containers/-web/stop", statusCode: http.StatusNoContent},
+	}
+	for _, test := range tests {
+		ref, event := parseLifecycleEvent(test.method, test.path, test.statusCode)
+		if ref != test.ref || event != test.event {
+			t.Errorf("parseLifecycleEvent(%s %s %d) = %q, %q, want %q, %q", test.method, test.path,
+				test.statusCode, ref, event, test.ref, test.event)
+		}
+	}
+}
+
+// connectedAgent is a connected workload agent client, recording the manifests of the trust reports sent
+type connectedAgent struct {
+	WlaClient
+	manifests []string
+}
+
+func (agent *connectedAgent) Connect(timeout time.Duration) error {
+	return nil
+}
+
+func (agent *connectedAgent) Status() wla.Status {
+	return wla.Status{State: wla.StateConnected}
+}
+
+func (agent *connectedAgent) CreateInstanceTrustReport(manifest string) error {
+	agent.manifests = append(agent.manifests, manifest)
+	return nil
+}
+
+func TestTerminationsRecordedLocally(t *testing.T) {
+	agent := &connectedAgent{}
+	engine := &Engine{wla: agent}
+	recorded := terminations.Value()
+
+	start := trustreport.Report{ContainerID: "c0ffee", ContainerUUID: "uuid", Event: trustreport.EventStart,
+		Manifest: "{}"}
+	if delivered, err := engine.sendReport(start); err != nil || !delivered {
+		t.Fatalf("Start report delivered = %v, %v", delivered, err)
+	}
+	stop := trustreport.Report{ContainerID: "c0ffee", ContainerUUID: "uuid", Event: trustreport.EventStop}
+	if delivered, err := engine.sendReport(stop); err != nil || delivered {
+		t.Errorf("Termination delivered = %v, %v, want it recorded locally", delivered, err)
+	}
+	if len(agent.manifests) != 1 {
+		t.Errorf("Reports sent to the workload agent = %v, want the start report only", agent.manifests)
+	}
+	if counted := terminations.Value() - recorded; counted != 1 {
+		t.Errorf("%d termination(s) counted, want 1", counted)
+	}
+}
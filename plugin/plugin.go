@@ -6,49 +6,49 @@
 package plugin
 
 import (
-	"encoding/json"
 	"github.com/pkg/errors"
 	"gopkg.in/retry.v1"
 	"log"
-	"net"
-	"net/rpc"
 	"net/url"
-	"os"
 	"regexp"
-	"secure-docker-plugin/v3/integrity"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/state"
+	"secure-docker-plugin/v3/trustreport"
 	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
 	"strings"
 	"sync"
 	"time"
 
-	pinfo "intel/isecl/lib/platform-info/v3/platforminfo"
-	"intel/isecl/lib/vml/v3"
-
 	"context"
-	dockerclient "github.com/docker/docker/client"
 	"github.com/docker/go-plugins-helpers/authorization"
 )
 
 const (
-	containerCreateURI                  = `/containers/create`
-	regexForContainerIDValidation       = `^[a-fA-F0-9]{64}$`
-	regexForcontainerStartURIValidation = `(.*?\bcontainers\b)(.*?\bstart\b).*`
+	containerCreateURI            = `/containers/create`
+	regexForContainerIDValidation = `^[a-fA-F0-9]{64}$`
 )
 
-// SecureDockerPlugin struct definition
+// SecureDockerPlugin is the docker authorization adapter of the decision engine
 type SecureDockerPlugin struct {
+	Engine
 	// Docker client
-	dockerClient *dockerclient.Client
-	dockerHost   string
-	// Wlagent client
-	wlaClient         *rpc.Client
-	wlaSocketFilePath string
-	dcmtx             sync.Mutex
-	wlamtx            sync.Mutex
-}
-
-type ManifestString struct {
-	Manifest string
+	dockerClient    DockerClient
+	dockerHost      string
+	dcmtx           sync.Mutex
+	newDockerClient DockerClientFactory
+	// Trust reports waiting for the workload agent
+	reports *trustreport.Spool
+	// Started containers waiting for their trust report
+	reportQueue *trustreport.Queue
+	// Closed to stop the background tasks
+	stop chan struct{}
+	// Set while the running containers are reconciled
+	reconciling int32
+	// Decisions of the create requests waiting for the ID of the created container
+	decisions pendingDecisions
+	// Decision and trust report status of the containers
+	states *state.Store
 }
 
 func (plugin *SecureDockerPlugin) closeDockerClient() {
@@ -60,16 +60,7 @@ func (plugin *SecureDockerPlugin) closeDockerClient() {
 	plugin.dockerClient = nil
 }
 
-func (plugin *SecureDockerPlugin) closeWlaClient() {
-	plugin.wlamtx.Lock()
-	defer plugin.wlamtx.Unlock()
-	if plugin.wlaClient != nil {
-		plugin.wlaClient.Close()
-	}
-	plugin.wlaClient = nil
-}
-
-func (plugin *SecureDockerPlugin) getDockerClient() (*dockerclient.Client, error) {
+func (plugin *SecureDockerPlugin) getDockerClient() (DockerClient, error) {
 	var err error
 	plugin.dcmtx.Lock()
 	defer plugin.dcmtx.Unlock()
@@ -78,13 +69,12 @@ func (plugin *SecureDockerPlugin) getDockerClient() (*dockerclient.Client, error
 	}
 
 	attempts := retry.Regular{
-		Total: 30 * time.Second,
+		Total: plugin.config().Docker.ConnectTimeout.Duration,
 		Delay: 500 * time.Millisecond,
 	}
 	for attempt := attempts.Start(nil); attempt.Next(); {
 		log.Printf("Attempt %v to initialize docker client", attempt.Count())
-		plugin.dockerClient, err = dockerclient.NewClientWithOpts(dockerclient.WithHost(plugin.dockerHost),
-			dockerclient.WithAPIVersionNegotiation())
+		plugin.dockerClient, err = plugin.newDockerClient(plugin.dockerHost)
 		if err == nil {
 			break
 		}
@@ -96,209 +86,135 @@ func (plugin *SecureDockerPlugin) getDockerClient() (*dockerclient.Client, error
 	return plugin.dockerClient, nil
 }
 
-func (plugin *SecureDockerPlugin) getWlaClient() (*rpc.Client, error) {
-	var err error
-	plugin.wlamtx.Lock()
-	defer plugin.wlamtx.Unlock()
-
-	if plugin.wlaClient != nil {
-		return plugin.wlaClient, nil
-	}
-
-	_, err = os.Stat(plugin.wlaSocketFilePath)
-	if err != nil {
-		log.Printf("%s file does not exist", plugin.wlaSocketFilePath)
-		return nil, nil
-	}
-
-	timeOut, _ := time.ParseDuration(util.WlagentSocketDialTimeout)
-	attempts := retry.Regular{
-		Total: 30 * time.Second,
-		Delay: 500 * time.Millisecond,
-	}
-	var conn net.Conn
-	for attempt := attempts.Start(nil); attempt.Next(); {
-		log.Printf("Attempt %v to initialize WLA client", attempt.Count())
-		conn, err = net.DialTimeout("unix", plugin.wlaSocketFilePath, timeOut)
-		if err == nil {
-			break
+// Reconfigure applies a new configuration to the plugin. The docker client is re-created on the next
+// request and the WLA connection is re-established when their address changed.
+func (plugin *SecureDockerPlugin) Reconfigure(cfg *config.Configuration) {
+	plugin.dcmtx.Lock()
+	if plugin.dockerHost != cfg.Docker.Host {
+		log.Printf("Docker host changed from %s to %s", plugin.dockerHost, cfg.Docker.Host)
+		if plugin.dockerClient != nil {
+			plugin.dockerClient.Close()
 		}
+		plugin.dockerClient = nil
+		plugin.dockerHost = cfg.Docker.Host
 	}
-	if err != nil {
-		return nil, errors.Wrapf(err, "SDP: Failed to initialize WLA client")
-	}
+	plugin.dcmtx.Unlock()
 
-	plugin.wlaClient = rpc.NewClient(conn)
-	return plugin.wlaClient, nil
+	plugin.wla.Reconfigure(cfg.Wla.Socket, cfg.Wla.DialTimeout.Duration, cfg.Wla.CallTimeout.Duration)
+
+	plugin.flavors.clear()
 }
 
-// NewPlugin creates a new instance of the secure docker plugin
-func NewPlugin(dockerHost, wlagentSocketFile string) (*SecureDockerPlugin, error) {
-	sdp := &SecureDockerPlugin{
-		dockerHost:        dockerHost,
-		wlaSocketFilePath: wlagentSocketFile,
-	}
+// NewPlugin creates a new instance of the secure docker plugin. The docker, workload agent, registry and
+// hardware info clients are created from the configuration unless substituted by options.
+func NewPlugin(dockerHost, wlagentSocketFile string, options ...Option) (*SecureDockerPlugin, error) {
+	sdp := newPlugin(dockerHost, wlagentSocketFile, options...)
 	if _, err := sdp.getDockerClient(); err != nil {
 		return nil, err
 	}
-	if _, err := sdp.getWlaClient(); err != nil {
-		return nil, err
+	if err := sdp.wla.Connect(sdp.config().Wla.ConnectTimeout.Duration); err != nil && err != wla.ErrNotInstalled {
+		return nil, errors.Wrap(err, "SDP: Failed to initialize WLA client")
 	}
 	log.Println("SDP init OK")
 	return sdp, nil
 }
 
+// newPlugin creates a plugin instance without connecting to the docker daemon and the workload agent
+func newPlugin(dockerHost, wlagentSocketFile string, options ...Option) *SecureDockerPlugin {
+	sdp := &SecureDockerPlugin{
+		dockerHost:      dockerHost,
+		stop:            make(chan struct{}),
+		newDockerClient: newDockerClient,
+	}
+	sdp.Engine.init(wlagentSocketFile, func() {
+		for _, option := range options {
+			option.apply(sdp)
+		}
+	})
+	cfg := sdp.config()
+	sdp.states = state.NewStore(cfg.State.Dir)
+	trustReportConfig := cfg.TrustReport
+	sdp.reports = trustreport.NewSpool(trustReportConfig.SpoolDir, sdp.sendTrustReport,
+		trustReportConfig.RetryMin.Duration, trustReportConfig.RetryMax.Duration)
+	sdp.reportQueue = trustreport.NewQueue(trustReportConfig.QueueSize, trustReportConfig.Workers,
+		trustReportConfig.EnqueueTimeout.Duration, sdp.processTrustReport)
+	// Replay the trust reports which could not be delivered before
+	sdp.wla.OnConnect(sdp.reports.Wake)
+	return sdp
+}
+
+// Start runs the background tasks of the plugin: the WLA reconnection, the trust report workers, the delivery of the spooled reports,
+// the docker events watcher, the reconciliation of the running containers and the periodic verification of their
+// images
+func (plugin *SecureDockerPlugin) Start() {
+	go plugin.wla.Run(plugin.stop)
+	go plugin.reportQueue.Run(plugin.stop)
+	go plugin.reports.Run(plugin.stop)
+	cfg := plugin.config()
+	if cfg.TrustReport.WatchEvents {
+		go plugin.watchEvents(plugin.stop)
+	}
+	if cfg.Reconcile.Enabled {
+		plugin.Reconcile()
+	}
+	go plugin.reverifyImages(plugin.stop)
+}
+
+// Cleanup stops the background tasks and closes the docker and WLA clients
 func (plugin *SecureDockerPlugin) Cleanup() error {
-	dockerCleanupErr := plugin.dockerClient.Close()
-	wlaCleanupErr := plugin.wlaClient.Close()
-	return errors.Errorf("Plugin client cleanup err: Docker %v | WLA - %v",
-		dockerCleanupErr, wlaCleanupErr)
+	close(plugin.stop)
+	plugin.closeDockerClient()
+	plugin.wla.Close()
+	return nil
 }
 
 // AuthZReq acts only on image run (containers/create) requests.
 // Remaining requests are passed through by default.
+// With capture.enabled the request is recorded along with the responses its decision depended on.
 func (plugin *SecureDockerPlugin) AuthZReq(req authorization.Request) authorization.Response {
-	//Parse request and the request body
-	reqURI, err := url.QueryUnescape(req.RequestURI)
-	if err != nil {
-		log.Println("Error retrieving the request URI", err)
-		return authorization.Response{Allow: false}
-	}
-	reqURL, err := url.ParseRequestURI(reqURI)
-	if err != nil {
-		log.Println("Error retrieving the request URL", err)
-		return authorization.Response{Allow: false}
-	}
-
-	// Checking reqURL Path for the request type
-	// If request type is not /containers/create, then passthrough the request
-	if !strings.HasSuffix(reqURL.Path, containerCreateURI) {
-		// Passthrough request - not a run request
-		return authorization.Response{Allow: true}
-	}
-
-	// Request path contains /containers/create request so request body will be parsed
-	// Extract image reference from request
-	imageRef := util.GetImageRef(req)
-
-	dc, err := plugin.getDockerClient()
-	if err != nil {
-		log.Println("Error retrieving the image id.", err)
-		plugin.closeDockerClient()
-		return authorization.Response{Allow: false}
-	}
-
-	// Image ID is needed to fetch image flavor
-	imageID, err := util.GetImageID(dc, imageRef)
-	if err != nil {
-		log.Println("Error retrieving the image id.", err)
-		return authorization.Response{Allow: false}
-	}
-
-	// Convert image id into uuid format
-	imageUUID := util.GetUUIDFromImageID(imageID)
-
-	wlac, err := plugin.getWlaClient()
-	if err != nil {
-		if strings.Contains(err.Error(), "connection is shut down") {
-			plugin.closeWlaClient()
-		}
-		log.Println("Error retrieving the image id.", err)
-		return authorization.Response{Allow: false}
-	}
-
-	// ALlow docker to launch images when wlagent client is nil
-	if wlac == nil {
-		return authorization.Response{Allow: true}
-	}
-	// Get Image flavor
-	flavor, err := util.GetImageFlavor(wlac, imageUUID)
-	if err != nil {
-		if strings.Contains(err.Error(), "connection is shut down") {
-			plugin.closeWlaClient()
-		}
-		log.Println("Error retrieving the image flavor.", err)
-		return authorization.Response{Allow: false}
-	}
-
-	if flavor.Meta.ID == "" {
-		log.Println("Flavor does not exist for the image.", imageUUID)
-		return authorization.Response{Allow: true}
-	}
-
-	integrityVerified := true
-
-	integrityRequired := flavor.IntegrityEnforced
-
-	if integrityRequired {
-		notaryURL := flavor.Integrity.NotaryURL
-		if strings.HasSuffix(notaryURL, "/") {
-			notaryURL = notaryURL[:len(notaryURL)-1]
-		}
-
-		integrityVerified = integrity.VerifyIntegrity(dc, notaryURL, imageRef)
-	}
-
-	if integrityVerified {
-		log.Println("[ALLOWED]")
-		return authorization.Response{Allow: true}
-	}
-
-	log.Println("[DENIED]")
-	return authorization.Response{Allow: false}
+	cfg := plugin.config()
+	rec := newRecorder(req, cfg)
+	decision := plugin.authorize(req, rec)
+	resp := decision.Response(cfg.Policy.RedactDenialDetails)
+	if !decision.Passthrough {
+		recordDecision(decision, cfg.Logging.AuditFile)
+		rec.save(decision, resp, &cfg.Capture)
+	}
+	plugin.rememberDecision(req, decision)
+	return resp
 }
 
 // AuthZRes authorizes the docker client response.
-// All responses are allowed by default.
+// All responses are allowed by default, the state of created containers is recorded and
+// successful container lifecycle requests are queued for a trust report.
 func (plugin *SecureDockerPlugin) AuthZRes(req authorization.Request) authorization.Response {
+	redact := plugin.config().Policy.RedactDenialDetails
+
 	//Parse request and the request body
 	reqURI, err := url.QueryUnescape(req.RequestURI)
 	if err != nil {
 		log.Println("AuthZRes: Error parsing req")
-		return authorization.Response{Allow: false}
+		return Decision{}.deny(CodeInvalidRequest, "invalid request URI: "+err.Error()).Response(redact)
 	}
 	reqURL, err := url.ParseRequestURI(reqURI)
 	if err != nil {
 		log.Println("AuthZRes: Error parsing request URI")
-		return authorization.Response{Allow: false}
+		return Decision{}.deny(CodeInvalidRequest, "invalid request URL: "+err.Error()).Response(redact)
 	}
 
-	dc, err := plugin.getDockerClient()
-	if err != nil {
-		plugin.closeDockerClient()
-		log.Println("Error retrieving the image id.", err)
-		return authorization.Response{Allow: false}
-	}
-
-	wlac, err := plugin.getWlaClient()
-	if err != nil {
-		if strings.Contains(err.Error(), "connection is shut down") {
-			plugin.closeWlaClient()
-		}
-		log.Println("Error retrieving the image id.", err)
-		return authorization.Response{Allow: false}
-	}
-
-	// ALlow docker to launch images when wlagent client is nil
-	if wlac == nil {
-		return authorization.Response{Allow: true}
-	}
+	// Record the decision taken for a created container along with its ID
+	plugin.recordContainerState(req, reqURL.Path)
 
 	// Checking reqURL Path for the request type
-	// If request type is not /containers/(id or name)/start, then passthrough the request
-	r := regexp.MustCompile(regexForcontainerStartURIValidation)
-	if !r.MatchString(reqURL.Path) {
-		return authorization.Response{Allow: true}
-	}
-	if req.ResponseStatusCode == 204 {
-		reqURLSplit := strings.Split(reqURL.Path, "/")
-		containerID := reqURLSplit[len(reqURLSplit)-2]
-		if isValidContainerID(containerID) {
-			err = createTrustReport(dc, wlac, containerID)
-			if err != nil && strings.Contains(err.Error(), "connection is shut down") {
-				plugin.closeWlaClient()
-			}
+	// If the request is not a successful container lifecycle request, then passthrough the request
+	containerRef, event := parseLifecycleEvent(req.RequestMethod, reqURL.Path, req.ResponseStatusCode)
+	if event != "" {
+		// The report is created by the queue workers, so the response is not delayed. The container is queued under
+		// its recorded ID when known, so its events share a worker whether it is referenced by name or by ID.
+		if containerID, err := plugin.states.Resolve(containerRef); err == nil {
+			containerRef = containerID
 		}
+		plugin.reportQueue.Enqueue(containerRef, event)
 	}
 
 	// Allowed by default.
@@ -310,53 +226,50 @@ func isValidContainerID(containerID string) bool {
 	return r.MatchString(containerID)
 }
 
-func createTrustReport(dc *dockerclient.Client, wlac *rpc.Client, containerID string) error {
-	encrypted := false
-	integrityEnforced := false
-	instanceInfo, err := dc.ContainerInspect(context.Background(), containerID)
+// createTrustReport builds the manifest of a started container and hands it to the trust report spool
+func (plugin *SecureDockerPlugin) createTrustReport(dc DockerClient, containerRef, event string) error {
+	instanceInfo, err := dc.ContainerInspect(context.Background(), containerRef)
 	if err != nil {
 		log.Println("Failed to get instance info: ", err.Error())
 	} else {
-		imageID := strings.TrimPrefix(instanceInfo.Image, "sha256:")
-		securityMetaData, err := util.GetSecurityMetaData(dc, imageID)
-		if err != nil {
-			log.Println("Error getting security meta data: ", err)
-			return nil
+		containerID := instanceInfo.ID
+		containerUUID := util.GetUUIDFromImageID(containerID)
+		startedAt := ""
+		if instanceInfo.State != nil {
+			startedAt = instanceInfo.State.StartedAt
 		}
-		if securityMetaData != nil {
-			encrypted = securityMetaData.RequiresConfidentiality
-			integrityEnforced = securityMetaData.RequiresIntegrity
-		} else {
+		// A start seen both in the docker response and in the docker events is reported once
+		if event == trustreport.EventStart && plugin.reports.Covers(containerUUID, startedAt) {
 			return nil
 		}
-		// get host hardware UUID
-		log.Println("Retrieving host hardware UUID...")
-		hardwareUUID, err := pinfo.HardwareUUID()
-		if err != nil {
-			log.Println("Unable to get the host hardware UUID")
-			return err
-		}
-		containerUUID := util.GetUUIDFromImageID(containerID)
-		imageUUID := util.GetUUIDFromImageID(imageID)
-		log.Println("The host hardware UUID is :", hardwareUUID)
+		plugin.recordContainerName(containerID, instanceInfo.Name)
+		imageID := strings.TrimPrefix(instanceInfo.Image, "sha256:")
 		log.Println("Container id : ", containerID)
-		manifest, err := vml.CreateContainerManifest(containerUUID, hardwareUUID, imageUUID, encrypted, integrityEnforced)
-		if err != nil {
-			log.Println("Unable to create manifest for container ", containerID)
-			return err
+		// The trust report names the image by the UUID its flavor was found with when the container was created
+		imageUUID := ""
+		if status, err := plugin.states.Get(containerID); err == nil {
+			imageUUID = status.FlavorKeyUUID
 		}
-		manifestByte, err := json.Marshal(manifest)
-		if err != nil {
-			log.Printf("Error marshalling Manifest for container %v %v", containerID, err.Error())
+		if imageUUID == "" {
+			imageRef := ""
+			if instanceInfo.Config != nil {
+				imageRef = instanceInfo.Config.Image
+			}
+			imageUUID = plugin.imageFlavorUUID(dc, imageRef, imageID)
+		}
+		manifest, err := plugin.containerManifest(dc, containerUUID, imageID, imageUUID)
+		if err != nil || manifest == "" {
 			return err
 		}
-		log.Println("Manifest: ", string(manifestByte))
 
-		var args = ManifestString{
-			Manifest: string(manifestByte),
+		report := trustreport.Report{
+			ContainerID:   containerID,
+			ContainerUUID: containerUUID,
+			Event:         event,
+			Manifest:      manifest,
+			StartedAt:     startedAt,
 		}
-		var status bool
-		err = wlac.Call("VirtualMachine.CreateInstanceTrustReport", &args, &status)
+		err = plugin.deliverTrustReport(report)
 		if err != nil {
 			log.Printf("Failed to create trust report for container %v %v: ", containerID, err.Error())
 			return err
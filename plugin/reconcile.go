@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"expvar"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	"log"
+	"secure-docker-plugin/v3/config"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Reconciliation metrics, exported on the plugin socket under /debug/vars
+	reconciledContainers = expvar.NewInt("sdp_reconcile_containers")
+	policyViolations     = expvar.NewInt("sdp_reconcile_violations")
+	remediatedContainers = expvar.NewInt("sdp_reconcile_stopped")
+)
+
+// ContainerDecision is the policy decision for a running container
+type ContainerDecision struct {
+	ContainerID string   `json:"container_id"`
+	Decision    Decision `json:"decision"`
+	Stopped     bool     `json:"stopped,omitempty"`
+}
+
+// Reconcile re-evaluates the running containers in the background, unless a reconciliation is already running
+func (plugin *SecureDockerPlugin) Reconcile() {
+	if !atomic.CompareAndSwapInt32(&plugin.reconciling, 0, 1) {
+		log.Println("Reconciliation already running")
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&plugin.reconciling, 0)
+		if _, err := plugin.ReconcileContainers(context.Background()); err != nil {
+			log.Printf("Reconciliation failed: %v", err)
+		}
+	}()
+}
+
+// ReconcileContainers runs the image policy and integrity check of AuthZReq against the images of the running
+// containers, without pulling them.
+// Violations are reported and, with the stop remediation, the non compliant containers are stopped.
+// Containers in audit mode are reported only. The decisions of the non compliant containers are returned.
+func (plugin *SecureDockerPlugin) ReconcileContainers(ctx context.Context) ([]ContainerDecision, error) {
+	dc, err := plugin.getDockerClient()
+	if err != nil {
+		plugin.closeDockerClient()
+		return nil, err
+	}
+
+	containers, err := dc.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list running containers")
+	}
+
+	cfg := plugin.config()
+	log.Printf("Reconciling %d running container(s) against the image policy", len(containers))
+
+	// The image a container runs is verified, not the image its reference points to now, each image once
+	decisions := make(map[string]Decision)
+	var violations []ContainerDecision
+	for _, container := range containers {
+		reconciledContainers.Add(1)
+		key := container.Image + "@" + container.ImageID
+		decision, verified := decisions[key]
+		if !verified {
+			decision = plugin.verifyRunningImage(dc, container, cfg.Reverify.BlockRevoked).enforce(&cfg.Policy)
+			decisions[key] = decision
+		}
+		if decision.Allow && !decision.Audited {
+			continue
+		}
+
+		policyViolations.Add(1)
+		violation := ContainerDecision{ContainerID: container.ID, Decision: decision}
+		if decision.Audited {
+			log.Printf("[AUDIT] Running container %s (%s) violates %s: [%s] %s", container.ID, container.Image,
+				decision.policySource(), decision.Code, decision.Reason)
+			writeAuditRecord(decision, cfg.Logging.AuditFile)
+		} else {
+			log.Printf("[VIOLATION] Running container %s (%s): [%s] %s", container.ID, container.Image,
+				decision.Code, decision.Reason)
+			if cfg.Reconcile.Remediation == config.RemediationStop {
+				violation.Stopped = stopContainer(ctx, dc, container.ID, cfg.Reconcile.StopTimeout.Duration)
+				if violation.Stopped {
+					remediatedContainers.Add(1)
+				}
+			}
+		}
+		violations = append(violations, violation)
+	}
+
+	log.Printf("Reconciliation done, %d non compliant container(s)", len(violations))
+	return violations, nil
+}
+
+// stopContainer stops a non compliant container, giving it timeout to exit before it is killed
+func stopContainer(ctx context.Context, dc DockerClient, containerID string, timeout time.Duration) bool {
+	if err := dc.ContainerStop(ctx, containerID, &timeout); err != nil {
+		log.Printf("Failed to stop non compliant container %s: %v", containerID, err)
+		return false
+	}
+	log.Printf("Stopped non compliant container %s", containerID)
+	return true
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"secure-docker-plugin/v3/capture"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/flavorsig"
+	"secure-docker-plugin/v3/integrity"
+	"secure-docker-plugin/v3/util"
+	"secure-docker-plugin/v3/wla"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// errNotCaptured is returned for the calls the replayed decision makes but the captured one did not
+var errNotCaptured = errors.New("not in the capture bundle")
+
+// Replay re-runs the authorization of a captured request with the configuration and the responses of the
+// docker daemon, registry, notary server and workload agent recorded in the bundle, so the decision is taken
+// again without any of them. The configuration in use is left untouched.
+// It returns the replayed decision and the response AuthZReq returned for it.
+func Replay(bundle *capture.Bundle) (Decision, authorization.Response, error) {
+	cfg, err := config.ParseConfiguration([]byte(bundle.Config))
+	if err != nil {
+		return Decision{}, authorization.Response{}, errors.Wrap(err, "Invalid configuration in the capture bundle")
+	}
+	// Replays must not leave anything behind
+	dir, err := ioutil.TempDir("", "sdp-replay")
+	if err != nil {
+		return Decision{}, authorization.Response{}, errors.Wrap(err, "Unable to create replay directory")
+	}
+	defer os.RemoveAll(dir)
+	cfg.State.Dir = dir
+	cfg.TrustReport.SpoolDir = dir
+	cfg.Reverify.RevocationFile = filepath.Join(dir, "revoked.json")
+	cfg.Logging.AuditFile = ""
+	cfg.Capture.Enabled = false
+	cfg.Cache.FlavorTTL = config.Duration{}
+	// Version 1 bundles were captured while the flavors were looked up by image ID only
+	if bundle.Version < 2 {
+		cfg.FlavorLookup.Keys = []string{config.FlavorKeyImageID}
+	}
+
+	sdp := newPlugin(cfg.Docker.Host, cfg.Wla.Socket,
+		WithConfig(func() *config.Configuration { return cfg }),
+		WithDockerClient(func(host string) (DockerClient, error) {
+			return replayDocker{bundle: bundle}, nil
+		}),
+		WithWlaClient(&replayAgent{bundle: bundle}),
+		WithRegistry(replayRegistry{bundle: bundle}),
+		WithIntegrityVerifier(replayIntegrity{bundle: bundle}),
+		WithFlavorVerifier(replayFlavorVerifier{bundle: bundle}))
+	for imageID, reason := range bundle.Revocations {
+		sdp.revocations.set(imageID, reason)
+	}
+
+	decision := sdp.Authorize(bundle.Request)
+	return decision, decision.Response(cfg.Policy.RedactDenialDetails), nil
+}
+
+// replayError recreates a recorded error
+func replayError(recorded *capture.Failure) error {
+	if recorded == nil {
+		return nil
+	}
+	if recorded.Method != "" {
+		return &wla.Error{Kind: recorded.Kind, Method: recorded.Method, Err: errors.New(recorded.Message)}
+	}
+	if sentinel, ok := sentinels[recorded.Kind]; ok {
+		return sentinel
+	}
+	if recorded.Kind == capture.NotFound {
+		return notFoundError(recorded.Message)
+	}
+	if recorded.Kind == certificateFailure {
+		return &flavorsig.CertificateError{Err: errors.New(recorded.Message)}
+	}
+	return errors.New(recorded.Message)
+}
+
+// notFoundError is a docker not found error
+type notFoundError string
+
+func (err notFoundError) Error() string {
+	return string(err)
+}
+
+// NotFound marks the error as a docker not found error
+func (err notFoundError) NotFound() bool {
+	return true
+}
+
+// replayDocker answers the inspections from the bundle
+type replayDocker struct {
+	bundle *capture.Bundle
+}
+
+func (dc replayDocker) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	recorded, ok := dc.bundle.Images[imageID]
+	if !ok {
+		return types.ImageInspect{}, nil, notFoundError("image " + imageID + " " + errNotCaptured.Error())
+	}
+	if recorded.Inspect == nil {
+		return types.ImageInspect{}, nil, replayError(recorded.Error)
+	}
+	return *recorded.Inspect, nil, nil
+}
+
+func (dc replayDocker) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	recorded, ok := dc.bundle.Containers[container]
+	if !ok {
+		return types.ContainerJSON{}, notFoundError("container " + container + " " + errNotCaptured.Error())
+	}
+	if recorded.Inspect == nil {
+		return types.ContainerJSON{}, replayError(recorded.Error)
+	}
+	return *recorded.Inspect, nil
+}
+
+func (dc replayDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	return nil, nil
+}
+
+func (dc replayDocker) ContainerStop(ctx context.Context, container string, timeout *time.Duration) error {
+	return errors.New("containers are not stopped in a replay")
+}
+
+func (dc replayDocker) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	errs := make(chan error, 1)
+	errs <- errors.New("no docker events in a replay")
+	return make(chan events.Message), errs
+}
+
+func (dc replayDocker) Close() error {
+	return nil
+}
+
+// replayRegistry answers the digests from the bundle
+type replayRegistry struct {
+	bundle *capture.Bundle
+}
+
+func (registry replayRegistry) ImageDigest(imageRef string) (string, error) {
+	recorded, ok := registry.bundle.Digests[imageRef]
+	if !ok {
+		return "", errors.Wrapf(errNotCaptured, "digest of %s", imageRef)
+	}
+	return recorded.Digest, replayError(recorded.Error)
+}
+
+// replayIntegrity answers the signature verifications from the bundle
+type replayIntegrity struct {
+	bundle *capture.Bundle
+}
+
+func (verifier replayIntegrity) VerifyIntegrity(dc util.ImageInspector, notaryURL, imageRef string) (
+	integrity.Signature, error) {
+	recorded, ok := verifier.bundle.Integrity[capture.IntegrityKey(notaryURL, imageRef)]
+	if !ok {
+		return integrity.Signature{}, errors.Wrapf(errNotCaptured, "signature verification of %s with %s", imageRef,
+			notaryURL)
+	}
+	if recorded.IntegrityError != nil {
+		return integrity.Signature{}, recorded.IntegrityError
+	}
+	return integrity.Signature{Digest: recorded.Digest, Signer: recorded.Signer}, replayError(recorded.Error)
+}
+
+// replayFlavorVerifier answers the flavor signature verifications from the bundle
+type replayFlavorVerifier struct {
+	bundle *capture.Bundle
+}
+
+func (verifier replayFlavorVerifier) VerifyFlavor(flvr wla.Flavor) error {
+	recorded, ok := verifier.bundle.FlavorSignatures[flvr.Meta.ID]
+	if !ok {
+		return errors.Wrapf(errNotCaptured, "signature verification of flavor %s", flvr.Meta.ID)
+	}
+	return replayError(recorded)
+}
+
+// replayAgent is a workload agent answering from the bundle
+type replayAgent struct {
+	bundle *capture.Bundle
+}
+
+func (agent *replayAgent) Connect(timeout time.Duration) error {
+	recorded := agent.bundle.Wla
+	if recorded == nil {
+		return errors.Wrap(errNotCaptured, "workload agent connection")
+	}
+	if !recorded.Installed {
+		return wla.ErrNotInstalled
+	}
+	return replayError(recorded.Error)
+}
+
+func (agent *replayAgent) Installed() bool {
+	return agent.bundle.Wla != nil && agent.bundle.Wla.Installed
+}
+
+func (agent *replayAgent) Status() wla.Status {
+	return wla.Status{}
+}
+
+func (agent *replayAgent) OnConnect(onConnect func()) {}
+
+func (agent *replayAgent) Reconfigure(socket string, dialTimeout, callTimeout time.Duration) {}
+
+func (agent *replayAgent) Run(stop <-chan struct{}) {}
+
+func (agent *replayAgent) Close() {}
+
+func (agent *replayAgent) FetchFlavor(imageUUID string) (wla.Flavor, error) {
+	recorded, ok := agent.bundle.Flavors[imageUUID]
+	if !ok {
+		return wla.Flavor{}, &wla.Error{Kind: wla.Transport, Method: wla.MethodFetchFlavor, Err: errNotCaptured}
+	}
+	if recorded.Flavor == nil {
+		return wla.Flavor{}, replayError(recorded.Error)
+	}
+	return *recorded.Flavor, nil
+}
+
+// FetchKey returns a zeroed key of the captured size, the key itself is never captured
+func (agent *replayAgent) FetchKey(keyURL string) ([]byte, error) {
+	recorded, ok := agent.bundle.Keys[keyURL]
+	if !ok {
+		return nil, &wla.Error{Kind: wla.Transport, Method: wla.MethodFetchKeyWithURL, Err: errNotCaptured}
+	}
+	if recorded.Error != nil {
+		return nil, replayError(recorded.Error)
+	}
+	return make([]byte, recorded.Size), nil
+}
+
+func (agent *replayAgent) CreateInstanceTrustReport(manifest string) error {
+	return errors.New("no trust report is created in a replay")
+}
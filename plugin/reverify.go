@@ -0,0 +1,322 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/integrity"
+	"secure-docker-plugin/v3/util"
+	"sync"
+	"time"
+)
+
+// reverifyPollInterval is how often a disabled periodic verification checks whether a reload enabled it
+const reverifyPollInterval = time.Minute
+
+var (
+	// Periodic verification metrics, exported on the plugin socket under /debug/vars
+	reverifyRuns       = expvar.NewInt("sdp_reverify_runs")
+	revokedImages      = expvar.NewInt("sdp_reverify_revoked_images")
+	revokedContainers  = expvar.NewInt("sdp_reverify_revoked_containers")
+	reverifiedStopped  = expvar.NewInt("sdp_reverify_stopped")
+	reverifyFailedRuns = expvar.NewInt("sdp_reverify_failed_runs")
+)
+
+// revokedCodes are the integrity failures meaning the signature of a previously verified image is no longer valid.
+// Other failures, such as an unreachable notary server or an unclassified error, leave the image state unchanged.
+var revokedCodes = map[DenialCode]bool{
+	CodeSignatureMissing: true,
+	CodeDigestMismatch:   true,
+}
+
+// revocationList keeps the images whose signature was found revoked, with the reason, by image ID. The list is
+// persisted in file, when set, so the revocations outlive a restart and are shared with the engines of the other
+// processes, which read it again whenever it changed.
+type revocationList struct {
+	mtx    sync.Mutex
+	images map[string]string
+	file   string
+	// modTime is the modification time of file when last read or written
+	modTime time.Time
+}
+
+// open sets the file the list is persisted in and loads it
+func (list *revocationList) open(file string) {
+	list.mtx.Lock()
+	defer list.mtx.Unlock()
+	list.file = file
+	list.modTime = time.Time{}
+	list.refresh()
+}
+
+// refresh reads the list again when its file changed, the caller holds the list lock
+func (list *revocationList) refresh() {
+	if list.file == "" {
+		return
+	}
+	info, err := os.Stat(list.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to read the revoked images of %s: %v", list.file, err)
+		}
+		return
+	}
+	if info.ModTime().Equal(list.modTime) {
+		return
+	}
+	data, err := ioutil.ReadFile(list.file)
+	images := make(map[string]string)
+	if err == nil {
+		err = json.Unmarshal(data, &images)
+	}
+	if err != nil {
+		log.Printf("Unable to read the revoked images of %s: %v", list.file, err)
+		return
+	}
+	list.images, list.modTime = images, info.ModTime()
+	revokedImages.Set(int64(len(list.images)))
+}
+
+// save writes the list to its file, the caller holds the list lock
+func (list *revocationList) save() {
+	if list.file == "" {
+		return
+	}
+	data, err := json.Marshal(list.images)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(list.file), 0700)
+	}
+	var tmp *os.File
+	if err == nil {
+		tmp, err = ioutil.TempFile(filepath.Dir(list.file), ".revoked")
+	}
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), list.file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to save the revoked images to %s: %v", list.file, err)
+		return
+	}
+	if info, err := os.Stat(list.file); err == nil {
+		list.modTime = info.ModTime()
+	}
+}
+
+func (list *revocationList) get(imageID string) (string, bool) {
+	list.mtx.Lock()
+	defer list.mtx.Unlock()
+	list.refresh()
+	reason, ok := list.images[imageID]
+	return reason, ok
+}
+
+// set records an image as revoked and tells whether it was not revoked before
+func (list *revocationList) set(imageID, reason string) bool {
+	list.mtx.Lock()
+	defer list.mtx.Unlock()
+	list.refresh()
+	if list.images == nil {
+		list.images = make(map[string]string)
+	}
+	reported, known := list.images[imageID]
+	list.images[imageID] = reason
+	revokedImages.Set(int64(len(list.images)))
+	if !known || reported != reason {
+		list.save()
+	}
+	return !known
+}
+
+// clear forgets an image whose signature is valid again and tells whether it was revoked
+func (list *revocationList) clear(imageID string) bool {
+	list.mtx.Lock()
+	defer list.mtx.Unlock()
+	list.refresh()
+	_, known := list.images[imageID]
+	delete(list.images, imageID)
+	revokedImages.Set(int64(len(list.images)))
+	if known {
+		list.save()
+	}
+	return known
+}
+
+// runningImage inspects the image a container runs under the reference the container was created with: the tag may
+// have been pulled again for another image since, which must not be verified in place of the running one
+type runningImage struct {
+	util.ImageInspector
+	imageRef string
+	imageID  string
+}
+
+func (images runningImage) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+	if image == images.imageRef && images.imageID != "" {
+		image = images.imageID
+	}
+	return images.ImageInspector.ImageInspectWithRaw(ctx, image)
+}
+
+// runningSignature verifies the signature of a running image by its manifest digest once its tag was signed again
+// for another image: moving a tag does not revoke the image, which stays valid as long as its digest is signed for a
+// tag of the repository
+type runningSignature struct {
+	IntegrityVerifier
+}
+
+func (verifier runningSignature) VerifyIntegrity(images util.ImageInspector, notaryURL, imageRef string) (
+	integrity.Signature, error) {
+	signature, err := verifier.IntegrityVerifier.VerifyIntegrity(images, notaryURL, imageRef)
+	if integrityErr, ok := err.(*integrity.Error); !ok || integrityErr.Kind != integrity.DigestMismatch {
+		return signature, err
+	}
+	named, parseErr := reference.ParseNormalizedNamed(imageRef)
+	if _, digested := named.(reference.Digested); parseErr != nil || digested {
+		return signature, err
+	}
+	metadata, _ := util.GetImageMetadata(images, imageRef)
+	digest := util.GetImageDigest(metadata, imageRef)
+	if metadata == nil || digest == "" {
+		return signature, err
+	}
+	signature, digestErr := verifier.IntegrityVerifier.VerifyIntegrity(images, notaryURL, named.Name()+"@"+digest)
+	if integrityErr, ok := digestErr.(*integrity.Error); ok && integrityErr.Kind == integrity.SignatureMissing {
+		// The digest is signed for no tag, the tag mismatch explains the revocation best
+		return signature, err
+	}
+	if digestErr == nil {
+		log.Printf("Tag of %s signed for another image, the running digest %s is still signed by %s", imageRef,
+			digest, signature.Signer)
+	}
+	return signature, digestErr
+}
+
+// verifyRunningImage evaluates the image a running container was created from, not the image its reference points
+// to now, denying the images with a revoked signature when checkRevoked is set. The encryption of the image is not
+// verified again, its key is only fetched when a container is created.
+func (plugin *SecureDockerPlugin) verifyRunningImage(dc DockerClient, container types.Container,
+	checkRevoked bool) Decision {
+	if decision, decided := plugin.ruleDecision(container.Image); decided {
+		return decision
+	}
+	images := runningImage{ImageInspector: dc, imageRef: container.Image, imageID: container.ImageID}
+	return plugin.verifyImageWith(images, container.Image, checkRevoked, false,
+		runningSignature{IntegrityVerifier: plugin.integrity}, nil)
+}
+
+// reverifyImages verifies the signatures of the running images every reverify.interval until stop is closed
+func (plugin *SecureDockerPlugin) reverifyImages(stop <-chan struct{}) {
+	for {
+		interval := plugin.config().Reverify.Interval.Duration
+		wait := interval
+		if wait <= 0 {
+			wait = reverifyPollInterval
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+		// The interval is read again, a reload may have disabled the verification while waiting
+		if plugin.config().Reverify.Interval.Duration <= 0 {
+			continue
+		}
+		if _, err := plugin.ReverifyImages(context.Background()); err != nil {
+			reverifyFailedRuns.Add(1)
+			log.Printf("Periodic image verification failed: %v", err)
+		}
+	}
+}
+
+// ReverifyImages verifies again the signatures of the images of the running containers which require integrity, the
+// images the containers run rather than the images their references point to now. A tag signed again for another
+// image only revokes the image it was signed for before once no other tag of the repository signs its digest.
+// Images whose signature is no longer valid are recorded as revoked, so that new containers can be denied, and
+// their containers are reported and, with the stop remediation, stopped. The decisions of the revoked containers
+// are returned.
+func (plugin *SecureDockerPlugin) ReverifyImages(ctx context.Context) ([]ContainerDecision, error) {
+	dc, err := plugin.getDockerClient()
+	if err != nil {
+		plugin.closeDockerClient()
+		return nil, err
+	}
+
+	containers, err := dc.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list running containers")
+	}
+
+	cfg := plugin.config()
+	reverifyRuns.Add(1)
+	log.Printf("Verifying the signatures of the images of %d running container(s)", len(containers))
+
+	// Each running image is verified once, notary lookups are expensive
+	decisions := make(map[string]Decision)
+	var revoked []ContainerDecision
+	for _, container := range containers {
+		key := container.Image + "@" + container.ImageID
+		decision, verified := decisions[key]
+		if !verified {
+			decision = plugin.verifyRunningImage(dc, container, false)
+			decisions[key] = decision
+			plugin.updateRevocation(decision)
+		}
+		if !revokedCodes[decision.Code] || decision.Allow || !decision.IntegrityRequired {
+			continue
+		}
+
+		revokedContainers.Add(1)
+		decision.Code = CodeSignatureRevoked
+		decision = decision.enforce(&cfg.Policy)
+		violation := ContainerDecision{ContainerID: container.ID, Decision: decision}
+		log.Printf("[REVOKED] Running container %s (%s): %s", container.ID, container.Image, decision.Reason)
+		writeAuditRecord(decision, cfg.Logging.AuditFile)
+		if !decision.Audited && cfg.Reverify.Remediation == config.RemediationStop {
+			violation.Stopped = stopContainer(ctx, dc, container.ID, cfg.Reverify.StopTimeout.Duration)
+			if violation.Stopped {
+				reverifiedStopped.Add(1)
+			}
+		}
+		revoked = append(revoked, violation)
+	}
+
+	log.Printf("Image verification done, %d container(s) run a revoked image", len(revoked))
+	return revoked, nil
+}
+
+// updateRevocation records the outcome of the verification of an image requiring integrity
+func (plugin *SecureDockerPlugin) updateRevocation(decision Decision) {
+	if decision.ImageID == "" || !decision.IntegrityRequired {
+		return
+	}
+	if decision.IntegrityVerified {
+		if plugin.revocations.clear(decision.ImageID) {
+			log.Printf("Signature of image %s is valid again", decision.ImageRef)
+		}
+		return
+	}
+	if revokedCodes[decision.Code] && plugin.revocations.set(decision.ImageID, decision.Reason) {
+		log.Printf("[REVOKED] Signature of image %s is no longer valid: %s", decision.ImageRef, decision.Reason)
+	}
+}
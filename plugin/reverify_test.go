@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"secure-docker-plugin/v3/integrity"
+	"secure-docker-plugin/v3/util"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestRevocationListPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdp-revoked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state", "revoked.json")
+
+	var list revocationList
+	list.open(file)
+	if !list.set("sha256:c0ffee", "signature removed") || list.set("sha256:c0ffee", "signature removed") {
+		t.Fatal("set did not tell whether the image was revoked before")
+	}
+	list.set("sha256:decade", "digest mismatch")
+
+	// Another list of the same file, as after a restart or in another process
+	var reopened revocationList
+	reopened.open(file)
+	if reason, revoked := reopened.get("sha256:c0ffee"); !revoked || reason != "signature removed" {
+		t.Errorf("Revocation lost on reload: %q, %v", reason, revoked)
+	}
+	if !list.clear("sha256:decade") {
+		t.Fatal("clear did not tell the image was revoked")
+	}
+	// The change is noticed without opening the file again, provided its modification time moved
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := info.ModTime().Add(time.Second)
+	if err = os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, revoked := reopened.get("sha256:decade"); revoked {
+		t.Error("Cleared revocation still read from the file")
+	}
+}
+
+// imagesByRef inspects the images of a fixed list
+type imagesByRef map[string]types.ImageInspect
+
+func (images imagesByRef) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte,
+	error) {
+	if inspect, ok := images[image]; ok {
+		return inspect, nil, nil
+	}
+	return types.ImageInspect{}, nil, notFoundError("No such image: " + image)
+}
+
+func TestRunningImageInspectsTheContainerImage(t *testing.T) {
+	images := runningImage{
+		ImageInspector: imagesByRef{
+			"app:1.0":     {ID: "sha256:new"},
+			"sha256:old":  {ID: "sha256:old"},
+			"sidecar:1.0": {ID: "sha256:sidecar"},
+		},
+		imageRef: "app:1.0",
+		imageID:  "sha256:old",
+	}
+	tests := map[string]string{"app:1.0": "sha256:old", "sidecar:1.0": "sha256:sidecar"}
+	for ref, want := range tests {
+		inspect, _, err := images.ImageInspectWithRaw(context.Background(), ref)
+		if err != nil || inspect.ID != want {
+			t.Errorf("ImageInspectWithRaw(%s) = %s, %v, want %s", ref, inspect.ID, err, want)
+		}
+	}
+	// Without the image ID of the container the reference is inspected
+	images.imageID = ""
+	if inspect, _, _ := images.ImageInspectWithRaw(context.Background(), "app:1.0"); inspect.ID != "sha256:new" {
+		t.Errorf("ImageInspectWithRaw(app:1.0) = %s without an image ID, want sha256:new", inspect.ID)
+	}
+}
+
+// signedDigests verifies the signatures against the digests signed for each tag of the repository app
+type signedDigests map[string]string
+
+func (tags signedDigests) VerifyIntegrity(dc util.ImageInspector, notaryURL, imageRef string) (integrity.Signature,
+	error) {
+	if i := strings.Index(imageRef, "@"); i >= 0 {
+		for _, digest := range tags {
+			if digest == imageRef[i+1:] {
+				return integrity.Signature{Digest: digest, Signer: "targets"}, nil
+			}
+		}
+		return integrity.Signature{}, &integrity.Error{Kind: integrity.SignatureMissing, ImageRef: imageRef}
+	}
+	inspect, _, _ := dc.ImageInspectWithRaw(context.Background(), imageRef)
+	digest := util.GetImageDigest(&inspect, imageRef)
+	if signed := tags[strings.TrimPrefix(imageRef, "app:")]; signed != digest {
+		return integrity.Signature{}, &integrity.Error{Kind: integrity.DigestMismatch, ImageRef: imageRef}
+	}
+	return integrity.Signature{Digest: digest, Signer: "targets"}, nil
+}
+
+func TestMovedTagDoesNotRevokeTheRunningImage(t *testing.T) {
+	images := runningImage{
+		ImageInspector: imagesByRef{
+			"sha256:old": {ID: "sha256:old", RepoDigests: []string{"app@sha256:" + strings.Repeat("1", 64)}},
+		},
+		imageRef: "app:latest",
+		imageID:  "sha256:old",
+	}
+	old, moved := "sha256:"+strings.Repeat("1", 64), "sha256:"+strings.Repeat("2", 64)
+	tests := []struct {
+		name string
+		tags signedDigests
+		kind string
+	}{
+		{"signed tag", signedDigests{"latest": old}, ""},
+		{"moved tag, digest signed for another tag", signedDigests{"latest": moved, "1.0": old}, ""},
+		{"moved tag, digest no longer signed", signedDigests{"latest": moved}, integrity.DigestMismatch},
+	}
+	for _, test := range tests {
+		verifier := runningSignature{IntegrityVerifier: test.tags}
+		signature, err := verifier.VerifyIntegrity(images, "https://notary.example.com", "app:latest")
+		if test.kind == "" && (err != nil || signature.Digest != old) {
+			t.Errorf("%s: VerifyIntegrity = %+v, %v, want the running digest verified", test.name, signature, err)
+		}
+		if integrityErr, ok := err.(*integrity.Error); test.kind != "" && (!ok || integrityErr.Kind != test.kind) {
+			t.Errorf("%s: VerifyIntegrity error %v, want %s", test.name, err, test.kind)
+		}
+	}
+}
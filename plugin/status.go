@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"secure-docker-plugin/v3/state"
+	"secure-docker-plugin/v3/trustreport"
+	"strings"
+	"sync"
+	"time"
+
+	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+const (
+	// StatusURI is the plugin HTTP endpoint returning the state of a container, followed by the container reference
+	StatusURI = "/status/"
+
+	// pendingDecisionTTL is how long the decision of a create request waits for the docker response
+	pendingDecisionTTL = time.Minute
+)
+
+type pendingDecision struct {
+	decision Decision
+	expires  time.Time
+}
+
+// pendingDecisions keeps the decisions of the allowed create requests until AuthZRes learns the ID of the created
+// container. They are keyed by request, docker passing the create request again with its response: identical
+// requests, creating containers of the same image with the same settings, queue their decisions and every
+// response takes the oldest one.
+type pendingDecisions struct {
+	mtx       sync.Mutex
+	decisions map[string][]pendingDecision
+}
+
+// requestKey identifies a request in AuthZReq and in AuthZRes
+func requestKey(req authorization.Request) string {
+	hash := sha256.New()
+	for _, field := range []string{req.User, req.RequestMethod, req.RequestURI} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	hash.Write(req.RequestBody)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (pending *pendingDecisions) put(key string, decision Decision) {
+	pending.mtx.Lock()
+	defer pending.mtx.Unlock()
+	if pending.decisions == nil {
+		pending.decisions = make(map[string][]pendingDecision)
+	}
+	now := time.Now()
+	for other, entries := range pending.decisions {
+		if entries = unexpired(entries, now); len(entries) == 0 {
+			delete(pending.decisions, other)
+		} else {
+			pending.decisions[other] = entries
+		}
+	}
+	pending.decisions[key] = append(pending.decisions[key],
+		pendingDecision{decision: decision, expires: now.Add(pendingDecisionTTL)})
+}
+
+// unexpired drops the expired decisions of a request, the oldest come first
+func unexpired(entries []pendingDecision, now time.Time) []pendingDecision {
+	for len(entries) > 0 && now.After(entries[0].expires) {
+		entries = entries[1:]
+	}
+	return entries
+}
+
+// take removes and returns the oldest decision of a request
+func (pending *pendingDecisions) take(key string) (Decision, bool) {
+	pending.mtx.Lock()
+	defer pending.mtx.Unlock()
+	entries := unexpired(pending.decisions[key], time.Now())
+	if len(entries) == 0 {
+		delete(pending.decisions, key)
+		return Decision{}, false
+	}
+	entry := entries[0]
+	if len(entries) == 1 {
+		delete(pending.decisions, key)
+	} else {
+		pending.decisions[key] = entries[1:]
+	}
+	return entry.decision, true
+}
+
+// containerCreated is the body of the docker response to a container create request
+type containerCreated struct {
+	ID string `json:"Id"`
+}
+
+// isContainerCreate tells whether a request path is a container create request
+func isContainerCreate(method, path string) bool {
+	return method == http.MethodPost && strings.HasSuffix(path, containerCreateURI)
+}
+
+// rememberDecision keeps the decision of an allowed create request until the container is created
+func (plugin *SecureDockerPlugin) rememberDecision(req authorization.Request, decision Decision) {
+	if !decision.Allow || decision.Passthrough || decision.ImageRef == "" {
+		return
+	}
+	reqURL, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil || !isContainerCreate(req.RequestMethod, reqURL.Path) {
+		return
+	}
+	plugin.decisions.put(requestKey(req), decision)
+}
+
+// recordContainerState stores the decision taken for a container once docker created it
+func (plugin *SecureDockerPlugin) recordContainerState(req authorization.Request, path string) {
+	if !isContainerCreate(req.RequestMethod, path) {
+		return
+	}
+	// The decision of a failed create is dropped as well
+	decision, ok := plugin.decisions.take(requestKey(req))
+	if !ok || req.ResponseStatusCode != http.StatusCreated {
+		return
+	}
+	var created containerCreated
+	if err := json.Unmarshal(req.ResponseBody, &created); err != nil || !isValidContainerID(created.ID) {
+		log.Println("Unable to read the ID of the created container")
+		return
+	}
+
+	name := ""
+	if reqURL, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		name = reqURL.Query().Get("name")
+	}
+	status := state.ContainerStatus{
+		ContainerID:             created.ID,
+		Name:                    strings.TrimPrefix(name, "/"),
+		ImageRef:                decision.ImageRef,
+		ImageID:                 decision.ImageID,
+		FlavorID:                decision.FlavorID,
+		FlavorKeyUUID:           decision.FlavorKeyUUID,
+		IntegrityVerified:       decision.IntegrityVerified,
+		ConfidentialityVerified: decision.ConfidentialityVerified,
+		Digest:                  decision.Digest,
+		Signer:                  decision.Signer,
+		NotaryURL:               decision.NotaryURL,
+		Code:                    string(decision.Code),
+		Reason:                  decision.Reason,
+		Enforcement:             decision.Enforcement,
+		Rule:                    decision.Rule,
+		Audited:                 decision.Audited,
+		Created:                 time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := plugin.states.Put(status); err != nil {
+		log.Printf("Unable to record the state of container %s: %v", created.ID, err)
+	}
+}
+
+// recordTrustReportState records the status of the latest trust report of a container
+func (plugin *SecureDockerPlugin) recordTrustReportState(report trustreport.Report, reportState string) {
+	err := plugin.states.Update(report.ContainerID, func(status *state.ContainerStatus) {
+		status.TrustReport = reportState
+		status.TrustReportEvent = report.Event
+	})
+	if err != nil {
+		log.Printf("Unable to record the trust report status of container %s: %v", report.ContainerID, err)
+	}
+}
+
+// recordContainerName records the name of a started container, docker names the containers created without one
+func (plugin *SecureDockerPlugin) recordContainerName(containerID, name string) {
+	name = strings.TrimPrefix(name, "/")
+	err := plugin.states.Update(containerID, func(status *state.ContainerStatus) {
+		status.Name = name
+	})
+	if err != nil {
+		log.Printf("Unable to record the name of container %s: %v", containerID, err)
+	}
+}
+
+// ContainerStatus returns the recorded state of a container from its name, ID or ID prefix
+func (plugin *SecureDockerPlugin) ContainerStatus(containerRef string) (*state.ContainerStatus, error) {
+	containerID, err := plugin.states.Resolve(containerRef)
+	if err == nil {
+		return plugin.states.Get(containerID)
+	}
+	if err != state.ErrNotFound {
+		return nil, err
+	}
+
+	// The containers whose name was not recorded are resolved by docker
+	dc, dcErr := plugin.getDockerClient()
+	if dcErr != nil {
+		plugin.closeDockerClient()
+		return nil, dcErr
+	}
+	instanceInfo, inspectErr := dc.ContainerInspect(context.Background(), containerRef)
+	if inspectErr != nil {
+		if dockerclient.IsErrNotFound(inspectErr) {
+			return nil, state.ErrNotFound
+		}
+		return nil, inspectErr
+	}
+	return plugin.states.Get(instanceInfo.ID)
+}
+
+// ServeStatus serves the state of the container named by the path following StatusURI
+func (plugin *SecureDockerPlugin) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, StatusURI)
+	if !containerRef.MatchString(ref) {
+		http.Error(w, "invalid container reference", http.StatusBadRequest)
+		return
+	}
+	status, err := plugin.ContainerStatus(ref)
+	if err == state.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package plugin
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// createRequest is a container create request of an image as passed to AuthZReq
+func createRequest(name, image string) authorization.Request {
+	return authorization.Request{
+		RequestMethod: http.MethodPost,
+		RequestURI:    "/v1.40/containers/create?name=" + name,
+		RequestBody:   []byte(`{"Image":"` + image + `"}`),
+	}
+}
+
+func TestPendingDecisionsKeyedByRequest(t *testing.T) {
+	const image = "registry.example.com/app:1.0"
+	var pending pendingDecisions
+
+	// The first create is allowed in audit mode, a reload enforces the policy before the identical second create
+	audited := Decision{ImageRef: image, Allow: true, Audited: true, Code: CodeFlavorNotFound}
+	enforced := Decision{ImageRef: image, Allow: true, Enforcement: "enforce"}
+	pending.put(requestKey(createRequest("web", image)), audited)
+	pending.put(requestKey(createRequest("web", image)), enforced)
+	other := Decision{ImageRef: image, Allow: true, Rule: "other"}
+	pending.put(requestKey(createRequest("db", image)), other)
+
+	// AuthZRes receives the create request again, along with the response
+	response := createRequest("web", image)
+	response.ResponseStatusCode = http.StatusCreated
+	response.ResponseBody = []byte(`{"Id":"c0ffee"}`)
+	for _, want := range []Decision{audited, enforced} {
+		if decision, ok := pending.take(requestKey(response)); !ok || decision.Audited != want.Audited ||
+			decision.Enforcement != want.Enforcement {
+			t.Errorf("Decision = %+v, %v, want %+v", decision, ok, want)
+		}
+	}
+	if decision, ok := pending.take(requestKey(response)); ok {
+		t.Errorf("Decision %+v taken twice", decision)
+	}
+	if decision, ok := pending.take(requestKey(createRequest("db", image))); !ok || decision.Rule != other.Rule {
+		t.Errorf("Decision of the other create = %+v, %v, want %+v", decision, ok, other)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"os/signal"
+	"secure-docker-plugin/v3/config"
+	"secure-docker-plugin/v3/plugin"
+	"syscall"
+)
+
+// logFile is the log file currently in use, nil when logging to stderr
+var logFile *os.File
+
+// loadConfiguration reads the configuration file and applies the command line overrides
+func loadConfiguration(path, dockerHost string) (*config.Configuration, error) {
+	cfg, err := config.LoadConfiguration(path)
+	if err != nil {
+		return nil, err
+	}
+	if dockerHost != "" {
+		cfg.Docker.Host = dockerHost
+	}
+	return cfg, nil
+}
+
+// applyLogging (re)opens the configured log file, which also lets logrotate work with SIGHUP
+func applyLogging(cfg *config.Configuration) error {
+	if cfg.Logging.File == "" {
+		log.SetOutput(os.Stderr)
+	} else {
+		f, err := os.OpenFile(cfg.Logging.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to open log file %s", cfg.Logging.File)
+		}
+		log.SetOutput(f)
+		if logFile != nil {
+			logFile.Close()
+		}
+		logFile = f
+		return nil
+	}
+
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+	return nil
+}
+
+// handleReload reloads the configuration every time SIGHUP is received.
+// The new configuration is swapped in only when it is valid, otherwise the current one is kept.
+// Changing plugin.socket requires a restart.
+func handleReload(sdp *plugin.SecureDockerPlugin, path, dockerHost string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		for range sigs {
+			log.Printf("SIGHUP received, reloading configuration from %s", path)
+			cfg, err := loadConfiguration(path, dockerHost)
+			if err != nil {
+				log.Printf("Failed to reload configuration, keeping the current one: %v", err)
+				continue
+			}
+			if err = applyLogging(cfg); err != nil {
+				log.Printf("Failed to reload configuration, keeping the current one: %v", err)
+				continue
+			}
+			config.Set(cfg)
+			sdp.Reconfigure(cfg)
+			log.Println("Configuration reloaded")
+			// The policy or the flavors may have changed, check the running containers again
+			if cfg.Reconcile.Enabled {
+				sdp.Reconcile()
+			}
+		}
+	}()
+}
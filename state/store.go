@@ -0,0 +1,264 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package state keeps the decisions taken for the containers and the status of their trust reports on disk,
+// so they can be inspected by the status command and the plugin HTTP endpoint.
+package state
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const stateFileExt = ".json"
+
+// Trust report states
+const (
+	TrustReportPending   = "pending"
+	TrustReportDelivered = "delivered"
+)
+
+// containerIDPattern matches full container IDs and their prefixes
+var containerIDPattern = regexp.MustCompile(`^[a-fA-F0-9]{1,64}$`)
+
+// ErrNotFound is returned when no state is recorded for a container
+var ErrNotFound = errors.New("no state recorded for the container")
+
+// ContainerStatus is the decision taken when a container was created along with the status of its trust report
+type ContainerStatus struct {
+	ContainerID string `json:"container_id"`
+	// Name is the container name, recorded from the create request or once the container started
+	Name     string `json:"name,omitempty"`
+	ImageRef string `json:"image_ref,omitempty"`
+	ImageID  string `json:"image_id,omitempty"`
+	FlavorID string `json:"flavor_id,omitempty"`
+	// FlavorKeyUUID is the image UUID the flavor was found with, the image UUID of the trust reports
+	FlavorKeyUUID           string `json:"flavor_key_uuid,omitempty"`
+	IntegrityVerified       bool   `json:"integrity_verified"`
+	ConfidentialityVerified bool   `json:"confidentiality_verified"`
+	// Digest is the image digest the signature was verified for by the NotaryURL notary server, Signer is the notary
+	// role which signed it, targets or a delegation such as targets/releases
+	Digest    string `json:"digest,omitempty"`
+	Signer    string `json:"signer,omitempty"`
+	NotaryURL string `json:"notary_url,omitempty"`
+	// Code and Reason explain the decision, Code is only set for containers let through by the audit mode
+	Code        string `json:"code,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Enforcement string `json:"enforcement,omitempty"`
+	Rule        string `json:"rule,omitempty"`
+	Audited     bool   `json:"audited,omitempty"`
+	Created     string `json:"created,omitempty"`
+	// TrustReport is either pending or delivered, empty when no trust report was created for the container
+	TrustReport      string `json:"trust_report,omitempty"`
+	TrustReportEvent string `json:"trust_report_event,omitempty"`
+	Updated          string `json:"updated,omitempty"`
+}
+
+// Store keeps a state file per container, named after the container ID
+type Store struct {
+	dir string
+	mtx sync.Mutex
+	// names maps the IDs of the recorded containers to their names, loaded on first use by Resolve
+	names map[string]string
+}
+
+// NewStore creates a store keeping the container states in dir
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+func (store *Store) path(containerID string) string {
+	return filepath.Join(store.dir, containerID+stateFileExt)
+}
+
+// Put records the state of a container, replacing the previous one
+func (store *Store) Put(status ContainerStatus) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	return store.write(status)
+}
+
+// Update applies change to the recorded state of a container, nothing is done when no state is recorded
+func (store *Store) Update(containerID string, change func(status *ContainerStatus)) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	status, err := store.read(containerID)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	change(status)
+	return store.write(*status)
+}
+
+// Remove forgets the state of a removed container
+func (store *Store) Remove(containerID string) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if err := os.Remove(store.path(containerID)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Unable to remove the state of container %s", containerID)
+	}
+	if store.names != nil {
+		delete(store.names, containerID)
+	}
+	return nil
+}
+
+// Resolve returns the full ID of a container with a recorded state from its name, its ID or a unique prefix of
+// its ID. The containers are resolved without docker, so removed containers are resolved until their state is removed.
+func (store *Store) Resolve(containerRef string) (string, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if err := store.loadNames(); err != nil {
+		return "", err
+	}
+	if _, ok := store.names[containerRef]; ok {
+		return containerRef, nil
+	}
+
+	// A container name takes precedence over an ID prefix, as with docker
+	for containerID, name := range store.names {
+		if name != "" && name == containerRef {
+			return containerID, nil
+		}
+	}
+	if !containerIDPattern.MatchString(containerRef) {
+		return "", ErrNotFound
+	}
+	match := ""
+	for containerID := range store.names {
+		if !strings.HasPrefix(containerID, containerRef) {
+			continue
+		}
+		if match != "" {
+			return "", errors.Errorf("container ID prefix %s is ambiguous", containerRef)
+		}
+		match = containerID
+	}
+	if match == "" {
+		return "", ErrNotFound
+	}
+	return match, nil
+}
+
+// loadNames reads the names of the recorded containers once, the caller holds the store lock
+func (store *Store) loadNames() error {
+	if store.names != nil {
+		return nil
+	}
+	names := make(map[string]string)
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Unable to read state directory %s", store.dir)
+	}
+	for _, file := range files {
+		fileName := file.Name()
+		if !strings.HasSuffix(fileName, stateFileExt) || strings.HasPrefix(fileName, ".") {
+			continue
+		}
+		status, err := store.read(strings.TrimSuffix(fileName, stateFileExt))
+		if err != nil {
+			continue
+		}
+		names[status.ContainerID] = status.Name
+	}
+	store.names = names
+	return nil
+}
+
+// Get returns the state of a container from its ID or a unique prefix of its ID
+func (store *Store) Get(containerID string) (*ContainerStatus, error) {
+	if !containerIDPattern.MatchString(containerID) {
+		return nil, errors.Errorf("%q is not a container ID", containerID)
+	}
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if len(containerID) == 64 {
+		return store.read(containerID)
+	}
+
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "Unable to read state directory %s", store.dir)
+	}
+	match := ""
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, stateFileExt) || !strings.HasPrefix(name, containerID) {
+			continue
+		}
+		if match != "" {
+			return nil, errors.Errorf("container ID prefix %s is ambiguous", containerID)
+		}
+		match = strings.TrimSuffix(name, stateFileExt)
+	}
+	if match == "" {
+		return nil, ErrNotFound
+	}
+	return store.read(match)
+}
+
+// read loads the state of a container, the caller holds the store lock
+func (store *Store) read(containerID string) (*ContainerStatus, error) {
+	data, err := ioutil.ReadFile(store.path(containerID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "Unable to read the state of container %s", containerID)
+	}
+	var status ContainerStatus
+	if err = json.Unmarshal(data, &status); err != nil {
+		return nil, errors.Wrapf(err, "Invalid state for container %s", containerID)
+	}
+	return &status, nil
+}
+
+// write atomically replaces the state file of a container, the caller holds the store lock
+func (store *Store) write(status ContainerStatus) error {
+	if !containerIDPattern.MatchString(status.ContainerID) || len(status.ContainerID) != 64 {
+		return errors.Errorf("%q is not a full container ID", status.ContainerID)
+	}
+	status.Updated = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling container state")
+	}
+
+	if err = os.MkdirAll(store.dir, 0700); err != nil {
+		return errors.Wrapf(err, "Unable to create state directory %s", store.dir)
+	}
+	tmp, err := ioutil.TempFile(store.dir, "."+status.ContainerID)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create state file")
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), store.path(status.ContainerID))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "Unable to write state file")
+	}
+	if store.names != nil {
+		store.names[status.ContainerID] = status.Name
+	}
+	return nil
+}
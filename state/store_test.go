@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	webID = "4f1c5b7ce8a9c1b5d3c7f3e5c9a7b1d3f5e7a9c1b3d5f7e9a1c3b5d7f9e1a3c5"
+	dbID  = "4f2a6c8e0b1d3f5a7c9e1b3d5f7a9c1e3b5d7f9a1c3e5b7d9f1a3c5e7b9d1f3a"
+)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "sdp-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStore(dir), func() { os.RemoveAll(dir) }
+}
+
+func TestResolve(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	for _, status := range []ContainerStatus{{ContainerID: webID, Name: "web"}, {ContainerID: dbID}} {
+		if err := store.Put(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The name of the second container is only known once it started
+	if err := store.Update(dbID, func(status *ContainerStatus) { status.Name = "db" }); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref         string
+		containerID string
+		err         string
+	}{
+		{ref: webID, containerID: webID},
+		{ref: "web", containerID: webID},
+		{ref: "4f1c5b", containerID: webID},
+		{ref: "db", containerID: dbID},
+		{ref: "4f2", containerID: dbID},
+		{ref: "4f", err: "ambiguous"},
+		{ref: "cache", err: ErrNotFound.Error()},
+		{ref: "0123", err: ErrNotFound.Error()},
+	}
+	for _, test := range tests {
+		containerID, err := store.Resolve(test.ref)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Resolve(%s) returned %s, %v, expected an error containing %q", test.ref, containerID, err,
+					test.err)
+			}
+			continue
+		}
+		if err != nil || containerID != test.containerID {
+			t.Errorf("Resolve(%s) returned %s, %v, expected %s", test.ref, containerID, err, test.containerID)
+		}
+	}
+}
+
+func TestResolveLoadsRecordedStates(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	if err := store.Put(ContainerStatus{ContainerID: webID, Name: "web"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted plugin resolves the names recorded before
+	restarted := NewStore(store.dir)
+	if containerID, err := restarted.Resolve("web"); err != nil || containerID != webID {
+		t.Fatalf("Resolve(web) returned %s, %v, expected %s", containerID, err, webID)
+	}
+	if err := restarted.Remove(webID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.Resolve("web"); err != ErrNotFound {
+		t.Errorf("Resolve(web) returned %v after the removal, expected %v", err, ErrNotFound)
+	}
+	if _, err := restarted.Get(webID); err != ErrNotFound {
+		t.Errorf("Get returned %v after the removal, expected %v", err, ErrNotFound)
+	}
+}
+
+func TestPutRejectsPartialIDs(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	for _, containerID := range []string{"", "web", webID[:12], "../" + webID} {
+		if err := store.Put(ContainerStatus{ContainerID: containerID}); err == nil {
+			t.Errorf("Put accepted the state of container %q", containerID)
+		}
+	}
+}
+
+func TestStateLifecycle(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	if err := store.Put(ContainerStatus{ContainerID: webID, FlavorID: "flavor-web"}); err != nil {
+		t.Fatal(err)
+	}
+	// The state of a container never created through the plugin is not made up
+	if err := store.Update(dbID, func(status *ContainerStatus) { status.Name = "db" }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(dbID); err != ErrNotFound {
+		t.Errorf("Get(%s) returned %v after an update, expected %v", dbID, err, ErrNotFound)
+	}
+
+	if err := store.Update(webID, func(status *ContainerStatus) { status.Name = "web" }); err != nil {
+		t.Fatal(err)
+	}
+	status, err := store.Get(webID[:12])
+	if err != nil || status.ContainerID != webID || status.Name != "web" || status.FlavorID != "flavor-web" {
+		t.Errorf("Get(%s) returned %+v, %v, expected the updated state of %s", webID[:12], status, err, webID)
+	}
+
+	if err = store.Remove(webID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(webID); err != ErrNotFound {
+		t.Errorf("Get(%s) returned %v after the removal, expected %v", webID, err, ErrNotFound)
+	}
+	// Removing a container twice is not an error, the docker responses may be replayed
+	if err = store.Remove(webID); err != nil {
+		t.Errorf("Second Remove(%s) returned %v", webID, err)
+	}
+	if _, err = store.Get("web"); err == nil {
+		t.Errorf("Get(web) succeeded, expected a name to be rejected")
+	}
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package trustreport
+
+// Container lifecycle events, the terminations are recorded by the plugin as the workload agent has no method for them
+const (
+	EventStart   = "start"
+	EventRestart = "restart"
+	EventUpdate  = "update"
+	EventStop    = "stop"
+	EventKill    = "kill"
+	EventRemove  = "remove"
+)
+
+// IsTermination tells whether the event ends the execution of the container,
+// the other events come with a new trust report of the container
+func IsTermination(event string) bool {
+	return event == EventStop || event == EventKill || event == EventRemove
+}
+
+// Report is a lifecycle event of a container to deliver to the workload agent.
+// Manifest holds the container manifest of the trust report for the non termination events.
+type Report struct {
+	ContainerID   string `json:"container_id"`
+	ContainerUUID string `json:"container_uuid"`
+	Event         string `json:"event"`
+	Manifest      string `json:"manifest,omitempty"`
+	// StartedAt identifies the run of the container the report belongs to
+	StartedAt string `json:"started_at,omitempty"`
+	Created   string `json:"created"`
+	Attempts  int    `json:"attempts"`
+	// Terminated is the termination of the container queued behind the report, delivered once the report was
+	Terminated string `json:"terminated,omitempty"`
+}
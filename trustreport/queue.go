@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package trustreport
+
+import (
+	"expvar"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// Queue metrics, exported on the plugin socket under /debug/vars
+	queueLength    = expvar.NewInt("sdp_trust_report_queue_length")
+	queueProcessed = expvar.NewInt("sdp_trust_report_queue_processed")
+	queueFailed    = expvar.NewInt("sdp_trust_report_queue_failed")
+	queueFull      = expvar.NewInt("sdp_trust_report_queue_full")
+)
+
+// Processor creates the report of a container lifecycle event
+type Processor func(containerRef, event string) error
+
+type job struct {
+	containerRef string
+	event        string
+}
+
+// shard holds the jobs of the containers processed by one worker, in the order they were enqueued
+type shard struct {
+	mtx  sync.Mutex
+	jobs []job
+	// ready wakes the worker up, room wakes up an Enqueue waiting for the worker
+	ready chan struct{}
+	room  chan struct{}
+}
+
+// Queue creates trust reports in a bounded pool of workers, off the docker request path. The containers are sharded
+// over the workers by reference, so the events of a container are reported in the order they happened.
+type Queue struct {
+	shards  []*shard
+	size    int
+	timeout time.Duration
+	process Processor
+}
+
+// NewQueue creates a queue of size containers processed by the given number of workers.
+// When the shard of a container is full, Enqueue waits up to timeout for room before queuing it beyond the size.
+func NewQueue(size, workers int, timeout time.Duration, process Processor) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	queue := &Queue{
+		shards:  make([]*shard, workers),
+		size:    (size + workers - 1) / workers,
+		timeout: timeout,
+		process: process,
+	}
+	for i := range queue.shards {
+		queue.shards[i] = &shard{ready: make(chan struct{}, 1), room: make(chan struct{}, 1)}
+	}
+	return queue
+}
+
+// shardOf returns the shard of a container
+func (queue *Queue) shardOf(containerRef string) *shard {
+	hash := fnv.New32a()
+	hash.Write([]byte(containerRef))
+	return queue.shards[hash.Sum32()%uint32(len(queue.shards))]
+}
+
+// signal wakes up the goroutine waiting on a channel of a shard, if any
+func signal(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue schedules the report of a container lifecycle event, the container is referenced by ID or name.
+// When the shard of the container stays full the event is queued beyond the size rather than lost or reported out
+// of order, Enqueue never waits for the report.
+func (queue *Queue) Enqueue(containerRef, event string) {
+	target := queue.shardOf(containerRef)
+	if !target.waitRoom(queue.size, queue.timeout) {
+		queueFull.Add(1)
+		log.Printf("Trust report queue is full, queuing the %s report of container %s beyond its size", event,
+			containerRef)
+	}
+	target.mtx.Lock()
+	target.jobs = append(target.jobs, job{containerRef: containerRef, event: event})
+	target.mtx.Unlock()
+	queueLength.Add(1)
+	signal(target.ready)
+}
+
+// waitRoom waits up to timeout for the shard to hold less than size jobs, it returns false when it stayed full
+func (target *shard) waitRoom(size int, timeout time.Duration) bool {
+	var timer *time.Timer
+	for {
+		target.mtx.Lock()
+		length := len(target.jobs)
+		target.mtx.Unlock()
+		if length < size {
+			return true
+		}
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-target.room:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (queue *Queue) run(next job) {
+	if err := queue.process(next.containerRef, next.event); err != nil {
+		queueFailed.Add(1)
+		log.Printf("%s report for container %s is pending: %v", next.event, next.containerRef, err)
+		return
+	}
+	queueProcessed.Add(1)
+}
+
+// work processes the jobs of a shard one at a time until stop is closed
+func (queue *Queue) work(worker *shard, stop <-chan struct{}) {
+	for {
+		worker.mtx.Lock()
+		if len(worker.jobs) == 0 {
+			worker.mtx.Unlock()
+			select {
+			case <-stop:
+				return
+			case <-worker.ready:
+				continue
+			}
+		}
+		next := worker.jobs[0]
+		worker.jobs = worker.jobs[1:]
+		worker.mtx.Unlock()
+		signal(worker.room)
+
+		queueLength.Add(-1)
+		queue.run(next)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// Run processes the queued containers until stop is closed
+func (queue *Queue) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, worker := range queue.shards {
+		wg.Add(1)
+		go func(worker *shard) {
+			defer wg.Done()
+			queue.work(worker, stop)
+		}(worker)
+	}
+	wg.Wait()
+}
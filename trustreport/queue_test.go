@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package trustreport
+
+import (
+	"github.com/pkg/errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueFullDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	processed := make(chan string, 3)
+	queue := NewQueue(1, 1, time.Millisecond, func(containerRef, event string) error {
+		<-release
+		processed <- containerRef
+		return nil
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go queue.Run(stop)
+
+	begin := time.Now()
+	for _, containerRef := range []string{"c1", "c2", "c3"} {
+		queue.Enqueue(containerRef, EventStart)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("Enqueue blocked for %v on a full queue", elapsed)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-processed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d report(s) created, want 3", i)
+		}
+	}
+}
+
+func TestQueueKeepsTheEventsOfAContainerInOrder(t *testing.T) {
+	var mtx sync.Mutex
+	events := make(map[string][]string)
+	done := make(chan struct{}, 100)
+	queue := NewQueue(4, 4, time.Millisecond, func(containerRef, event string) error {
+		// The first event of a container takes longer, a worker of its own would let the next one overtake it
+		if event == EventStart {
+			time.Sleep(10 * time.Millisecond)
+		}
+		mtx.Lock()
+		events[containerRef] = append(events[containerRef], event)
+		mtx.Unlock()
+		done <- struct{}{}
+		return nil
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go queue.Run(stop)
+
+	containers := []string{"c1", "c2", "c3", "c4", "c5"}
+	sequence := []string{EventStart, EventStop, EventRestart, EventKill, EventRemove}
+	for _, event := range sequence {
+		for _, containerRef := range containers {
+			queue.Enqueue(containerRef, event)
+		}
+	}
+	for i := 0; i < len(containers)*len(sequence); i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d report(s) created, want %d", i, len(containers)*len(sequence))
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, containerRef := range containers {
+		if !reflect.DeepEqual(events[containerRef], sequence) {
+			t.Errorf("Events of %s reported as %v, want %v", containerRef, events[containerRef], sequence)
+		}
+	}
+}
+
+func TestQueueGoesOnAfterAFailure(t *testing.T) {
+	processed := make(chan string, 2)
+	queue := NewQueue(2, 1, time.Millisecond, func(containerRef, event string) error {
+		processed <- event
+		if event == EventStart {
+			return errors.New("workload agent unavailable")
+		}
+		return nil
+	})
+	failed := queueFailed.Value()
+	stop := make(chan struct{})
+	defer close(stop)
+	go queue.Run(stop)
+
+	queue.Enqueue("c1", EventStart)
+	queue.Enqueue("c1", EventStop)
+	for _, want := range []string{EventStart, EventStop} {
+		select {
+		case event := <-processed:
+			if event != want {
+				t.Fatalf("Processed %s, want %s", event, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The %s report was not created after the failure", want)
+		}
+	}
+	if queueFailed.Value() != failed+1 {
+		t.Errorf("Failed reports = %d, want %d", queueFailed.Value(), failed+1)
+	}
+}
@@ -0,0 +1,349 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package trustreport
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolFileExt = ".json"
+	reportedDir  = "reported"
+	// maxRejections is the number of times a report rejected by the workload agent is retried
+	maxRejections = 5
+)
+
+// Sender delivers a report to the workload agent
+type Sender func(report Report) error
+
+// Spool keeps the reports on disk until the workload agent accepted them. Reports are keyed by
+// container UUID, so a container has at most one pending report: the latest lifecycle event wins, except that a
+// termination never replaces a pending trust report but is queued behind it.
+// The run of the containers whose trust report was delivered is remembered until they are removed.
+type Spool struct {
+	dir      string
+	send     Sender
+	minDelay time.Duration
+	maxDelay time.Duration
+	mtx      sync.Mutex
+	wake     chan struct{}
+}
+
+// NewSpool creates a spool storing the pending reports in dir, retrying the delivery
+// with a delay doubling from minDelay up to maxDelay while the workload agent is unavailable
+func NewSpool(dir string, send Sender, minDelay, maxDelay time.Duration) *Spool {
+	return &Spool{
+		dir:      dir,
+		send:     send,
+		minDelay: minDelay,
+		maxDelay: maxDelay,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (spool *Spool) path(containerUUID string) string {
+	return filepath.Join(spool.dir, containerUUID+spoolFileExt)
+}
+
+func (spool *Spool) reportedPath(containerUUID string) string {
+	return filepath.Join(spool.dir, reportedDir, containerUUID)
+}
+
+// Add stores a report, replacing any report still pending for the same container
+func (spool *Spool) Add(report Report) error {
+	spool.mtx.Lock()
+	defer spool.mtx.Unlock()
+	return spool.put(report)
+}
+
+// put stores a report like Add, the caller holds the spool lock
+func (spool *Spool) put(report Report) error {
+	if report.Created == "" {
+		report.Created = time.Now().UTC().Format(time.RFC3339)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling spool entry")
+	}
+	return spool.write(report.ContainerUUID, data)
+}
+
+// pending reads the pending report of a container, nil when there is none. The caller holds the spool lock.
+func (spool *Spool) pending(containerUUID string) (*Report, error) {
+	data, err := ioutil.ReadFile(spool.path(containerUUID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending Report
+	if err = json.Unmarshal(data, &pending); err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+// Reported tells whether the trust report of a container was delivered and the container was not removed since
+func (spool *Spool) Reported(containerUUID string) bool {
+	_, err := os.Stat(spool.reportedPath(containerUUID))
+	return err == nil
+}
+
+// IsPending tells whether a report of the container waits for delivery
+func (spool *Spool) IsPending(containerUUID string) bool {
+	_, err := os.Stat(spool.path(containerUUID))
+	return err == nil
+}
+
+// Covers tells whether a trust report was delivered or is pending for the run of a container started at startedAt
+func (spool *Spool) Covers(containerUUID, startedAt string) bool {
+	if reported, err := ioutil.ReadFile(spool.reportedPath(containerUUID)); err == nil && string(reported) == startedAt {
+		return true
+	}
+
+	data, err := ioutil.ReadFile(spool.path(containerUUID))
+	if err != nil {
+		return false
+	}
+	var pending Report
+	if err = json.Unmarshal(data, &pending); err != nil {
+		return false
+	}
+	return !IsTermination(pending.Event) && pending.StartedAt == startedAt
+}
+
+// delivered records the delivery of a report, spooling the termination queued behind it. The caller holds the
+// spool lock.
+func (spool *Spool) delivered(report Report) {
+	if report.Terminated == "" {
+		os.Remove(spool.path(report.ContainerUUID))
+	} else if err := spool.put(Report{ContainerID: report.ContainerID, ContainerUUID: report.ContainerUUID,
+		Event: report.Terminated}); err != nil {
+		log.Printf("Unable to spool %s report for container %s: %v", report.Terminated, report.ContainerID, err)
+		os.Remove(spool.path(report.ContainerUUID))
+	}
+
+	switch {
+	case report.Event == EventRemove:
+		os.Remove(spool.reportedPath(report.ContainerUUID))
+	case !IsTermination(report.Event):
+		err := os.MkdirAll(filepath.Join(spool.dir, reportedDir), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(spool.reportedPath(report.ContainerUUID), []byte(report.StartedAt), 0600)
+		}
+		if err != nil {
+			log.Printf("Unable to record the trust report of container %s: %v", report.ContainerID, err)
+		}
+	}
+}
+
+// write atomically replaces the spool file of a container, the caller holds the spool lock
+func (spool *Spool) write(containerUUID string, data []byte) error {
+	if err := os.MkdirAll(spool.dir, 0700); err != nil {
+		return errors.Wrapf(err, "Unable to create spool directory %s", spool.dir)
+	}
+	tmp, err := ioutil.TempFile(spool.dir, "."+containerUUID)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create spool file")
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), spool.path(containerUUID))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "Unable to write spool file")
+	}
+	return nil
+}
+
+// Deliver spools a report and wakes the delivery worker up, the report is sent by Run whether or not the
+// workload agent is available, so Deliver never waits for it.
+// Terminations are only delivered for containers with a delivered or pending trust report. The termination of a
+// container whose trust report is still pending is delivered after it.
+func (spool *Spool) Deliver(report Report) error {
+	if err := spool.spool(report); err != nil {
+		return errors.Wrapf(err, "Unable to spool %s report for container %s", report.Event, report.ContainerID)
+	}
+	spool.Wake()
+	return nil
+}
+
+func (spool *Spool) spool(report Report) error {
+	spool.mtx.Lock()
+	defer spool.mtx.Unlock()
+	if !IsTermination(report.Event) {
+		return spool.put(report)
+	}
+	pending, err := spool.pending(report.ContainerUUID)
+	if err != nil {
+		log.Printf("Replacing unreadable spooled trust report %s: %v", report.ContainerUUID, err)
+	}
+	switch {
+	case pending != nil && !IsTermination(pending.Event):
+		pending.Terminated = report.Event
+		return spool.put(*pending)
+	case pending == nil && !spool.Reported(report.ContainerUUID):
+		return nil
+	}
+	return spool.put(report)
+}
+
+// Pending returns the number of reports waiting to be delivered
+func (spool *Spool) Pending() int {
+	spool.mtx.Lock()
+	defer spool.mtx.Unlock()
+	return len(spool.list())
+}
+
+// list returns the container UUIDs of the pending reports, oldest first. The caller holds the spool lock.
+func (spool *Spool) list() []string {
+	files, err := ioutil.ReadDir(spool.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to read spool directory %s: %v", spool.dir, err)
+		}
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	var uuids []string
+	for _, file := range files {
+		name := file.Name()
+		if file.Mode().IsRegular() && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, spoolFileExt) {
+			uuids = append(uuids, strings.TrimSuffix(name, spoolFileExt))
+		}
+	}
+	return uuids
+}
+
+// Flush sends the pending reports. It stops at the first transport failure, the remaining
+// reports are kept for the next attempt. Reports rejected by the workload agent are kept as well.
+func (spool *Spool) Flush() error {
+	spool.mtx.Lock()
+	defer spool.mtx.Unlock()
+
+	for _, containerUUID := range spool.list() {
+		if err := spool.flush(containerUUID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush sends the pending report of a container, then the termination queued behind it. The caller holds the
+// spool lock.
+func (spool *Spool) flush(containerUUID string) error {
+	for {
+		data, err := ioutil.ReadFile(spool.path(containerUUID))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Unable to read spooled trust report %s: %v", containerUUID, err)
+			}
+			return nil
+		}
+		var pending Report
+		if err = json.Unmarshal(data, &pending); err != nil {
+			log.Printf("Dropping corrupted spooled trust report %s: %v", containerUUID, err)
+			os.Remove(spool.path(containerUUID))
+			return nil
+		}
+
+		err = spool.send(pending)
+		if err == nil {
+			log.Printf("%s report delivered for container %s", pending.Event, pending.ContainerID)
+			spool.delivered(pending)
+			if pending.Terminated != "" {
+				continue
+			}
+			return nil
+		}
+
+		pending.Attempts++
+		_, rejected := errors.Cause(err).(rpc.ServerError)
+		if rejected && pending.Attempts >= maxRejections {
+			log.Printf("Dropping %s report for container %s rejected %d times by the workload agent: %v",
+				pending.Event, pending.ContainerID, pending.Attempts, err)
+			os.Remove(spool.path(containerUUID))
+			return nil
+		}
+		if data, marshalErr := json.Marshal(pending); marshalErr == nil {
+			if writeErr := spool.write(containerUUID, data); writeErr != nil {
+				log.Printf("Unable to update spooled trust report %s: %v", containerUUID, writeErr)
+			}
+		}
+		if rejected {
+			log.Printf("%s report for container %s rejected by the workload agent (attempt %d): %v",
+				pending.Event, pending.ContainerID, pending.Attempts, err)
+			return nil
+		}
+		return errors.Wrapf(err, "Failed to deliver %s report for container %s", pending.Event, pending.ContainerID)
+	}
+}
+
+// Wake triggers a delivery attempt without waiting for the retry delay, e.g. after the workload agent reconnected
+func (spool *Spool) Wake() {
+	select {
+	case spool.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run retries the delivery of the pending reports until stop is closed
+func (spool *Spool) Run(stop <-chan struct{}) {
+	delay := spool.minDelay
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-spool.wake:
+		case <-timer.C:
+		}
+
+		if err := spool.Flush(); err != nil {
+			log.Printf("%v, %d report(s) pending, retrying in %v", err, spool.Pending(), delay)
+			resetTimer(timer, delay)
+			delay *= 2
+			if delay > spool.maxDelay {
+				delay = spool.maxDelay
+			}
+			continue
+		}
+
+		delay = spool.minDelay
+		// Rejected reports are retried at the slowest pace
+		resetTimer(timer, spool.maxDelay)
+	}
+}
+
+func resetTimer(timer *time.Timer, delay time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(delay)
+}
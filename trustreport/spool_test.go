@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package trustreport
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAgent records the reports sent, failing while unavailable
+type fakeAgent struct {
+	mtx       sync.Mutex
+	available bool
+	reports   []Report
+}
+
+func (agent *fakeAgent) send(report Report) error {
+	agent.mtx.Lock()
+	defer agent.mtx.Unlock()
+	if !agent.available {
+		return errors.New("WLA is not available")
+	}
+	agent.reports = append(agent.reports, report)
+	return nil
+}
+
+func (agent *fakeAgent) setAvailable(available bool) {
+	agent.mtx.Lock()
+	defer agent.mtx.Unlock()
+	agent.available = available
+}
+
+func (agent *fakeAgent) sent() []Report {
+	agent.mtx.Lock()
+	defer agent.mtx.Unlock()
+	return append([]Report(nil), agent.reports...)
+}
+
+func newTestSpool(t *testing.T, agent *fakeAgent) (*Spool, func()) {
+	dir, err := ioutil.TempDir("", "sdp-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSpool(dir, agent.send, time.Millisecond, 10*time.Millisecond), func() { os.RemoveAll(dir) }
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSpoolDeliversOnceTheAgentIsBack(t *testing.T) {
+	agent := &fakeAgent{}
+	spool, cleanup := newTestSpool(t, agent)
+	defer cleanup()
+
+	start := Report{ContainerID: "c1", ContainerUUID: "uuid-1", Event: EventStart, Manifest: "{}", StartedAt: "t1"}
+	if err := spool.Deliver(start); err != nil {
+		t.Fatal(err)
+	}
+	if !spool.IsPending("uuid-1") || len(agent.sent()) != 0 {
+		t.Fatalf("Report not spooled while the workload agent is unavailable")
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go spool.Run(stop)
+	time.Sleep(20 * time.Millisecond)
+	agent.setAvailable(true)
+	// The delivery is recorded once the agent accepted the report
+	waitFor(t, func() bool { return !spool.IsPending("uuid-1") && spool.Reported("uuid-1") })
+	if sent := agent.sent(); len(sent) != 1 || !spool.Covers("uuid-1", "t1") {
+		t.Errorf("Reports sent %+v, want the start of c1 recorded as covering its run", sent)
+	}
+
+	// The termination of a reported container is delivered, a termination of an unknown container is not
+	spool.Deliver(Report{ContainerID: "c1", ContainerUUID: "uuid-1", Event: EventRemove})
+	spool.Deliver(Report{ContainerID: "c2", ContainerUUID: "uuid-2", Event: EventStop})
+	waitFor(t, func() bool { return len(agent.sent()) == 2 })
+	if sent := agent.sent(); sent[1].Event != EventRemove || spool.Reported("uuid-1") || spool.IsPending("uuid-2") {
+		t.Errorf("Reports sent %+v, want the removal of c1 only", sent)
+	}
+}
+
+func TestSpoolKeepsTheLatestEvent(t *testing.T) {
+	agent := &fakeAgent{}
+	spool, cleanup := newTestSpool(t, agent)
+	defer cleanup()
+
+	spool.Deliver(Report{ContainerID: "c1", ContainerUUID: "uuid-1", Event: EventStart, Manifest: "{}"})
+	spool.Deliver(Report{ContainerID: "c1", ContainerUUID: "uuid-1", Event: EventUpdate, Manifest: "{}"})
+	// A termination does not replace the pending trust report, it is delivered after it
+	spool.Deliver(Report{ContainerID: "c1", ContainerUUID: "uuid-1", Event: EventStop})
+	spool.Deliver(Report{ContainerID: "c1", ContainerUUID: "uuid-1", Event: EventRemove})
+	agent.setAvailable(true)
+	if err := spool.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sent := agent.sent()
+	if len(sent) != 2 || sent[0].Event != EventUpdate || sent[1].Event != EventRemove {
+		t.Errorf("Reports sent %+v, want the update then the removal", sent)
+	}
+	if spool.IsPending("uuid-1") || spool.Reported("uuid-1") {
+		t.Error("Removed container still pending or reported")
+	}
+}
+
+func TestSpoolDeliversAPendingStartBeforeItsTermination(t *testing.T) {
+	// The workload agent is disconnected when the container stops
+	agent := &fakeAgent{}
+	spool, cleanup := newTestSpool(t, agent)
+	defer cleanup()
+
+	start := Report{ContainerID: "c1", ContainerUUID: "uuid-1", Event: EventStart, Manifest: "{}", StartedAt: "t1"}
+	spool.Deliver(start)
+	spool.Deliver(Report{ContainerID: "c1", ContainerUUID: "uuid-1", Event: EventStop})
+	if !spool.Covers("uuid-1", "t1") {
+		t.Fatal("Pending start replaced by the termination")
+	}
+	if err := spool.Flush(); err == nil {
+		t.Fatal("Reports delivered while the workload agent is unavailable")
+	}
+
+	agent.setAvailable(true)
+	if err := spool.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sent := agent.sent()
+	if len(sent) != 2 || sent[0].Event != EventStart || sent[1].Event != EventStop || !spool.Reported("uuid-1") {
+		t.Errorf("Reports sent %+v, want the start delivered then the stop", sent)
+	}
+	if spool.IsPending("uuid-1") {
+		t.Error("Termination still pending after the start was delivered")
+	}
+}
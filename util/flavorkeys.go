@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package util
+
+import (
+	"secure-docker-plugin/v3/config"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// FlavorKey is a key the flavor of an image can be associated with, the workload agent is queried with its UUID
+type FlavorKey struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+	UUID  string `json:"uuid"`
+}
+
+// newFlavorKey returns the key of a value, its UUID is derived like the image UUID
+func newFlavorKey(kind, value string) FlavorKey {
+	return FlavorKey{Kind: kind, Value: value, UUID: GetUUIDFromImageID(value)}
+}
+
+// namedRef parses an image reference into a repository name, nil when the reference is an image ID
+func namedRef(imageRef, imageID string) reference.Named {
+	ref, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil || (imageID != "" && strings.HasPrefix(imageID, strings.TrimPrefix(imageRef, "sha256:"))) {
+		return nil
+	}
+	return ref
+}
+
+// GetImageDigest returns the manifest digest of an image: the digest imageRef references, or the repository digest
+// of the local image for the repository of imageRef. It is empty when unknown, for instance for an image built locally.
+func GetImageDigest(imageInfo *types.ImageInspect, imageRef string) string {
+	imageID := ""
+	if imageInfo != nil {
+		imageID = strings.TrimPrefix(imageInfo.ID, "sha256:")
+	}
+	ref := namedRef(imageRef, imageID)
+	if ref == nil {
+		return ""
+	}
+	if digested, ok := ref.(reference.Digested); ok {
+		return digested.Digest().String()
+	}
+	if imageInfo == nil {
+		return ""
+	}
+	for _, repoDigest := range imageInfo.RepoDigests {
+		digested, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil || digested.Name() != ref.Name() {
+			continue
+		}
+		if digested, ok := digested.(reference.Digested); ok {
+			return digested.Digest().String()
+		}
+	}
+	return ""
+}
+
+// GetFlavorKeys returns the keys the flavor of an image is looked up with, in the order of lookup.Keys.
+// imageID is the image ID without the sha256: prefix, digest the manifest digest, the keys the image lacks are skipped.
+func GetFlavorKeys(lookup *config.FlavorLookupConfig, imageRef, imageID, digest string) []FlavorKey {
+	ref := namedRef(imageRef, imageID)
+	var keys []FlavorKey
+	for _, kind := range lookup.Keys {
+		value := ""
+		switch kind {
+		case config.FlavorKeyImageID:
+			value = imageID
+		case config.FlavorKeyDigest:
+			value = digest
+		case config.FlavorKeyTag:
+			if ref != nil {
+				if tagged, ok := reference.TagNameOnly(ref).(reference.Tagged); ok {
+					value = ref.Name() + ":" + tagged.Tag()
+				}
+			}
+		case config.FlavorKeyRepository:
+			if ref != nil {
+				value = ref.Name()
+			}
+		case config.FlavorKeyRepositoryPattern:
+			if ref != nil {
+				value = lookup.MatchRepository(ref.Name())
+			}
+		}
+		if value != "" {
+			keys = append(keys, newFlavorKey(kind, value))
+		}
+	}
+	return keys
+}
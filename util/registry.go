@@ -6,7 +6,10 @@
 package util
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"github.com/buger/jsonparser"
 	"io/ioutil"
 	"log"
@@ -16,26 +19,68 @@ import (
 )
 
 const (
-	version           = "/v2/"
-	defaultDockerHub  = "https://registry-1.docker.io"
-	dockerHubAuthHead = "https://auth.docker.io/token?scope=repository:"
-	dockerHubAuthTail = ":pull&service=registry.docker.io"
+	version          = "/v2/"
+	defaultDockerHub = "https://registry-1.docker.io"
 )
 
 type requestOptions struct {
 	url       string
 	auth      string
 	headers   map[string]string
-	transport *http.Transport
+	transport http.RoundTripper
 }
 
-// GetDigestFromRegistry to get sha value of an docker image from secure,insecure private and public docker registry...
-func GetDigestFromRegistry(imageRef string) (string, error) {
+// Registry resolves the image config digest of the images not available locally
+type Registry interface {
+	ImageDigest(imageRef string) (string, error)
+}
+
+// RegistryClient queries the docker registries with the credentials of the registry configuration
+type RegistryClient struct {
+	// Config returns the configuration in use, config.Get when nil
+	Config func() *config.Configuration
+	// Transport overrides the transport built from the registry configuration when set
+	Transport http.RoundTripper
+}
+
+// NewRegistryClient returns a registry client configured from the current configuration
+func NewRegistryClient() *RegistryClient {
+	return &RegistryClient{}
+}
+
+// ImageDigest to get sha value of an docker image from secure,insecure private and public docker registry...
+func (registryClient *RegistryClient) ImageDigest(imageRef string) (string, error) {
+	data, err := registryClient.manifest(imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	digest, _, _, err := jsonparser.Get(data, "config", "digest")
+	if err != nil {
+		log.Println("Error in parsing digest from json", err)
+		return "", err
+	}
+
+	return string(digest), nil
+}
+
+// ManifestDigest returns the digest of the manifest the registry serves for an image, the digest docker pulls the
+// image with
+func (registryClient *RegistryClient) ManifestDigest(imageRef string) (string, error) {
+	data, err := registryClient.manifest(imageRef)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// manifest reads the schema 2 manifest of an image from its registry
+func (registryClient *RegistryClient) manifest(imageRef string) ([]byte, error) {
 	var (
 		regAddress string
 		image      string
 		tag        string
-		data       []byte
 		token      string
 		err        error
 	)
@@ -44,19 +89,22 @@ func GetDigestFromRegistry(imageRef string) (string, error) {
 	token = ""
 	regAddress, image, tag, err = GetRegistryAddr(imageRef)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	ev := &config.EnvVariables{}
-	ev.GetEnv()
-	username, password, scheme, skipVerify := ev.Username, ev.Password, ev.SchemeType, ev.SkipVerify
+	getConfig := registryClient.Config
+	if getConfig == nil {
+		getConfig = config.Get
+	}
+	registry := getConfig().Registry
+	username, password, scheme, skipVerify := registry.Username, registry.Password, registry.SchemeType, registry.SkipVerify
 
 	options := requestOptions{}
 
 	//	options.headers = map[string]string{"Accept": "application/vnd.docker.distribution.manifest.v2+json"}
-	token, err = getToken(username, password, image)
+	token, err = getToken(registry.TokenURL, username, password, image, registryClient.Transport)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if regAddress == "docker.io" {
 
@@ -69,25 +117,17 @@ func GetDigestFromRegistry(imageRef string) (string, error) {
 		options.url = scheme + "://" + regAddress + version + image + "/manifests/" + tag
 	}
 	options.headers = map[string]string{"Accept": "application/vnd.docker.distribution.manifest.v2+json", "Authorization": "Bearer " + token}
-	options.transport = transport(skipVerify)
-	data, err = newRequest(options)
-	if err != nil {
-		return "", err
+	options.transport = registryClient.Transport
+	if options.transport == nil {
+		options.transport = transport(skipVerify)
 	}
-
-	digest, _, _, err := jsonparser.Get(data, "config", "digest")
-	if err != nil {
-		log.Println("Error in parsing digest from json", err)
-		return "", err
-	}
-
-	return string(digest), nil
+	return newRequest(options)
 }
 
-func getToken(username, password, image string) (string, error) {
+func getToken(tokenURL, username, password, image string, transport http.RoundTripper) (string, error) {
 
-	options := requestOptions{}
-	options.url = dockerHubAuthHead + image + dockerHubAuthTail
+	options := requestOptions{transport: transport}
+	options.url = fmt.Sprintf(tokenURL, image)
 	if username != "" && password != "" {
 		options.auth = getAuth(username, password)
 	}
@@ -161,6 +201,9 @@ func newRequest(options requestOptions) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("%s returned %s", options.url, response.Status)
+	}
 
 	return data, nil
 }
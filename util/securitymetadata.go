@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package util
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	// SecurityMetaDataVersion is the latest version of the security-meta-data format understood by the plugin.
+	// Version 0 is the original single blob describing the whole image, version 1 adds the per-layer metadata.
+	SecurityMetaDataVersion = 1
+
+	// securityMetaDataKey is the graph-driver data entry holding the security metadata of an image
+	securityMetaDataKey = "security-meta-data"
+)
+
+var (
+	// knownKeyTypes are the key types of the encrypted layers
+	knownKeyTypes = map[string]bool{
+		"key-type-keyrings": true,
+		"key-type-kms":      true,
+	}
+	// knownKeySizes are the key sizes, in bits, of the encrypted layers
+	knownKeySizes = map[string]bool{
+		"128": true,
+		"192": true,
+		"256": true,
+		"512": true,
+	}
+	// cipherName matches the dm-crypt cipher specifications such as aes-xts-plain64 or aes-cbc-essiv:sha256
+	cipherName = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*(:[a-z0-9]+)?$`)
+)
+
+// LayerSecurityMetaData describes the confidentiality and integrity of an image layer, or of the whole image
+/* Sample security meta data JSON:
+{
+	"RequiresConfidentiality": true,
+	"RequiresIntegrity": false,
+	"KeyHandle": "f2c863b9-8fa7-4831-98cd-3cdd82567243",
+	"KeySize": "256",
+	"KeyType": "key-type-keyrings",
+	"CryptCipher": "aes-xts-plain",
+	"KeyFilePath": "/tmp/wrappedKey_f2c863b9-8fa7-4831-98cd-3cdd82567243_694390072",
+	"IsEmptyLayer": false,
+	"IsSecurityTransformed": true
+}
+*/
+type LayerSecurityMetaData struct {
+	// Layer is the digest of the layer, empty for the image wide metadata
+	Layer                   string `json:",omitempty"`
+	RequiresConfidentiality bool
+	RequiresIntegrity       bool
+	KeyHandle               string
+	KeySize                 string
+	KeyType                 string
+	CryptCipher             string
+	KeyFilePath             string
+	IsEmptyLayer            bool
+	IsSecurityTransformed   bool
+}
+
+// encrypted tells whether the layer content is encrypted
+func (layer *LayerSecurityMetaData) encrypted() bool {
+	return layer.RequiresConfidentiality && layer.IsSecurityTransformed && !layer.IsEmptyLayer
+}
+
+// validate checks the key and cipher settings of an encrypted layer
+func (layer *LayerSecurityMetaData) validate() error {
+	if !layer.encrypted() {
+		return nil
+	}
+	if layer.KeyHandle == "" {
+		return errors.New("encrypted layer has no KeyHandle")
+	}
+	if !knownKeyTypes[layer.KeyType] {
+		return errors.Errorf("unknown KeyType %q", layer.KeyType)
+	}
+	if !knownKeySizes[layer.KeySize] {
+		return errors.Errorf("unsupported KeySize %q", layer.KeySize)
+	}
+	if !cipherName.MatchString(layer.CryptCipher) {
+		return errors.Errorf("invalid CryptCipher %q", layer.CryptCipher)
+	}
+	return nil
+}
+
+// SecurityMetaData is the security metadata of an image, read from its graph-driver data.
+// The image wide fields are derived from the layers when the metadata only describes the layers.
+type SecurityMetaData struct {
+	Version int
+	LayerSecurityMetaData
+	Layers []LayerSecurityMetaData `json:",omitempty"`
+}
+
+// Ciphers returns the distinct ciphers of the encrypted layers, or of the image when it has no layer metadata
+func (metaData *SecurityMetaData) Ciphers() []string {
+	layers := metaData.Layers
+	if len(layers) == 0 {
+		layers = []LayerSecurityMetaData{metaData.LayerSecurityMetaData}
+	}
+	var ciphers []string
+	seen := make(map[string]bool)
+	for i := range layers {
+		if layers[i].encrypted() && !seen[layers[i].CryptCipher] {
+			seen[layers[i].CryptCipher] = true
+			ciphers = append(ciphers, layers[i].CryptCipher)
+		}
+	}
+	return ciphers
+}
+
+// summarize merges the layers into the image wide fields: the image requires confidentiality or integrity when it
+// says so or a layer does, and is transformed when it says so or all its non empty layers requiring
+// confidentiality are
+func (metaData *SecurityMetaData) summarize() {
+	confidential, transformed := false, true
+	for i := range metaData.Layers {
+		layer := &metaData.Layers[i]
+		metaData.RequiresIntegrity = metaData.RequiresIntegrity || layer.RequiresIntegrity
+		if !layer.RequiresConfidentiality || layer.IsEmptyLayer {
+			continue
+		}
+		confidential = true
+		transformed = transformed && layer.IsSecurityTransformed
+		if metaData.CryptCipher == "" {
+			metaData.KeyHandle = layer.KeyHandle
+			metaData.KeySize = layer.KeySize
+			metaData.KeyType = layer.KeyType
+			metaData.CryptCipher = layer.CryptCipher
+		}
+	}
+	metaData.RequiresConfidentiality = metaData.RequiresConfidentiality || confidential
+	metaData.IsSecurityTransformed = metaData.IsSecurityTransformed || confidential && transformed
+}
+
+// ParseSecurityMetaData parses the security-meta-data graph-driver entry of an image. The entry is either a
+// metadata object, possibly encoded as a JSON string, or the list of the layer metadata.
+func ParseSecurityMetaData(data string) (*SecurityMetaData, error) {
+	data = strings.TrimSpace(data)
+	// Some graph drivers store the metadata object as a JSON string
+	if strings.HasPrefix(data, `"`) {
+		var decoded string
+		if err := json.Unmarshal([]byte(data), &decoded); err != nil {
+			return nil, errors.Wrap(err, "security metadata is not a valid JSON string")
+		}
+		data = strings.TrimSpace(decoded)
+	}
+
+	var metaData SecurityMetaData
+	switch {
+	case strings.HasPrefix(data, "["):
+		if err := json.Unmarshal([]byte(data), &metaData.Layers); err != nil {
+			return nil, errors.Wrap(err, "security metadata is not a valid list of layers")
+		}
+		metaData.Version = SecurityMetaDataVersion
+	case strings.HasPrefix(data, "{"):
+		if err := json.Unmarshal([]byte(data), &metaData); err != nil {
+			return nil, errors.Wrap(err, "security metadata is not a valid object")
+		}
+	default:
+		return nil, errors.New("security metadata is neither an object nor a list of layers")
+	}
+
+	if metaData.Version < 0 || metaData.Version > SecurityMetaDataVersion {
+		return nil, errors.Errorf("unsupported security metadata version %d, the latest supported is %d",
+			metaData.Version, SecurityMetaDataVersion)
+	}
+	if metaData.Version == 0 && len(metaData.Layers) > 0 {
+		return nil, errors.New("security metadata version 0 does not support per-layer metadata")
+	}
+	if len(metaData.Layers) > 0 {
+		metaData.summarize()
+	}
+
+	if err := metaData.LayerSecurityMetaData.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid image security metadata")
+	}
+	for i := range metaData.Layers {
+		if err := metaData.Layers[i].validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid security metadata for layer %d %s", i, metaData.Layers[i].Layer)
+		}
+	}
+	return &metaData, nil
+}
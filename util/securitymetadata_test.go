@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	encryptedLayer = `{"Layer": "sha256:a1", "RequiresConfidentiality": true, "IsSecurityTransformed": true,
+		"KeyHandle": "f2c863b9", "KeySize": "256", "KeyType": "key-type-keyrings", "CryptCipher": "aes-xts-plain64"}`
+	plainLayer  = `{"Layer": "sha256:b2", "RequiresConfidentiality": true, "IsSecurityTransformed": false}`
+	emptyLayer  = `{"Layer": "sha256:c3", "RequiresConfidentiality": true, "IsEmptyLayer": true}`
+	signedLayer = `{"Layer": "sha256:d4", "RequiresIntegrity": true}`
+)
+
+func TestParseSecurityMetaData(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		confidential bool
+		integrity    bool
+		transformed  bool
+		cipher       string
+		err          string
+	}{
+		{name: "image object", data: `{"RequiresConfidentiality": true, "IsSecurityTransformed": true,
+			"KeyHandle": "f2c863b9", "KeySize": "256", "KeyType": "key-type-kms", "CryptCipher": "aes-cbc-essiv:sha256"}`,
+			confidential: true, transformed: true, cipher: "aes-cbc-essiv:sha256"},
+		{name: "JSON string", data: `"{\"RequiresIntegrity\": true}"`, integrity: true},
+		{name: "layers", data: "[" + encryptedLayer + "," + emptyLayer + "," + signedLayer + "]",
+			confidential: true, integrity: true, transformed: true, cipher: "aes-xts-plain64"},
+		{name: "layer not transformed", data: "[" + encryptedLayer + "," + plainLayer + "]", confidential: true,
+			cipher: "aes-xts-plain64"},
+		{name: "unencrypted layers", data: "[" + signedLayer + "]", integrity: true},
+		{name: "transformed image with layers", data: `{"Version": 1, "RequiresConfidentiality": true,
+			"IsSecurityTransformed": true, "KeyHandle": "f2c863b9", "KeySize": "256", "KeyType": "key-type-kms",
+			"CryptCipher": "aes-xts-plain64", "Layers": [` + plainLayer + "]}", confidential: true, transformed: true,
+			cipher: "aes-xts-plain64"},
+		{name: "confidential image with transformed layers", data: `{"Version": 1, "RequiresConfidentiality": true,
+			"Layers": [` + encryptedLayer + "]}", confidential: true, transformed: true, cipher: "aes-xts-plain64"},
+		{name: "future version", data: `{"Version": 2}`, err: "unsupported security metadata version"},
+		{name: "layers in version 0", data: `{"Layers": [` + signedLayer + "]}", err: "does not support per-layer"},
+		{name: "unknown key type", data: `[{"RequiresConfidentiality": true, "IsSecurityTransformed": true,
+			"KeyHandle": "f2c863b9", "KeySize": "256", "KeyType": "key-type-tpm", "CryptCipher": "aes-xts-plain64"}]`,
+			err: "unknown KeyType"},
+		{name: "not JSON", data: "encrypted", err: "neither an object nor a list"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metaData, err := ParseSecurityMetaData(test.data)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("ParseSecurityMetaData returned %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metaData.RequiresConfidentiality != test.confidential || metaData.RequiresIntegrity != test.integrity ||
+				metaData.IsSecurityTransformed != test.transformed || metaData.CryptCipher != test.cipher {
+				t.Errorf("ParseSecurityMetaData = confidentiality %v, integrity %v, transformed %v, cipher %q, "+
+					"want %v, %v, %v, %q", metaData.RequiresConfidentiality, metaData.RequiresIntegrity,
+					metaData.IsSecurityTransformed, metaData.CryptCipher, test.confidential, test.integrity,
+					test.transformed, test.cipher)
+			}
+		})
+	}
+}
+
+func TestCiphers(t *testing.T) {
+	metaData, err := ParseSecurityMetaData("[" + encryptedLayer + "," + encryptedLayer + "," + plainLayer + "]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ciphers := metaData.Ciphers(); len(ciphers) != 1 || ciphers[0] != "aes-xts-plain64" {
+		t.Errorf("Ciphers() = %v, want [aes-xts-plain64]", ciphers)
+	}
+}
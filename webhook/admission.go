@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+)
+
+// The AdmissionReview types of the admission.k8s.io API groups v1 and v1beta1, which share the same fields. Only the
+// fields read or written by the webhook are defined.
+
+// AdmissionReview is the request sent by the API server to the webhook and the response returned to it
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+// GroupVersionKind names the kind of the object admitted
+type GroupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+// AdmissionRequest describes the operation on an object to admit
+type AdmissionRequest struct {
+	UID         string           `json:"uid"`
+	Kind        GroupVersionKind `json:"kind"`
+	SubResource string           `json:"subResource,omitempty"`
+	Name        string           `json:"name,omitempty"`
+	Namespace   string           `json:"namespace,omitempty"`
+	Operation   string           `json:"operation"`
+	Object      json.RawMessage  `json:"object,omitempty"`
+	DryRun      *bool            `json:"dryRun,omitempty"`
+}
+
+// AdmissionResponse is the decision on an admission request
+type AdmissionResponse struct {
+	UID     string  `json:"uid"`
+	Allowed bool    `json:"allowed"`
+	Result  *Status `json:"status,omitempty"`
+	// Warnings are shown to the API clients, for the pods allowed by the audit mode
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Status is the reason of a denial
+type Status struct {
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Code    int32  `json:"code,omitempty"`
+}
+
+// Container is a container of a pod
+type Container struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// Pod is the part of a pod read by the webhook
+type Pod struct {
+	Metadata struct {
+		Name         string `json:"name,omitempty"`
+		GenerateName string `json:"generateName,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		InitContainers      []Container `json:"initContainers,omitempty"`
+		Containers          []Container `json:"containers"`
+		EphemeralContainers []Container `json:"ephemeralContainers,omitempty"`
+	} `json:"spec"`
+}
+
+// containers returns the init, regular and ephemeral containers of the pod
+func (pod *Pod) containers() []Container {
+	var containers []Container
+	containers = append(containers, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	return append(containers, pod.Spec.EphemeralContainers...)
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package webhook is the Kubernetes validating admission webhook adapter of the decision engine. It denies the pods
+// with a container image the docker plugin would deny, so they are rejected by the API server instead of failing to
+// be created by the kubelet.
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net/http"
+	"secure-docker-plugin/v3/plugin"
+	"strings"
+)
+
+const (
+	// ValidateURI is the path the admission reviews are served on
+	ValidateURI = "/validate"
+
+	// maxReviewSize bounds the admission reviews read, the API server limits the objects to a few megabytes
+	maxReviewSize = 8 << 20
+)
+
+// Webhook admits the pods whose container images are all allowed by the engine
+type Webhook struct {
+	engine *plugin.Engine
+}
+
+// New returns a webhook deciding with engine
+func New(engine *plugin.Engine) *Webhook {
+	return &Webhook{engine: engine}
+}
+
+// Review decides on the request of an admission review and returns the review with the response. Only the pods
+// created or updated are verified, the other requests are allowed.
+func (webhook *Webhook) Review(review AdmissionReview) (AdmissionReview, error) {
+	req := review.Request
+	if req == nil {
+		return review, errors.New("Admission review has no request")
+	}
+	review.Request = nil
+	review.Response = &AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Kind.Group != "" || req.Kind.Kind != "Pod" || (req.Operation != "CREATE" && req.Operation != "UPDATE") {
+		return review, nil
+	}
+
+	var pod Pod
+	if err := json.Unmarshal(req.Object, &pod); err != nil {
+		review.Response.Allowed = false
+		review.Response.Result = &Status{Status: "Failure", Reason: "BadRequest", Code: http.StatusBadRequest,
+			Message: "secure-docker-plugin: invalid pod: " + err.Error()}
+		return review, nil
+	}
+	name := pod.Metadata.Name
+	if name == "" {
+		name = pod.Metadata.GenerateName
+	}
+
+	// The dry runs are decided without side effects, as declared by sideEffects: NoneOnDryRun
+	dryRun := req.DryRun != nil && *req.DryRun
+	redact := webhook.engine.Config().Policy.RedactDenialDetails
+	decisions := make(map[string]plugin.Decision)
+	var denials []string
+	for _, container := range pod.containers() {
+		decision, ok := decisions[container.Image]
+		if !ok {
+			decision = webhook.engine.AdmitRemote(container.Image, dryRun)
+			decisions[container.Image] = decision
+		}
+		switch {
+		case !decision.Allow:
+			denials = append(denials, "container "+container.Name+": "+decision.Detail(redact))
+		case decision.Audited:
+			review.Response.Warnings = append(review.Response.Warnings, "secure-docker-plugin: container "+
+				container.Name+" would be denied: "+decision.Detail(redact))
+		}
+	}
+	if len(denials) > 0 {
+		log.Printf("Pod %s/%s denied", req.Namespace, name)
+		review.Response.Allowed = false
+		review.Response.Result = &Status{Status: "Failure", Reason: "Forbidden", Code: http.StatusForbidden,
+			Message: "secure-docker-plugin: pod " + name + " denied: " + strings.Join(denials, "; ")}
+	}
+	return review, nil
+}
+
+// ServeHTTP answers the admission reviews posted by the API server
+func (webhook *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var review AdmissionReview
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxReviewSize)).Decode(&review); err != nil {
+		http.Error(w, "invalid admission review: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	review, err := webhook.Review(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(review); err != nil {
+		log.Println("Error writing the admission review response: ", err)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package wla
+
+import (
+	"encoding/json"
+	"log"
+
+	"intel/isecl/lib/flavor/v3"
+)
+
+// Flavor is an image flavor as sent by the workload agent
+type Flavor struct {
+	flavor.Image
+	// Raw is the flavor JSON as received, the signature is computed over it
+	Raw json.RawMessage `json:"raw,omitempty"`
+	// Signature is the base64 signature of the flavor by the Workload Service, empty for an unsigned flavor
+	Signature string `json:"signature,omitempty"`
+}
+
+// signedFlavor is the format of the flavors signed by the Workload Service
+type signedFlavor struct {
+	Flavor    json.RawMessage `json:"flavor"`
+	Signature string          `json:"signature"`
+}
+
+// parseFlavor reads a signed or unsigned flavor
+func parseFlavor(data []byte) (Flavor, error) {
+	var flvr Flavor
+	var signed signedFlavor
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return flvr, err
+	}
+	flvr.Raw = data
+	if signed.Flavor != nil {
+		flvr.Raw = signed.Flavor
+		flvr.Signature = signed.Signature
+	}
+	return flvr, json.Unmarshal(flvr.Raw, &flvr.Image)
+}
+
+// Agent is the workload agent RPC interface used by the plugin
+type Agent interface {
+	// FetchFlavor returns the flavor of an image, a NotFound error when the image has no flavor
+	FetchFlavor(imageUUID string) (Flavor, error)
+	// FetchKey returns the key of an encrypted image
+	FetchKey(keyURL string) ([]byte, error)
+	// CreateInstanceTrustReport creates the trust report of a started container
+	CreateInstanceTrustReport(manifest string) error
+}
+
+// FetchFlavor returns the flavor of an image, a NotFound error when the image has no flavor
+func (wlac *Client) FetchFlavor(imageUUID string) (Flavor, error) {
+	var flvr Flavor
+
+	log.Printf("Fetching flavor for image id %s", imageUUID)
+
+	var outFlavor OutFlavor
+	var args = FlavorInfo{
+		ImageID: imageUUID,
+	}
+	if err := wlac.Call(MethodFetchFlavor, &args, &outFlavor); err != nil {
+		log.Printf("Unable to fetch image flavor from the workload agent - %v", err)
+		return flvr, newCallError(MethodFetchFlavor, err)
+	}
+	if len(outFlavor.ImageFlavor) == 0 {
+		log.Printf("There is no flavor for given image id %s", imageUUID)
+		return flvr, &Error{Kind: NotFound, Method: MethodFetchFlavor}
+	}
+	flvr, err := parseFlavor([]byte(outFlavor.ImageFlavor))
+	if err != nil {
+		log.Printf("Unable to unmarshal image flavor - %v", err)
+		return flvr, &Error{Kind: Malformed, Method: MethodFetchFlavor, Err: err}
+	}
+	if flvr.Meta.ID == "" {
+		log.Printf("Flavor of image id %s has no ID", imageUUID)
+		return flvr, &Error{Kind: NotFound, Method: MethodFetchFlavor}
+	}
+	return flvr, nil
+}
+
+// FetchKey returns the key of an encrypted image
+func (wlac *Client) FetchKey(keyURL string) ([]byte, error) {
+	log.Printf("Fetching key %s", keyURL)
+
+	var keyInfo KeyInfo
+	var args = KeyInfo{
+		KeyUrl: keyURL,
+	}
+	if err := wlac.Call(MethodFetchKeyWithURL, &args, &keyInfo); err != nil {
+		log.Printf("Unable to fetch key from the workload agent - %v", err)
+		return nil, newCallError(MethodFetchKeyWithURL, err)
+	}
+	if !keyInfo.ReturnCode || len(keyInfo.Key) == 0 {
+		return nil, &Error{Kind: NotFound, Method: MethodFetchKeyWithURL}
+	}
+	return keyInfo.Key, nil
+}
+
+// CreateInstanceTrustReport creates the trust report of a started container
+func (wlac *Client) CreateInstanceTrustReport(manifest string) error {
+	var status bool
+	var args = ManifestString{
+		Manifest: manifest,
+	}
+	return newCallError(MethodCreateInstanceTrustReport, wlac.Call(MethodCreateInstanceTrustReport, &args, &status))
+}
@@ -0,0 +1,346 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package wla is the client of the workload agent RPC service listening on a unix socket.
+// The service has no version method: the client calls the methods of Agent, which every workload agent serves,
+// and a workload agent failing a call is told apart from a broken connection by the rpc.ServerError type.
+package wla
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Connection states of the client
+const (
+	// StateNotInstalled means the workload agent socket does not exist
+	StateNotInstalled = "not-installed"
+	StateDisconnected = "disconnected"
+	StateConnected    = "connected"
+)
+
+// connectDelay is the delay between the dial attempts of Connect
+const connectDelay = 500 * time.Millisecond
+
+var (
+	// ErrNotInstalled is returned by the calls made while the workload agent socket does not exist
+	ErrNotInstalled = errors.New("workload agent is not installed")
+	// ErrTimeout is returned by the calls the workload agent did not answer within the call timeout
+	ErrTimeout = errors.New("workload agent call timed out")
+)
+
+// Status is the connection state of the client, for health checks
+type Status struct {
+	Socket    string `json:"socket"`
+	State     string `json:"state"`
+	Since     string `json:"since,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Client calls the workload agent. A broken connection is detected on the failing call, dropped and
+// re-established in the background with a delay doubling from minDelay up to maxDelay.
+type Client struct {
+	mtx         sync.Mutex
+	socket      string
+	dialTimeout time.Duration
+	callTimeout time.Duration
+	minDelay    time.Duration
+	maxDelay    time.Duration
+	client      *rpc.Client
+	state       string
+	since       time.Time
+	lastErr     error
+	onConnect   func()
+	reconnect   chan struct{}
+	// dialing is closed when the connection attempt in progress completes, with the error dialErr. The attempt
+	// runs without the client lock, it is discarded when the connection was dropped meanwhile, which changes
+	// generation.
+	dialing    chan struct{}
+	dialErr    error
+	generation int
+}
+
+// NewClient creates a client of the workload agent listening on socket
+func NewClient(socket string, dialTimeout, callTimeout, minDelay, maxDelay time.Duration) *Client {
+	return &Client{
+		socket:      socket,
+		dialTimeout: dialTimeout,
+		callTimeout: callTimeout,
+		minDelay:    minDelay,
+		maxDelay:    maxDelay,
+		state:       StateDisconnected,
+		since:       time.Now(),
+		reconnect:   make(chan struct{}, 1),
+	}
+}
+
+// OnConnect sets a function called every time a connection is established
+func (wlac *Client) OnConnect(onConnect func()) {
+	wlac.mtx.Lock()
+	defer wlac.mtx.Unlock()
+	wlac.onConnect = onConnect
+}
+
+// Reconfigure changes the socket and the timeouts, the connection is dropped when the socket changed
+func (wlac *Client) Reconfigure(socket string, dialTimeout, callTimeout time.Duration) {
+	wlac.mtx.Lock()
+	defer wlac.mtx.Unlock()
+	wlac.dialTimeout = dialTimeout
+	wlac.callTimeout = callTimeout
+	if wlac.socket == socket {
+		return
+	}
+	log.Printf("WLA socket changed from %s to %s", wlac.socket, socket)
+	wlac.socket = socket
+	wlac.dropLocked(nil)
+}
+
+// Installed tells whether the workload agent socket exists
+func (wlac *Client) Installed() bool {
+	wlac.mtx.Lock()
+	socket := wlac.socket
+	wlac.mtx.Unlock()
+	_, err := os.Stat(socket)
+	return err == nil
+}
+
+// Status returns the connection state
+func (wlac *Client) Status() Status {
+	installed := wlac.Installed()
+	wlac.mtx.Lock()
+	defer wlac.mtx.Unlock()
+	status := Status{Socket: wlac.socket, State: wlac.state, Since: wlac.since.UTC().Format(time.RFC3339)}
+	if !installed && wlac.client == nil {
+		status.State = StateNotInstalled
+	}
+	if wlac.lastErr != nil {
+		status.LastError = wlac.lastErr.Error()
+	}
+	return status
+}
+
+// Connected tells whether a connection to the workload agent is established
+func (wlac *Client) Connected() bool {
+	wlac.mtx.Lock()
+	defer wlac.mtx.Unlock()
+	return wlac.client != nil
+}
+
+// Connect establishes the connection when there is none, trying for up to timeout.
+// ErrNotInstalled is returned when the workload agent socket does not exist.
+func (wlac *Client) Connect(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		err := wlac.connect()
+		if err == nil || err == ErrNotInstalled || !time.Now().Add(connectDelay).Before(deadline) {
+			return err
+		}
+		log.Printf("Attempt %d to connect to the WLA failed: %v", attempt, err)
+		time.Sleep(connectDelay)
+	}
+}
+
+// connect dials the workload agent once when there is no connection. Concurrent callers wait for the attempt in
+// progress, which does not hold the client lock so the status and the other calls are not blocked by a slow agent.
+func (wlac *Client) connect() error {
+	wlac.mtx.Lock()
+	if wlac.client != nil {
+		wlac.mtx.Unlock()
+		return nil
+	}
+	if dialing := wlac.dialing; dialing != nil {
+		wlac.mtx.Unlock()
+		<-dialing
+		wlac.mtx.Lock()
+		defer wlac.mtx.Unlock()
+		if wlac.client != nil {
+			return nil
+		}
+		return wlac.dialErr
+	}
+	socket, dialTimeout, generation := wlac.socket, wlac.dialTimeout, wlac.generation
+	if _, err := os.Stat(socket); err != nil {
+		wlac.mtx.Unlock()
+		return ErrNotInstalled
+	}
+	dialing := make(chan struct{})
+	wlac.dialing = dialing
+	wlac.mtx.Unlock()
+
+	client, err := dial(socket, dialTimeout)
+
+	wlac.mtx.Lock()
+	wlac.dialing = nil
+	if err == nil && wlac.generation != generation {
+		client.Close()
+		err = errors.Errorf("Connection to the WLA on %s dropped while connecting", socket)
+	}
+	wlac.dialErr = err
+	close(dialing)
+	if err != nil {
+		wlac.lastErr = err
+		wlac.mtx.Unlock()
+		return err
+	}
+	wlac.client = client
+	wlac.state = StateConnected
+	wlac.since = time.Now()
+	onConnect := wlac.onConnect
+	wlac.mtx.Unlock()
+
+	log.Printf("Connected to the WLA on %s", socket)
+	if onConnect != nil {
+		onConnect()
+	}
+	return nil
+}
+
+// dialUnix connects to a unix socket, replaced by the tests simulating a slow workload agent
+var dialUnix = net.DialTimeout
+
+// dial connects to the workload agent
+func dial(socket string, dialTimeout time.Duration) (*rpc.Client, error) {
+	conn, err := dialUnix("unix", socket, dialTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to the WLA on %s", socket)
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// callWithTimeout invokes a method, giving up after timeout
+func callWithTimeout(client *rpc.Client, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return errors.Wrapf(ErrTimeout, "%s did not answer within %v", serviceMethod, timeout)
+	}
+}
+
+// Call invokes a workload agent method, connecting first when needed. Errors returned by the workload agent
+// are rpc.ServerError values, any other error means the call did not reach it or its answer was lost.
+func (wlac *Client) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	if err := wlac.connect(); err != nil {
+		if err != ErrNotInstalled {
+			wlac.scheduleReconnect()
+		}
+		return err
+	}
+
+	wlac.mtx.Lock()
+	client := wlac.client
+	callTimeout := wlac.callTimeout
+	wlac.mtx.Unlock()
+	if client == nil {
+		return rpc.ErrShutdown
+	}
+
+	err := callWithTimeout(client, serviceMethod, args, reply, callTimeout)
+	// After a timeout the answer can no longer be matched with the call, start over with a new connection
+	if IsConnectionError(err) {
+		wlac.drop(client, err)
+	}
+	return err
+}
+
+// drop closes a broken connection unless it was already replaced, and schedules a reconnection
+func (wlac *Client) drop(client *rpc.Client, cause error) {
+	wlac.mtx.Lock()
+	defer wlac.mtx.Unlock()
+	if wlac.client != client {
+		return
+	}
+	log.Printf("Connection to the WLA lost: %v", cause)
+	wlac.dropLocked(cause)
+	wlac.scheduleReconnect()
+}
+
+// dropLocked closes the connection, and discards the connection attempt in progress, the caller holds the client lock
+func (wlac *Client) dropLocked(cause error) {
+	wlac.generation++
+	if wlac.client != nil {
+		wlac.client.Close()
+		wlac.client = nil
+		wlac.since = time.Now()
+	}
+	wlac.state = StateDisconnected
+	if cause != nil {
+		wlac.lastErr = cause
+	}
+}
+
+func (wlac *Client) scheduleReconnect() {
+	select {
+	case wlac.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes the connection
+func (wlac *Client) Close() {
+	wlac.mtx.Lock()
+	defer wlac.mtx.Unlock()
+	wlac.dropLocked(nil)
+}
+
+// Run re-establishes the lost connections in the background until stop is closed
+func (wlac *Client) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-wlac.reconnect:
+		}
+
+		delay := wlac.minDelay
+		for {
+			err := wlac.connect()
+			if err == nil || err == ErrNotInstalled {
+				break
+			}
+			log.Printf("Reconnecting to the WLA in %v: %v", delay, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > wlac.maxDelay {
+				delay = wlac.maxDelay
+			}
+		}
+	}
+}
+
+// IsConnectionError tells whether an error means the connection to the workload agent is broken
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		return false
+	}
+	cause := errors.Cause(err)
+	if cause == rpc.ErrShutdown || cause == io.EOF || cause == io.ErrUnexpectedEOF ||
+		cause == syscall.EPIPE || cause == syscall.ECONNRESET || cause == ErrTimeout {
+		return true
+	}
+	if opErr, ok := cause.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.EPIPE || sysErr.Err == syscall.ECONNRESET || sysErr.Err == syscall.ECONNREFUSED
+		}
+		return true
+	}
+	return false
+}
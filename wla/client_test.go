@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package wla_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"secure-docker-plugin/v3/wla"
+	"secure-docker-plugin/v3/wla/fake"
+	"testing"
+	"time"
+)
+
+// listen serves a fake workload agent on a socket of a temporary directory
+func listen(t *testing.T, opts fake.Options) (*fake.Server, func()) {
+	dir, err := ioutil.TempDir("", "sdp-wla")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := fake.Listen(filepath.Join(dir, "wlagent.sock"), opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return server, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	server, cleanup := listen(t, fake.Options{})
+	defer cleanup()
+	client := wla.NewClient(server.Addr(), time.Second, time.Second, time.Second, time.Second)
+	defer client.Close()
+	if err := client.Connect(0); err != nil {
+		t.Fatal(err)
+	}
+	if state := client.Status().State; state != wla.StateConnected {
+		t.Errorf("State = %s, want %s", state, wla.StateConnected)
+	}
+	if calls := server.Calls(wla.MethodFetchFlavor); calls != 0 {
+		t.Errorf("%d calls made by Connect, want none", calls)
+	}
+}
+
+func TestConnectNotInstalled(t *testing.T) {
+	client := wla.NewClient("/nonexistent/wlagent.sock", time.Second, time.Second, time.Second, time.Second)
+	if err := client.Connect(0); err != wla.ErrNotInstalled {
+		t.Errorf("Connect returned %v, want ErrNotInstalled", err)
+	}
+	if state := client.Status().State; state != wla.StateNotInstalled {
+		t.Errorf("State = %s, want %s", state, wla.StateNotInstalled)
+	}
+}
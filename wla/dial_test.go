@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package wla
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowAgent listens on a socket of a temporary directory, the connections to it taking latency to establish
+func slowAgent(t *testing.T, latency time.Duration) (string, *int32, func()) {
+	dir, err := ioutil.TempDir("", "sdp-wla")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "wlagent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := listener.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var dials int32
+	dialUnix = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		time.Sleep(latency)
+		return net.DialTimeout(network, address, timeout)
+	}
+	return socket, &dials, func() {
+		dialUnix = net.DialTimeout
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSlowConnectionDoesNotBlock(t *testing.T) {
+	const latency = time.Second
+	socket, dials, cleanup := slowAgent(t, latency)
+	defer cleanup()
+	client := NewClient(socket, 5*time.Second, time.Second, time.Second, time.Second)
+	defer client.Close()
+
+	// Concurrent callers share the connection attempt in progress
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- client.Connect(0)
+		}()
+	}
+	time.Sleep(latency / 4)
+	start := time.Now()
+	if state := client.Status().State; state != StateDisconnected {
+		t.Errorf("State = %s while connecting, want %s", state, StateDisconnected)
+	}
+	if elapsed := time.Since(start); elapsed > latency/2 {
+		t.Errorf("Status blocked %v by the connection attempt", elapsed)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Connect returned %v", err)
+		}
+	}
+	if count := atomic.LoadInt32(dials); count != 1 {
+		t.Errorf("%d connection attempts, want 1", count)
+	}
+}
+
+func TestCloseDiscardsTheConnectionInProgress(t *testing.T) {
+	const latency = 500 * time.Millisecond
+	socket, _, cleanup := slowAgent(t, latency)
+	defer cleanup()
+	client := NewClient(socket, 5*time.Second, time.Second, time.Second, time.Second)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.Connect(0)
+	}()
+	time.Sleep(latency / 4)
+	client.Close()
+	if err := <-errs; err == nil {
+		t.Error("Connection established after the client was closed")
+	}
+	if client.Connected() {
+		t.Error("Client connected after it was closed")
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package wla
+
+import (
+	"github.com/pkg/errors"
+	"net/rpc"
+)
+
+// Kinds of workload agent errors
+const (
+	// NotFound means the workload agent has nothing for the request, such as an image without flavor
+	NotFound = "not-found"
+	// Transport means the call did not reach the workload agent or its answer was lost
+	Transport = "transport"
+	// Malformed means the workload agent answered with data that could not be decoded
+	Malformed = "malformed"
+	// Rejected means the workload agent received the call and failed it
+	Rejected = "rejected"
+)
+
+// Error is a failed workload agent call
+type Error struct {
+	Kind   string
+	Method string
+	Err    error
+}
+
+func (err *Error) Error() string {
+	if err.Kind == NotFound {
+		return err.Method + ": not found"
+	}
+	return err.Method + ": " + err.Kind + ": " + err.Err.Error()
+}
+
+// Cause returns the underlying error, rpc.ServerError for rejected calls
+func (err *Error) Cause() error {
+	return err.Err
+}
+
+// newCallError classifies the error of a call
+func newCallError(method string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	kind := Transport
+	if _, ok := err.(rpc.ServerError); ok {
+		kind = Rejected
+	}
+	return &Error{Kind: kind, Method: method, Err: err}
+}
+
+// kindOf returns the kind of a workload agent error, empty for other errors
+func kindOf(err error) string {
+	if wlaErr, ok := err.(*Error); ok {
+		return wlaErr.Kind
+	}
+	if wlaErr, ok := errors.Cause(err).(*Error); ok {
+		return wlaErr.Kind
+	}
+	return ""
+}
+
+// IsNotFound tells whether the workload agent has nothing for the request
+func IsNotFound(err error) bool {
+	return kindOf(err) == NotFound
+}
+
+// IsTransport tells whether the call did not reach the workload agent or its answer was lost
+func IsTransport(err error) bool {
+	return kindOf(err) == Transport
+}
+
+// IsMalformed tells whether the workload agent answer could not be decoded
+func IsMalformed(err error) bool {
+	return kindOf(err) == Malformed
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package fake is a workload agent simulator serving the workload agent RPC interface on a unix socket,
+// for development and integration tests without an ISecL workload agent.
+package fake
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"regexp"
+	"secure-docker-plugin/v3/wla"
+	"sync"
+	"time"
+)
+
+// ErrInjected is the error returned by the calls failed on purpose
+var ErrInjected = errors.New("fake workload agent: injected failure")
+
+// imageUUIDPattern keeps the flavor lookups inside the flavor directory
+var imageUUIDPattern = regexp.MustCompile(`^[a-fA-F0-9-]{1,64}$`)
+
+// Options configures the simulator
+type Options struct {
+	// FlavorDir holds the image flavors, one JSON file per image named <image UUID>.json
+	FlavorDir string
+	// ManifestDir receives a copy of every received manifest when not empty
+	ManifestDir string
+	// Key is returned by FetchKeyWithURL for every key URL, no key is available when empty
+	Key []byte
+	// Latency delays every call
+	Latency time.Duration
+	// FailureRate is the probability, between 0 and 1, that a call fails with ErrInjected
+	FailureRate float64
+	// FailMethods restricts the injected failures to these methods, all methods fail when empty
+	FailMethods []string
+}
+
+// Agent is the state of the simulator: its options and the requests it received
+type Agent struct {
+	opts      Options
+	mtx       sync.Mutex
+	random    *rand.Rand
+	manifests []string
+	calls     map[string]int
+}
+
+// NewAgent creates a simulator
+func NewAgent(opts Options) *Agent {
+	return &Agent{
+		opts:   opts,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+		calls:  make(map[string]int),
+	}
+}
+
+// SetLatency changes the delay of the calls
+func (agent *Agent) SetLatency(latency time.Duration) {
+	agent.mtx.Lock()
+	defer agent.mtx.Unlock()
+	agent.opts.Latency = latency
+}
+
+// SetFailures changes the failure injection, see Options
+func (agent *Agent) SetFailures(rate float64, methods ...string) {
+	agent.mtx.Lock()
+	defer agent.mtx.Unlock()
+	agent.opts.FailureRate = rate
+	agent.opts.FailMethods = methods
+}
+
+// Manifests returns the manifests received by CreateInstanceTrustReport, oldest first
+func (agent *Agent) Manifests() []string {
+	agent.mtx.Lock()
+	defer agent.mtx.Unlock()
+	return append([]string(nil), agent.manifests...)
+}
+
+// Calls returns the number of calls received for a method, including the failed ones
+func (agent *Agent) Calls(method string) int {
+	agent.mtx.Lock()
+	defer agent.mtx.Unlock()
+	return agent.calls[method]
+}
+
+// call counts a call, applies the latency and tells whether it must fail
+func (agent *Agent) call(method string) error {
+	agent.mtx.Lock()
+	agent.calls[method]++
+	latency := agent.opts.Latency
+	fail := agent.opts.FailureRate > 0 && agent.random.Float64() < agent.opts.FailureRate
+	if fail && len(agent.opts.FailMethods) > 0 {
+		fail = false
+		for _, failMethod := range agent.opts.FailMethods {
+			fail = fail || failMethod == method
+		}
+	}
+	agent.mtx.Unlock()
+
+	time.Sleep(latency)
+	if fail {
+		log.Printf("Injected failure for %s", method)
+		return ErrInjected
+	}
+	return nil
+}
+
+func (agent *Agent) fetchFlavor(args *wla.FlavorInfo, reply *wla.OutFlavor) error {
+	if err := agent.call(wla.MethodFetchFlavor); err != nil {
+		return err
+	}
+	if !imageUUIDPattern.MatchString(args.ImageID) {
+		return errors.Errorf("invalid image id %q", args.ImageID)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(agent.opts.FlavorDir, args.ImageID+".json"))
+	if os.IsNotExist(err) {
+		log.Printf("No flavor for image %s", args.ImageID)
+		reply.ReturnCode = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Returning flavor for image %s", args.ImageID)
+	reply.ReturnCode = true
+	reply.ImageFlavor = string(data)
+	return nil
+}
+
+func (agent *Agent) fetchKeyWithURL(args *wla.KeyInfo, reply *wla.KeyInfo) error {
+	if err := agent.call(wla.MethodFetchKeyWithURL); err != nil {
+		return err
+	}
+	reply.KeyUrl = args.KeyUrl
+	reply.ReturnCode = len(agent.opts.Key) > 0
+	reply.Key = agent.opts.Key
+	return nil
+}
+
+func (agent *Agent) createInstanceTrustReport(args *wla.ManifestString, reply *bool) error {
+	if err := agent.call(wla.MethodCreateInstanceTrustReport); err != nil {
+		return err
+	}
+	if !json.Valid([]byte(args.Manifest)) {
+		return errors.New("manifest is not valid JSON")
+	}
+
+	agent.mtx.Lock()
+	agent.manifests = append(agent.manifests, args.Manifest)
+	count := len(agent.manifests)
+	agent.mtx.Unlock()
+
+	log.Printf("Received manifest %d: %s", count, args.Manifest)
+	if agent.opts.ManifestDir != "" {
+		path := filepath.Join(agent.opts.ManifestDir, time.Now().UTC().Format("20060102T150405.000000000")+".json")
+		if err := ioutil.WriteFile(path, []byte(args.Manifest), 0600); err != nil {
+			log.Printf("Unable to record manifest: %v", err)
+		}
+	}
+	*reply = true
+	return nil
+}
+
+// VirtualMachine is the RPC service of the workload agent
+type VirtualMachine struct {
+	agent *Agent
+}
+
+// FetchFlavor returns the flavor of an image from the flavor directory
+func (vm *VirtualMachine) FetchFlavor(args *wla.FlavorInfo, reply *wla.OutFlavor) error {
+	return vm.agent.fetchFlavor(args, reply)
+}
+
+// FetchKeyWithURL returns the configured key
+func (vm *VirtualMachine) FetchKeyWithURL(args *wla.KeyInfo, reply *wla.KeyInfo) error {
+	return vm.agent.fetchKeyWithURL(args, reply)
+}
+
+// CreateInstanceTrustReport records a manifest
+func (vm *VirtualMachine) CreateInstanceTrustReport(args *wla.ManifestString, reply *bool) error {
+	return vm.agent.createInstanceTrustReport(args, reply)
+}
+
+// Server serves a simulator on a unix socket
+type Server struct {
+	*Agent
+	listener net.Listener
+	server   *rpc.Server
+	wg       sync.WaitGroup
+	mtx      sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+// Listen creates the unix socket, replacing a stale one, and serves the simulator on it in the background
+func Listen(socket string, opts Options) (*Server, error) {
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to listen on %s", socket)
+	}
+	return Serve(listener, opts)
+}
+
+// Serve serves the simulator on a listener in the background
+func Serve(listener net.Listener, opts Options) (*Server, error) {
+	agent := NewAgent(opts)
+	server := rpc.NewServer()
+	if err := server.RegisterName("VirtualMachine", &VirtualMachine{agent: agent}); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	srv := &Server{Agent: agent, listener: listener, server: server, conns: make(map[net.Conn]bool)}
+	srv.wg.Add(1)
+	go srv.accept()
+	return srv, nil
+}
+
+func (srv *Server) accept() {
+	defer srv.wg.Done()
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.mtx.Lock()
+		if srv.closed {
+			srv.mtx.Unlock()
+			conn.Close()
+			return
+		}
+		srv.conns[conn] = true
+		srv.mtx.Unlock()
+
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.server.ServeConn(conn)
+			srv.mtx.Lock()
+			delete(srv.conns, conn)
+			srv.mtx.Unlock()
+		}()
+	}
+}
+
+// Addr returns the socket the simulator listens on
+func (srv *Server) Addr() string {
+	return srv.listener.Addr().String()
+}
+
+// DropConnections closes the client connections, simulating a workload agent restart
+func (srv *Server) DropConnections() {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the simulator and closes the client connections
+func (srv *Server) Close() error {
+	srv.mtx.Lock()
+	srv.closed = true
+	srv.mtx.Unlock()
+	err := srv.listener.Close()
+	srv.DropConnections()
+	srv.wg.Wait()
+	return err
+}
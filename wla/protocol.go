@@ -0,0 +1,36 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package wla
+
+// Methods of the workload agent RPC service
+const (
+	MethodFetchFlavor               = "VirtualMachine.FetchFlavor"
+	MethodFetchKeyWithURL           = "VirtualMachine.FetchKeyWithURL"
+	MethodCreateInstanceTrustReport = "VirtualMachine.CreateInstanceTrustReport"
+)
+
+// FlavorInfo is the argument of VirtualMachine.FetchFlavor
+type FlavorInfo struct {
+	ImageID string
+}
+
+// OutFlavor is the reply of VirtualMachine.FetchFlavor, ImageFlavor is empty when the image has no flavor
+type OutFlavor struct {
+	ReturnCode  bool
+	ImageFlavor string
+}
+
+// KeyInfo is the argument and the reply of VirtualMachine.FetchKeyWithURL
+type KeyInfo struct {
+	KeyUrl     string
+	Key        []byte
+	ReturnCode bool
+}
+
+// ManifestString is the argument of VirtualMachine.CreateInstanceTrustReport
+type ManifestString struct {
+	Manifest string
+}